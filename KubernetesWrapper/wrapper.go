@@ -2,12 +2,15 @@ package kuberneteswrapper
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"os"
-	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/runtimes"
 	"github.com/Cloudbase-Project/serverless/utils"
 	"k8s.io/client-go/kubernetes"
 
@@ -15,14 +18,20 @@ import (
 	v1 "k8s.io/api/apps/v1"
 	"k8s.io/api/autoscaling/v2beta2"
 	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/watch"
 )
 
+// max size of the compressed build context. it has to fit in a configmap
+const MaxBuildContextSize = 1000 * 1024
+
 type KubernetesWrapper struct {
 	KClient *kubernetes.Clientset
 }
@@ -31,9 +40,40 @@ type ImageBuilder struct {
 	Ctx        context.Context
 	Namespace  string
 	FunctionId string
-	Language   constants.Language
-	ImageName  string
-	Code       string
+	// unique per build. builds of the same function can run side by side
+	BuildId   string
+	Runtime   *runtimes.Runtime
+	ImageName string
+	// docker-config secret with the push credentials
+	RegistrySecret string
+	// the registry uses plain http or a self signed certificate
+	Insecure bool
+	// repository kaniko caches layers in. no layer cache when empty
+	CacheRepository string
+	// how long cached layers are used. kaniko's default when empty
+	CacheTTL string
+	// PVC with base images cached by the cache warmer. base images are pulled when empty
+	CacheVolume string
+	Code        string
+	// normalized source archive the generated files are added to. Code is ignored when set
+	Source []byte
+	// repository the builder pod fetches the source from. Code and Source are ignored when set
+	Git *GitSource
+	// validated dependency manifest and lockfile. path -> content
+	DependencyFiles map[string]string
+	// dependency files used when the repository of a git source has none. path -> content
+	DefaultFiles map[string]string
+}
+
+// A commit of a git repository a builder pod fetches and builds
+type GitSource struct {
+	URL string
+	// branch, tag or commit sha. the default branch when empty
+	Ref string
+	// cleaned directory of the function in the repository. the root when empty
+	Subdirectory string
+	// curl resolve entry pinning the host to the addresses checked when the build started
+	Resolve string
 }
 
 type DeploymentOptions struct {
@@ -42,13 +82,45 @@ type DeploymentOptions struct {
 	FunctionId      string
 	DeploymentLabel map[string]string
 	ImageName       string
-	Replicas        int32
+	// docker-config secret with the pull credentials
+	RegistrySecret string
+	Replicas       int32
+	// port the function listens on
+	Port int32
+	// checksum of the function's environment. changing it restarts the pods
+	EnvChecksum string
+	// cpu and memory of the function's container
+	Resources corev1.ResourceRequirements
+	// readiness, liveness and startup probes of the container
+	Probes *ProbeOptions
+}
+
+// Health checks of a function's container. All three probes check the same endpoint
+type ProbeOptions struct {
+	// http path to check. a tcp check of the port when empty
+	Path string
+	Port int32
+	// how often readiness and liveness are checked
+	PeriodSeconds  int32
+	TimeoutSeconds int32
+	// failed checks in a row before a pod is taken out of the service or restarted
+	FailureThreshold int32
+	// how long a container has to pass its first check before it is restarted
+	StartupSeconds int32
 }
 
 type HPAOptions struct {
-	Ctx        context.Context
-	Namespace  string
-	FunctionId string
+	Ctx         context.Context
+	Namespace   string
+	FunctionId  string
+	MinReplicas int32
+	MaxReplicas int32
+	// average cpu utilization to scale at, in percent of the cpu request
+	TargetCPU int32
+	// custom metric of the deployment to scale on instead of cpu
+	MetricName string
+	// average value of MetricName per pod to scale at
+	TargetValue int32
 }
 
 type ServiceOptions struct {
@@ -56,12 +128,24 @@ type ServiceOptions struct {
 	Namespace       string
 	FunctionId      string
 	DeploymentLabel map[string]string
+	// port the function listens on
+	TargetPort int32
 }
 
 type UpdateOptions struct {
 	Ctx       context.Context
 	Namespace string
 	Name      string
+	// switch the deployment to this image. the image is left alone when empty
+	ImageName string
+	// pull secret for ImageName. none when empty
+	RegistrySecret string
+	// checksum of the function's environment. left alone when empty
+	EnvChecksum string
+	// cpu and memory of the container. left alone when nil
+	Resources *corev1.ResourceRequirements
+	// probes of the container. left alone when nil
+	Probes *ProbeOptions
 }
 
 type DeleteOptions struct {
@@ -78,9 +162,10 @@ func (kw *KubernetesWrapper) BuildLabel(key string, value []string) (*labels.Req
 	return labels.NewRequirement(key, selection.Equals, value)
 }
 
+// watch a single image builder pod
 func (kw *KubernetesWrapper) GetImageBuilderWatcher(
 	ctx context.Context,
-	label string,
+	name string,
 ) (watch.Interface, error) {
 	return kw.KClient.CoreV1().
 		Pods(constants.Namespace).
@@ -88,9 +173,12 @@ func (kw *KubernetesWrapper) GetImageBuilderWatcher(
 			// TODO: Donno if the request context should be used here or a custom timeout context should be used here.
 			// r.Context(),
 			ctx,
-			metav1.ListOptions{LabelSelector: label})
+			metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()})
 }
 
+// how long a rollout may make no progress before the deployment controller fails it
+const ProgressDeadline = 10 * time.Minute
+
 func (kw *KubernetesWrapper) GetDeploymentWatcher(
 	ctx context.Context,
 	label string,
@@ -101,24 +189,208 @@ func (kw *KubernetesWrapper) GetDeploymentWatcher(
 		Watch(ctx, metav1.ListOptions{LabelSelector: label})
 }
 
-// Build an image for the given functionId and image name
-func (kw *KubernetesWrapper) CreateImageBuilder(ib *ImageBuilder) (*corev1.Pod, error) {
+/*
+The build context of a build as a gzipped tarball: the source, the dependency files, the
+runtime's scaffold files and its Dockerfile.
+*/
+func BuildContext(ib *ImageBuilder) ([]byte, error) {
+	// generated files. path relative to the context root
+	files := map[string]string{"Dockerfile": ib.Runtime.Dockerfile}
+	if ib.Source == nil && ib.Git == nil {
+		files[ib.Runtime.SourceFile] = ib.Code
+	}
+	for name, content := range ib.DependencyFiles {
+		files[name] = content
+	}
+	for name, content := range ib.Runtime.Files {
+		files[name] = content
+	}
+
+	// the context is handed to kaniko as a tarball in a configmap so the files are never
+	// interpreted by a shell and arrive byte for byte.
+	buildContext, err := utils.BuildContextArchive(ib.Source, files)
+	if err != nil {
+		return nil, err
+	}
+	if len(buildContext) > MaxBuildContextSize {
+		return nil, fmt.Errorf("build context is too large. max %v bytes compressed", MaxBuildContextSize)
+	}
+	return buildContext, nil
+}
+
+// The default dependency files of a git source as a gzipped tarball. nil when there are none
+func BuildContextDefaults(ib *ImageBuilder) ([]byte, error) {
+	if ib.Git == nil || len(ib.DefaultFiles) == 0 {
+		return nil, nil
+	}
+	return utils.BuildContextArchive(nil, ib.DefaultFiles)
+}
+
+/*
+Store the build context in the build's configmap. builder pods mount it at /context. Git
+sources get their default dependency files next to it.
+*/
+func (kw *KubernetesWrapper) applyBuildContext(ib *ImageBuilder) error {
+	buildContext, err := BuildContext(ib)
+	if err != nil {
+		return err
+	}
+	data := map[string][]byte{"context.tar.gz": buildContext}
+	defaults, err := BuildContextDefaults(ib)
+	if err != nil {
+		return err
+	}
+	if defaults != nil {
+		data["defaults.tar.gz"] = defaults
+	}
+	return kw.ApplyConfigMap(ib.Ctx, ib.Namespace, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   BuildContextName(ib.FunctionId, ib.BuildId),
+			Labels: map[string]string{"builder": ib.FunctionId, "build": ib.BuildId},
+		},
+		BinaryData: data,
+	})
+}
 
-	var Dockerfile string
-	if ib.Language == constants.NODEJS {
-		Dockerfile = constants.NodejsDockerfile
+/*
+Fetches one commit of a git repository and lays out the build context in /workspace: the default
+dependency files, the repository's subdirectory over them and the generated files over that.
+The commit's sha ends up in the container's termination message. Arguments are passed as
+positional parameters so nothing in them is interpreted by the shell. Credentials are only
+read from the function's secret, never from the url or the node.
+*/
+const gitFetchScript = `set -e
+url="$1" ref="${2:-HEAD}" subdirectory="$3" resolve="$4" source_file="$5"
+# redirects would go to hosts that weren't checked
+set -- -c credential.helper= -c http.followRedirects=false
+if [ -f /git-credentials/token ]; then
+  set -- "$@" -c 'credential.helper=!f() { echo "username=$(cat /git-credentials/username)"; echo "password=$(cat /git-credentials/token)"; }; f'
+fi
+if [ -n "$resolve" ]; then
+  set -- "$@" -c "http.curloptResolve=$resolve"
+fi
+mkdir /tmp/repository
+cd /tmp/repository
+git init -q
+echo "Fetching $ref of $url"
+git "$@" fetch -q --depth=1 --no-tags "$url" "$ref"
+commit=$(git rev-parse 'FETCH_HEAD^{commit}')
+echo "Fetched commit $commit"
+cd /workspace
+if [ -f /context/defaults.tar.gz ]; then
+  tar -xzf /context/defaults.tar.gz
+fi
+git -C /tmp/repository archive --format=tar "$commit${subdirectory:+:$subdirectory}" | tar -xf -
+if [ ! -f "$source_file" ]; then
+  echo "source must contain $source_file"
+  exit 1
+fi
+tar -xzf /context/context.tar.gz
+printf '%s' "$commit" > /dev/termination-log
+`
 
+// name of the init container fetching a git source. its termination message is the commit
+const GitFetchContainer = "fetch"
+
+// init container fetching the build's git source into the workspace volume
+func gitFetchContainer(ib *ImageBuilder) corev1.Container {
+	return corev1.Container{
+		Name:  GitFetchContainer,
+		Image: "alpine/git:2.40.1",
+		Command: []string{
+			"/bin/sh", "-c", gitFetchScript, "fetch",
+			ib.Git.URL, ib.Git.Ref, ib.Git.Subdirectory, ib.Git.Resolve, ib.Runtime.SourceFile,
+		},
+		Env: []corev1.EnvVar{{Name: "GIT_TERMINAL_PROMPT", Value: "0"}},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "context", MountPath: "/context"},
+			{Name: "workspace", MountPath: "/workspace"},
+			{Name: "git-credentials", MountPath: "/git-credentials", ReadOnly: true},
+		},
 	}
-	// else if ib.Language == constants.GOLANG {
-	// 	Dockerfile = constants.GolangDockerfile
-	// }
+}
 
-	m1 := regexp.MustCompile(`"`)
-	packagejson := m1.ReplaceAllString(constants.NodejsPackageJSON, `\"`)
-	dockerfile := m1.ReplaceAllString(Dockerfile, `\"`)
+// the function's git credentials. the secret may not exist
+func gitCredentialsVolume(functionId string) corev1.Volume {
+	optional := true
+	return corev1.Volume{
+		Name: "git-credentials",
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+			SecretName: GitCredentialsName(functionId),
+			Optional:   &optional,
+		}},
+	}
+}
+
+// name of the secret with the username and token a function's git source is fetched with
+func GitCredentialsName(functionId string) string {
+	return functionId + "-git"
+}
 
-	REGISTRY := os.Getenv("REGISTRY")
-	BASE64_CREDENTIALS := os.Getenv("BASE64_CREDENTIALS")
+func workspaceVolume() corev1.Volume {
+	return corev1.Volume{Name: "workspace", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+}
+
+// the configmap holding the build context
+func buildContextVolume(ib *ImageBuilder) corev1.Volume {
+	return corev1.Volume{
+		Name: "context",
+		VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: BuildContextName(ib.FunctionId, ib.BuildId)},
+		}},
+	}
+}
+
+// Build an image for the given functionId and image name with a kaniko pod
+func (kw *KubernetesWrapper) CreateImageBuilder(ib *ImageBuilder) (*corev1.Pod, error) {
+	if err := kw.applyBuildContext(ib); err != nil {
+		return nil, err
+	}
+
+	buildContext := "tar:///context/context.tar.gz"
+	if ib.Git != nil {
+		// git sources are fetched by an init container and built from the directory it fills
+		buildContext = "dir:///workspace"
+	}
+	args := []string{
+		"--dockerfile=Dockerfile",
+		"--context=" + buildContext,
+		// "--no-push",
+		"--destination=" + ib.ImageName,
+		// the digest ends up in the container's termination message
+		"--digest-file=/dev/termination-log",
+	}
+	if ib.Insecure {
+		args = append(args, "--insecure", "--skip-tls-verify", "--insecure-pull")
+	}
+
+	mounts := []corev1.VolumeMount{{
+		Name:      "context",
+		MountPath: "/context",
+	}, {
+		Name:      "dockerconfig",
+		MountPath: "/kaniko/.docker",
+	}}
+	volumes := []corev1.Volume{buildContextVolume(ib), registrySecretVolume(ib.RegistrySecret)}
+
+	var initContainers []corev1.Container
+	if ib.Git != nil {
+		initContainers = append(initContainers, gitFetchContainer(ib))
+		mounts = append(mounts, corev1.VolumeMount{Name: "workspace", MountPath: "/workspace"})
+		volumes = append(volumes, workspaceVolume(), gitCredentialsVolume(ib.FunctionId))
+	}
+
+	if ib.CacheRepository != "" {
+		args = append(args, "--cache=true", "--cache-repo="+ib.CacheRepository)
+		if ib.CacheTTL != "" {
+			args = append(args, "--cache-ttl="+ib.CacheTTL)
+		}
+	}
+	if ib.CacheVolume != "" {
+		args = append(args, "--cache-dir=/cache")
+		mounts = append(mounts, corev1.VolumeMount{Name: "cache", MountPath: "/cache", ReadOnly: true})
+		volumes = append(volumes, cacheVolume(ib.CacheVolume, true))
+	}
 
 	pod, err := kw.KClient.CoreV1().Pods(ib.Namespace).Create(ib.Ctx, &corev1.Pod{
 		TypeMeta: metav1.TypeMeta{
@@ -126,68 +398,312 @@ func (kw *KubernetesWrapper) CreateImageBuilder(ib *ImageBuilder) (*corev1.Pod,
 			APIVersion: "v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "kaniko-worker",
+			Name: BuilderName(ib.FunctionId, ib.BuildId),
 			Labels: map[string]string{
 				"builder": ib.FunctionId, // the code id
+				"build":   ib.BuildId,
 			},
 		},
 		Spec: corev1.PodSpec{
-			InitContainers: []corev1.Container{{
-				Name:  "setup-kaniko",
-				Image: "yauritux/busybox-curl",
-				Command: []string{
-					"/bin/sh",
-					"-c",
-					// "curl -XGET http://cloudbase-serverless-srv.default:3000/worker/queue -o /workspace/index.js && echo -e " + Dockerfile + " >> /workspace/Dockerfile && echo -e " + constants.NodejsPackageJSON + " >> /workspace/package.json && echo -e " + constants.RegistryCredentials + " >> /kaniko/.docker/config.json ",
-					// "echo -e " + ib.Code + " >> /workspace/index.js && echo -e " + Dockerfile + " >> /workspace/Dockerfile && echo -e " + constants.NodejsPackageJSON + " >> /workspace/package.json",
-					`echo -e  "` + ib.Code + `" >> /workspace/index.js && echo -e "` + dockerfile + `" >> /workspace/Dockerfile && echo -e "` + packagejson + `" >> /workspace/package.json && echo -e "{\"auths\":{\"` + REGISTRY + `\":{\"auth\": \"` + BASE64_CREDENTIALS + `\" }}}" > /kaniko/.docker/config.json`,
-				},
-				VolumeMounts: []corev1.VolumeMount{{
-					Name:      "shared",
-					MountPath: "/workspace",
-				}, {
-					Name:      "dockerconfig",
-					MountPath: "/kaniko/.docker",
-				}},
+			InitContainers: initContainers,
+			Containers: []corev1.Container{{
+				Name:         "kaniko-executor",
+				Image:        "gcr.io/kaniko-project/executor:latest",
+				Args:         args,
+				VolumeMounts: mounts,
 			}},
+			RestartPolicy: corev1.RestartPolicyNever,
+			Volumes:       volumes,
+		},
+	}, metav1.CreateOptions{})
+	return pod, err
+}
+
+/*
+Runs rootless buildctl in daemonless mode with the build's arguments. The pushed digest is
+written to the termination message like kaniko does. Arguments are passed as positional
+parameters so nothing in them is interpreted by the shell.
+*/
+const buildkitScript = `set -e
+buildctl-daemonless.sh build "$@" --metadata-file /tmp/metadata.json
+sed -n 's/.*"containerimage.digest": *"\(sha256:[0-9a-f]*\)".*/\1/p' /tmp/metadata.json > /dev/termination-log
+`
+
+// Build an image for the given functionId and image name with a rootless BuildKit pod
+func (kw *KubernetesWrapper) CreateBuildKitBuilder(ib *ImageBuilder) (*corev1.Pod, error) {
+	if err := kw.applyBuildContext(ib); err != nil {
+		return nil, err
+	}
+
+	output := "type=image,name=" + ib.ImageName + ",push=true"
+	if ib.Insecure {
+		output += ",registry.insecure=true"
+	}
+	args := []string{
+		"--frontend", "dockerfile.v0",
+		"--local", "context=/workspace",
+		"--local", "dockerfile=/workspace",
+		"--output", output,
+	}
+	if ib.CacheRepository != "" {
+		cache := "type=registry,ref=" + ib.CacheRepository + ":buildcache"
+		args = append(args, "--export-cache", cache+",mode=max", "--import-cache", cache)
+	}
+
+	// buildctl wants a plain directory. unpack the context tarball first, or fetch the git source
+	unpack := corev1.Container{
+		Name:    "unpack",
+		Image:   "busybox:1.35",
+		Command: []string{"tar", "-xzf", "/context/context.tar.gz", "-C", "/workspace"},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "context", MountPath: "/context"},
+			{Name: "workspace", MountPath: "/workspace"},
+		},
+	}
+	volumes := []corev1.Volume{
+		buildContextVolume(ib),
+		registrySecretVolume(ib.RegistrySecret),
+		workspaceVolume(),
+		{Name: "buildkitd", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	}
+	if ib.Git != nil {
+		unpack = gitFetchContainer(ib)
+		volumes = append(volumes, gitCredentialsVolume(ib.FunctionId))
+	}
+
+	return kw.KClient.CoreV1().Pods(ib.Namespace).Create(ib.Ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: BuilderName(ib.FunctionId, ib.BuildId),
+			Labels: map[string]string{
+				"builder": ib.FunctionId,
+				"build":   ib.BuildId,
+			},
+			// rootless buildkit needs to create user namespaces
+			Annotations: map[string]string{
+				"container.apparmor.security.beta.kubernetes.io/buildkit": "unconfined",
+			},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{unpack},
 			Containers: []corev1.Container{{
-				Name:  "kaniko-executor",
-				Image: "gcr.io/kaniko-project/executor:latest",
-				Args: []string{
-					"--dockerfile=/workspace/Dockerfile",
-					"--context=dir:///workspace",
-					// "--no-push",
-					"--destination=" + ib.ImageName,
+				Name:    "buildkit",
+				Image:   "moby/buildkit:rootless",
+				Command: append([]string{"/bin/sh", "-c", buildkitScript, "buildkit"}, args...),
+				Env: []corev1.EnvVar{
+					{Name: "BUILDKITD_FLAGS", Value: "--oci-worker-no-process-sandbox"},
+					{Name: "DOCKER_CONFIG", Value: "/docker"},
+				},
+				SecurityContext: &corev1.SecurityContext{
+					SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined},
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "workspace", MountPath: "/workspace"},
+					{Name: "dockerconfig", MountPath: "/docker"},
+					{Name: "buildkitd", MountPath: "/home/user/.local/share/buildkit"},
 				},
+			}},
+			RestartPolicy: corev1.RestartPolicyNever,
+			Volumes:       volumes,
+		},
+	}, metav1.CreateOptions{})
+}
+
+// name of the pod warming the base image cache
+const CacheWarmerName = "kaniko-warmer"
+
+/*
+Start a pod pulling images into the base image cache on the PVC. Images already cached are
+skipped. A warmer still running from before is replaced.
+*/
+func (kw *KubernetesWrapper) CreateCacheWarmer(
+	ctx context.Context,
+	namespace string,
+	volume string,
+	registrySecret string,
+	images []string,
+) (*corev1.Pod, error) {
+	err := kw.KClient.CoreV1().Pods(namespace).Delete(ctx, CacheWarmerName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	// the old pod takes a moment to go away
+	for i := 0; i < 30; i++ {
+		_, err = kw.KClient.CoreV1().Pods(namespace).Get(ctx, CacheWarmerName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	args := []string{"--cache-dir=/cache"}
+	for _, image := range images {
+		args = append(args, "--image="+image)
+	}
+	return kw.KClient.CoreV1().Pods(namespace).Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   CacheWarmerName,
+			Labels: map[string]string{"app": CacheWarmerName},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  "kaniko-warmer",
+				Image: "gcr.io/kaniko-project/warmer:latest",
+				Args:  args,
 				VolumeMounts: []corev1.VolumeMount{{
-					Name:      "shared",
-					MountPath: "/workspace",
+					Name:      "cache",
+					MountPath: "/cache",
 				}, {
 					Name:      "dockerconfig",
 					MountPath: "/kaniko/.docker",
 				}},
 			}},
-			RestartPolicy: corev1.RestartPolicyNever,
-			Volumes: []corev1.Volume{{
-				Name: "shared", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
-			},
-				{
-					Name: "dockerconfig", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			RestartPolicy: corev1.RestartPolicyOnFailure,
+			Volumes:       []corev1.Volume{cacheVolume(volume, false), registrySecretVolume(registrySecret)},
+		},
+	}, metav1.CreateOptions{})
+}
+
+// the docker-config secret mounted as kaniko's config.json
+// pull secrets of a deployment's pods. none for registries that don't need one
+func imagePullSecrets(name string) []corev1.LocalObjectReference {
+	if name == "" {
+		return nil
+	}
+	return []corev1.LocalObjectReference{{Name: name}}
+}
+
+func registrySecretVolume(name string) corev1.Volume {
+	return corev1.Volume{
+		Name: "dockerconfig",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: name,
+				Items: []corev1.KeyToPath{
+					{Key: corev1.DockerConfigJsonKey, Path: "config.json"},
 				},
-				// {Name: "dockerconfig",
-				// 	VolumeSource: corev1.VolumeSource{
-				// 		Secret: &corev1.SecretVolumeSource{
-				// 			SecretName: "regcred",
-				// 			Items: []corev1.KeyToPath{
-				// 				{Key: ".dockerconfigjson", Path: "config.json"},
-				// 			},
-				// 		},
-				// 	}},
 			},
 		},
-	}, metav1.CreateOptions{})
-	fmt.Printf("err: %v\n", err)
-	return pod, err
+	}
+}
+
+func cacheVolume(claim string, readOnly bool) corev1.Volume {
+	return corev1.Volume{
+		Name: "cache",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim, ReadOnly: readOnly},
+		},
+	}
+}
+
+/*
+Create or replace the docker-config secret for the registry from base64 encoded "user:password"
+credentials.
+*/
+func (kw *KubernetesWrapper) ApplyRegistrySecret(
+	ctx context.Context,
+	namespace string,
+	name string,
+	registry string,
+	base64Credentials string,
+) error {
+	config, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			registry: map[string]string{"auth": base64Credentials},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: config},
+	}
+	_, err = kw.KClient.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = kw.KClient.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+/*
+Read the username and password for a registry host from a docker-config secret. Both are empty
+if the secret has no entry for the host.
+*/
+func (kw *KubernetesWrapper) GetRegistryCredentials(
+	ctx context.Context,
+	namespace string,
+	name string,
+	host string,
+) (string, string, error) {
+	secret, err := kw.KClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", "", err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+		return "", "", err
+	}
+	for key, entry := range config.Auths {
+		// keys can be full urls like https://index.docker.io/v1/
+		key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+		if strings.SplitN(key, "/", 2)[0] != host {
+			continue
+		}
+		if entry.Username != "" {
+			return entry.Username, entry.Password, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", "", err
+		}
+		credentials := strings.SplitN(string(decoded), ":", 2)
+		if len(credentials) != 2 {
+			return "", "", fmt.Errorf("secret %v: invalid auth for %v", name, host)
+		}
+		return credentials[0], credentials[1], nil
+	}
+	return "", "", nil
+}
+
+// name of the image builder pod of a build
+func BuilderName(functionId string, buildId string) string {
+	return "kaniko-" + functionId + "-" + buildId
+}
+
+// name of the configmap holding the build context of a build
+func BuildContextName(functionId string, buildId string) string {
+	return "kaniko-context-" + functionId + "-" + buildId
+}
+
+// Create the configmap or replace it if it already exists
+func (kw *KubernetesWrapper) ApplyConfigMap(
+	ctx context.Context,
+	namespace string,
+	configMap *corev1.ConfigMap,
+) error {
+	_, err := kw.KClient.CoreV1().ConfigMaps(namespace).Create(ctx, configMap, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = kw.KClient.CoreV1().ConfigMaps(namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// Delete the configmap. A missing configmap is not an error
+func (kw *KubernetesWrapper) DeleteConfigMap(options *DeleteOptions) error {
+	err := kw.KClient.CoreV1().
+		ConfigMaps(options.Namespace).
+		Delete(options.Ctx, options.Name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
 }
 
 func (kw *KubernetesWrapper) CreateNamespace(
@@ -205,8 +721,6 @@ func (kw *KubernetesWrapper) CreateHPA(
 	options *HPAOptions,
 ) (*v2beta2.HorizontalPodAutoscaler, error) {
 
-	averageUtilization := int32(15)
-
 	return kw.KClient.AutoscalingV2beta2().
 		HorizontalPodAutoscalers(options.Namespace).
 		Create(options.Ctx, &v2beta2.HorizontalPodAutoscaler{
@@ -214,29 +728,87 @@ func (kw *KubernetesWrapper) CreateHPA(
 				Kind:       "HorizontalPodAutoscaler",
 				APIVersion: "autoscaling/v2beta1",
 			}, ObjectMeta: metav1.ObjectMeta{
-				Name: "serverless-" + options.FunctionId + "-hpa",
+				Name: HPAName(options.FunctionId),
 			},
-			Spec: v2beta2.HorizontalPodAutoscalerSpec{
-				ScaleTargetRef: v2beta2.CrossVersionObjectReference{
-					Kind:       "Deployment",
-					Name:       options.FunctionId,
-					APIVersion: "apps/v1",
+			Spec: hpaSpec(options)}, metav1.CreateOptions{})
+}
+
+// Create the function's hpa or update its bounds and target if it exists
+func (kw *KubernetesWrapper) ApplyHPA(options *HPAOptions) error {
+	hpa, err := kw.KClient.AutoscalingV2beta2().
+		HorizontalPodAutoscalers(options.Namespace).
+		Get(options.Ctx, HPAName(options.FunctionId), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = kw.CreateHPA(options)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	hpa.Spec = hpaSpec(options)
+	_, err = kw.KClient.AutoscalingV2beta2().
+		HorizontalPodAutoscalers(options.Namespace).
+		Update(options.Ctx, hpa, metav1.UpdateOptions{})
+	return err
+}
+
+// name of a function's hpa
+func HPAName(functionId string) string {
+	return "serverless-" + functionId + "-hpa"
+}
+
+func hpaSpec(options *HPAOptions) v2beta2.HorizontalPodAutoscalerSpec {
+	minReplicas := options.MinReplicas
+	averageUtilization := options.TargetCPU
+	target := v2beta2.CrossVersionObjectReference{
+		Kind:       "Deployment",
+		Name:       options.FunctionId,
+		APIVersion: "apps/v1",
+	}
+	metric := v2beta2.MetricSpec{
+		Resource: &v2beta2.ResourceMetricSource{
+			Name: corev1.ResourceCPU, Target: v2beta2.MetricTarget{
+				Type:               v2beta2.UtilizationMetricType,
+				AverageUtilization: &averageUtilization,
+			},
+		},
+		Type: v2beta2.MetricSourceType("Resource"),
+	}
+	if options.MetricName != "" {
+		// the metric describes the whole deployment. AverageValue divides it by the replicas
+		metric = v2beta2.MetricSpec{
+			Object: &v2beta2.ObjectMetricSource{
+				DescribedObject: target,
+				Metric:          v2beta2.MetricIdentifier{Name: options.MetricName},
+				Target: v2beta2.MetricTarget{
+					Type:         v2beta2.AverageValueMetricType,
+					AverageValue: resource.NewQuantity(int64(options.TargetValue), resource.DecimalSI),
 				},
-				MaxReplicas: 3,
-
-				Metrics: []v2beta2.MetricSpec{
-					{
-						Resource: &v2beta2.ResourceMetricSource{
-							Name: corev1.ResourceCPU, Target: v2beta2.MetricTarget{
-								Type:               v2beta2.UtilizationMetricType,
-								AverageUtilization: &averageUtilization,
-							},
-						},
-						Type: v2beta2.MetricSourceType("Resource"),
-					}}}}, metav1.CreateOptions{})
+			},
+			Type: v2beta2.ObjectMetricSourceType,
+		}
+	}
+	return v2beta2.HorizontalPodAutoscalerSpec{
+		ScaleTargetRef: target,
+		MinReplicas:    &minReplicas,
+		MaxReplicas:    options.MaxReplicas,
+		Metrics:        []v2beta2.MetricSpec{metric},
+	}
+}
+
+// Delete the function's hpa. A missing hpa is not an error
+func (kw *KubernetesWrapper) DeleteHPA(options *DeleteOptions) error {
+	err := kw.KClient.AutoscalingV2beta2().
+		HorizontalPodAutoscalers(options.Namespace).
+		Delete(options.Ctx, HPAName(options.Name), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
 }
 
 func (kw *KubernetesWrapper) CreateDeployment(options *DeploymentOptions) (*v1.Deployment, error) {
+	progressDeadline := int32(ProgressDeadline.Seconds())
 	return kw.KClient.AppsV1().
 		Deployments(options.Namespace).
 		Create(options.Ctx,
@@ -252,23 +824,31 @@ func (kw *KubernetesWrapper) CreateDeployment(options *DeploymentOptions) (*v1.D
 						// TODO:
 						MatchLabels: options.DeploymentLabel,
 					},
-					Replicas: &options.Replicas, // TODO: Have to do more here
+					Replicas:                &options.Replicas, // TODO: Have to do more here
+					ProgressDeadlineSeconds: &progressDeadline,
 					Template: corev1.PodTemplateSpec{
-						ObjectMeta: metav1.ObjectMeta{Labels: options.DeploymentLabel},
+						ObjectMeta: metav1.ObjectMeta{
+							Labels:      options.DeploymentLabel,
+							Annotations: map[string]string{EnvChecksumAnnotation: options.EnvChecksum},
+						},
 						Spec: corev1.PodSpec{
 							RestartPolicy: corev1.RestartPolicyAlways,
 							Containers: []corev1.Container{{
 								// TODO:
 								Name:  options.FunctionId,
 								Image: options.ImageName, // "image name from db", // should be ghcr.io/projectname/codeId:latest
-								Ports: []corev1.ContainerPort{{ContainerPort: 3000}},
-								Resources: corev1.ResourceRequirements{
-									Requests: corev1.ResourceList{
-										corev1.ResourceCPU: resource.MustParse("250m"),
-									},
-								},
+								Ports: []corev1.ContainerPort{{ContainerPort: options.Port}},
+								Env: []corev1.EnvVar{{
+									Name:  "PORT",
+									Value: strconv.Itoa(int(options.Port)),
+								}},
+								EnvFrom:        envFrom(options.FunctionId),
+								Resources:      options.Resources,
+								ReadinessProbe: periodicProbe(options.Probes),
+								LivenessProbe:  periodicProbe(options.Probes),
+								StartupProbe:   startupProbe(options.Probes),
 							}},
-							ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}},
+							ImagePullSecrets: imagePullSecrets(options.RegistrySecret),
 						},
 					},
 				},
@@ -290,12 +870,21 @@ func (kw *KubernetesWrapper) CreateService(options *ServiceOptions) (*corev1.Ser
 				Selector: options.DeploymentLabel,
 				Type:     corev1.ServiceTypeClusterIP,
 				Ports: []corev1.ServicePort{
-					{Port: 4000, TargetPort: intstr.FromInt(4000)},
+					{Port: 4000, TargetPort: intstr.FromInt(int(options.TargetPort))},
 				},
 			},
 		}, metav1.CreateOptions{})
 }
 
+// Whether the deployment exists
+func (kw *KubernetesWrapper) DeploymentExists(ctx context.Context, namespace string, name string) (bool, error) {
+	_, err := kw.KClient.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // Delete the deployment
 func (kw *KubernetesWrapper) DeleteDeployment(options *DeleteOptions) error {
 	return kw.KClient.AppsV1().
@@ -310,7 +899,7 @@ func (kw *KubernetesWrapper) DeleteService(options *DeleteOptions) error {
 		Delete(options.Ctx, options.Name, metav1.DeleteOptions{})
 }
 
-// updates the deployment label with current timestamp to trigger a redeploy
+// updates the deployment label with current timestamp to trigger a redeploy. Also sets the image if given
 func (kw *KubernetesWrapper) UpdateDeployment(options *UpdateOptions) error {
 
 	deployment, err := kw.KClient.AppsV1().
@@ -321,7 +910,23 @@ func (kw *KubernetesWrapper) UpdateDeployment(options *UpdateOptions) error {
 		return err
 	}
 
+	if deployment.Spec.Template.ObjectMeta.Annotations == nil {
+		deployment.Spec.Template.ObjectMeta.Annotations = map[string]string{}
+	}
 	deployment.Spec.Template.ObjectMeta.Annotations["date"] = time.Now().String()
+	if options.EnvChecksum != "" {
+		setDeploymentEnv(deployment, options.EnvChecksum)
+	}
+	if options.ImageName != "" {
+		deployment.Spec.Template.Spec.Containers[0].Image = options.ImageName
+		deployment.Spec.Template.Spec.ImagePullSecrets = imagePullSecrets(options.RegistrySecret)
+	}
+	if options.Resources != nil {
+		deployment.Spec.Template.Spec.Containers[0].Resources = *options.Resources
+	}
+	if options.Probes != nil {
+		setProbes(&deployment.Spec.Template.Spec.Containers[0], options.Probes)
+	}
 
 	_, err = kw.KClient.AppsV1().
 		Deployments(options.Namespace).
@@ -331,3 +936,215 @@ func (kw *KubernetesWrapper) UpdateDeployment(options *UpdateOptions) error {
 	}
 	return nil
 }
+
+// annotation on a function's pods with the checksum of its environment
+const EnvChecksumAnnotation = "serverless/env-checksum"
+
+// name of the configmap with a function's plain environment variables and the secret with its secret ones
+func EnvName(functionId string) string {
+	return functionId + "-env"
+}
+
+// the function's env configmap and secret as env sources. either may not exist
+func envFrom(functionId string) []corev1.EnvFromSource {
+	optional := true
+	name := corev1.LocalObjectReference{Name: EnvName(functionId)}
+	return []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: name, Optional: &optional}},
+		{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: name, Optional: &optional}},
+	}
+}
+
+// point the deployment's container at the function's env and set the checksum
+func setDeploymentEnv(deployment *v1.Deployment, checksum string) {
+	template := &deployment.Spec.Template
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[EnvChecksumAnnotation] = checksum
+	template.Spec.Containers[0].EnvFrom = envFrom(deployment.Name)
+}
+
+// Set the checksum of the function's environment on its deployment. Returns whether its pods are replaced
+func (kw *KubernetesWrapper) SetDeploymentEnv(
+	ctx context.Context,
+	namespace string,
+	name string,
+	checksum string,
+) (bool, error) {
+	return kw.updatePodTemplate(ctx, namespace, name, func(deployment *v1.Deployment) {
+		setDeploymentEnv(deployment, checksum)
+	})
+}
+
+// Create the secret or replace it if it already exists
+func (kw *KubernetesWrapper) ApplySecret(
+	ctx context.Context,
+	namespace string,
+	secret *corev1.Secret,
+) error {
+	_, err := kw.KClient.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = kw.KClient.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// Delete the secret. A missing secret is not an error
+func (kw *KubernetesWrapper) DeleteSecret(options *DeleteOptions) error {
+	err := kw.KClient.CoreV1().
+		Secrets(options.Namespace).
+		Delete(options.Ctx, options.Name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Set the cpu and memory of the deployment's container. Returns whether its pods are replaced
+func (kw *KubernetesWrapper) SetDeploymentResources(
+	ctx context.Context,
+	namespace string,
+	name string,
+	resources corev1.ResourceRequirements,
+) (bool, error) {
+	return kw.updatePodTemplate(ctx, namespace, name, func(deployment *v1.Deployment) {
+		deployment.Spec.Template.Spec.Containers[0].Resources = resources
+	})
+}
+
+/*
+Change the pod template of a deployment with mutate and update it if anything changed. A changed
+template makes the deployment replace its pods one by one. Returns whether it does.
+*/
+func (kw *KubernetesWrapper) updatePodTemplate(
+	ctx context.Context,
+	namespace string,
+	name string,
+	mutate func(deployment *v1.Deployment),
+) (bool, error) {
+	deployment, err := kw.KClient.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	before := deployment.Spec.Template.DeepCopy()
+	mutate(deployment)
+	if apiequality.Semantic.DeepEqual(before, &deployment.Spec.Template) {
+		return false, nil
+	}
+	_, err = kw.KClient.AppsV1().Deployments(namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+	return err == nil, err
+}
+
+// Replicas the deployment is scaled to
+func (kw *KubernetesWrapper) GetDeploymentReplicas(ctx context.Context, namespace string, name string) (int32, error) {
+	scale, err := kw.KClient.AppsV1().Deployments(namespace).GetScale(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return scale.Spec.Replicas, nil
+}
+
+/*
+Scale the deployment. An hpa leaves a deployment at 0 replicas alone and takes over again once it
+is scaled back up.
+*/
+func (kw *KubernetesWrapper) ScaleDeployment(
+	ctx context.Context,
+	namespace string,
+	name string,
+	replicas int32,
+) error {
+	scale, err := kw.KClient.AppsV1().Deployments(namespace).GetScale(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if scale.Spec.Replicas == replicas {
+		return nil
+	}
+	scale.Spec.Replicas = replicas
+	_, err = kw.KClient.AppsV1().Deployments(namespace).UpdateScale(ctx, name, scale, metav1.UpdateOptions{})
+	return err
+}
+
+// Number of ready addresses behind the service
+func (kw *KubernetesWrapper) ReadyEndpoints(ctx context.Context, namespace string, serviceName string) (int, error) {
+	endpoints, err := kw.KClient.CoreV1().Endpoints(namespace).Get(ctx, serviceName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	ready := 0
+	for _, subset := range endpoints.Subsets {
+		ready += len(subset.Addresses)
+	}
+	return ready, nil
+}
+
+// how often the startup probe checks
+const startupPeriodSeconds = 2
+
+// an http get of the path, or a tcp connect to the port without one
+func probeHandler(options *ProbeOptions) corev1.Handler {
+	port := intstr.FromInt(int(options.Port))
+	if options.Path == "" {
+		return corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: port}}
+	}
+	// the scheme is set because the api server would default it, and comparing probes would fail
+	return corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Path: options.Path, Port: port, Scheme: corev1.URISchemeHTTP}}
+}
+
+/*
+Readiness takes a pod out of the service while it fails, liveness restarts a container that
+stopped answering. Both check the same way. nil without options
+*/
+func periodicProbe(options *ProbeOptions) *corev1.Probe {
+	if options == nil {
+		return nil
+	}
+	return &corev1.Probe{
+		Handler:          probeHandler(options),
+		PeriodSeconds:    options.PeriodSeconds,
+		TimeoutSeconds:   options.TimeoutSeconds,
+		FailureThreshold: options.FailureThreshold,
+		SuccessThreshold: 1,
+	}
+}
+
+// holds off the other probes until the container first answers. nil without options
+func startupProbe(options *ProbeOptions) *corev1.Probe {
+	if options == nil {
+		return nil
+	}
+	failureThreshold := (options.StartupSeconds + startupPeriodSeconds - 1) / startupPeriodSeconds
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	return &corev1.Probe{
+		Handler:          probeHandler(options),
+		PeriodSeconds:    startupPeriodSeconds,
+		TimeoutSeconds:   options.TimeoutSeconds,
+		FailureThreshold: failureThreshold,
+		SuccessThreshold: 1,
+	}
+}
+
+func setProbes(container *corev1.Container, options *ProbeOptions) {
+	container.ReadinessProbe = periodicProbe(options)
+	container.LivenessProbe = periodicProbe(options)
+	container.StartupProbe = startupProbe(options)
+}
+
+// Set the probes of the deployment's container. Returns whether its pods are replaced
+func (kw *KubernetesWrapper) SetDeploymentProbes(
+	ctx context.Context,
+	namespace string,
+	name string,
+	options *ProbeOptions,
+) (bool, error) {
+	return kw.updatePodTemplate(ctx, namespace, name, func(deployment *v1.Deployment) {
+		setProbes(&deployment.Spec.Template.Spec.Containers[0], options)
+	})
+}
@@ -5,23 +5,38 @@ type Language string
 const (
 	NODEJS Language = "NODEJS"
 	GOLANG Language = "GOLANG"
+	PYTHON Language = "PYTHON"
 )
 
 const (
-	NodejsDockerfile  = "FROM node:alpine \n workdir /app \n copy package.json . \n run npm install \n copy . . \n cmd [\"node\", \"index.js\"]"
-	NodejsPackageJSON = "{\r\n  \"name\": \"user-code-worker\",\r\n  \"version\": \"1.0.0\",\r\n  \"main\": \"index.js\",\r\n  \"license\": \"MIT\",\r\n  \"dependencies\": {\r\n    \"express\": \"^4.17.1\"\r\n  }\r\n}\r\n"
 	// Namespace           = "serverless"
 	Namespace           = "default"
 	RegistryCredentials = "qweqwe"
 )
 
+type SourceType string
+
+const (
+	// code sent in the build request
+	InlineSource SourceType = "Inline"
+	// uploaded tar.gz or zip archive
+	ArchiveSource SourceType = "Archive"
+	// a subdirectory of a git repository at a ref
+	GitSource SourceType = "Git"
+)
+
 type BuildStatus string
 
 const (
+	Queued       BuildStatus = "Queued"
 	Building     BuildStatus = "Building"
 	BuildSuccess BuildStatus = "Success"
 	BuildFailed  BuildStatus = "Failed"
 	NotBuilt     BuildStatus = "NotBuilt"
+	// cancelled through the API, before or while it ran
+	BuildCancelled BuildStatus = "Cancelled"
+	// ran longer than the build timeout
+	BuildTimedOut BuildStatus = "TimedOut"
 )
 
 type DeploymentStatus string
@@ -42,4 +57,45 @@ const (
 	DeployAction LastAction = "Deploy"
 	BuildAction  LastAction = "Build"
 	CreateAction LastAction = "Create"
+	// the deployment was pointed back at an earlier revision
+	RollbackAction LastAction = "Rollback"
+)
+
+type JobType string
+
+const (
+	BuildJob    JobType = "Build"
+	UpdateJob   JobType = "Update"
+	DeployJob   JobType = "Deploy"
+	RedeployJob JobType = "Redeploy"
+	RollbackJob JobType = "Rollback"
+)
+
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "Pending"
+	JobRunning   JobStatus = "Running"
+	JobSucceeded JobStatus = "Succeeded"
+	JobFailed    JobStatus = "Failed"
+)
+
+type ScalingMetric string
+
+const (
+	// average cpu utilization of the pods
+	CPUMetric ScalingMetric = "CPU"
+	// requests being handled at once, per pod
+	ConcurrencyMetric ScalingMetric = "Concurrency"
+	// requests per second, per pod
+	RPSMetric ScalingMetric = "RPS"
+)
+
+type Scaler string
+
+const (
+	// kubernetes' hpa. request metrics are read through the custom metrics api
+	HPAScaler Scaler = "HPA"
+	// the server's own loop, on the request metrics it collects at the proxy
+	BuiltinScaler Scaler = "Builtin"
 )
@@ -3,4 +3,10 @@ package dtos
 type CreateConfigDTO struct {
 	Owner     string `valid:"required;type(string)"`
 	ProjectId string `valid:"required;type(string)"`
+	// build timeout in seconds. the runtime's or the server's when left out
+	BuildTimeout int `valid:"optional"`
+	// per function maximums, as kubernetes quantities. unlimited when left out
+	MaxCPU      string `valid:"optional"`
+	MaxMemory   string `valid:"optional"`
+	MaxReplicas int    `valid:"optional"`
 }
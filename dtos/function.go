@@ -5,10 +5,81 @@ import (
 )
 
 type BuildFunctionDTO struct {
-	Code     string             `valid:"required;type(string)"`
-	Language constants.Language `valid:"required;type(string)"`
+	// can be left out to build the uploaded source archive
+	Code string `valid:"optional"`
+	// must be a registered runtime. checked against the runtime registry by the handler
+	Language constants.Language `valid:"required"`
+	// dependency manifest. package.json for NODEJS, requirements.txt for PYTHON. the stored one is kept when left out
+	Dependencies string `valid:"optional"`
+	// package-lock.json for NODEJS. the stored one is kept when left out
+	Lockfile string `valid:"optional"`
+}
+
+type GitSourceDTO struct {
+	// https or http url of the repository
+	URL string `valid:"required"`
+	// branch, tag or commit sha. the default branch when left out
+	Ref string `valid:"optional"`
+	// directory of the function in the repository. the root when left out
+	Subdirectory string `valid:"optional"`
+	// access token for private repositories over https. stored in a secret only the function's builds read
+	Token string `valid:"optional"`
+	// user the token belongs to, if the git host needs one
+	Username string `valid:"optional"`
+}
+
+type GitWebhookDTO struct {
+	// deploy builds triggered by a push once they succeed
+	AutoDeploy bool `valid:"optional"`
 }
 
 type UpdateCodeDTO struct {
 	Code string `valid:"required;type(string)"`
 }
+
+type RollbackDTO struct {
+	// revision to roll back to. the last good revision before the deployed one when left out
+	Revision int `valid:"optional"`
+}
+
+// replaces the function's resource spec. anything left out gets the default
+type ResourcesDTO struct {
+	// kubernetes quantities, like 250m or 0.5
+	CPURequest string `valid:"optional"`
+	CPULimit   string `valid:"optional"`
+	// kubernetes quantities, like 128Mi
+	MemoryRequest string `valid:"optional"`
+	MemoryLimit   string `valid:"optional"`
+	MinReplicas   int    `valid:"optional"`
+	MaxReplicas   int    `valid:"optional"`
+	// average cpu utilization to scale at, in percent of the cpu request
+	TargetCPU int `valid:"optional"`
+	// seconds without requests before the function is scaled to zero. -1 never scales it down
+	IdleTimeout int `valid:"optional"`
+	// CPU, Concurrency or RPS
+	ScalingMetric string `valid:"optional"`
+	// per pod concurrency or requests per second to scale at
+	ScalingTarget int `valid:"optional"`
+	// HPA, or Builtin to scale on request metrics without prometheus
+	Scaler string `valid:"optional"`
+}
+
+// replaces the function's probe settings. anything left out gets the default
+type ProbesDTO struct {
+	// path the probes check. the runtime's health endpoint when left out
+	HealthPath string `valid:"optional"`
+	// seconds between readiness and liveness checks
+	ProbePeriod int `valid:"optional"`
+	// seconds a check may take
+	ProbeTimeout int `valid:"optional"`
+	// failed checks in a row before a pod is unready or restarted
+	ProbeFailureThreshold int `valid:"optional"`
+	// seconds a pod has to pass its first check before it is restarted
+	StartupTimeout int `valid:"optional"`
+}
+
+type SetEnvDTO struct {
+	Value string `valid:"optional"`
+	// stored encrypted and never returned. needs SECRETS_KEY on the server
+	Secret bool `valid:"optional"`
+}
@@ -32,6 +32,10 @@ func (c *ConfigHandler) CreateConfig(rw http.ResponseWriter, r *http.Request) {
 		http.Error(rw, "Validation error : "+err.Error(), 400)
 		return
 	}
+	if err := services.ValidateProjectMaximums(data.MaxCPU, data.MaxMemory, data.MaxReplicas); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
 
 	config := c.service.CreateConfig(data)
 	config.ToJSON(rw)
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/dtos"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/secrets"
+	"github.com/Cloudbase-Project/serverless/services"
+	"github.com/Cloudbase-Project/serverless/utils"
+	"github.com/gorilla/mux"
+)
+
+type EnvHandler struct {
+	l         *log.Logger
+	functions *services.FunctionService
+	service   *services.EnvService
+	kw        *kuberneteswrapper.KubernetesWrapper
+}
+
+func NewEnvHandler(
+	l *log.Logger,
+	kw *kuberneteswrapper.KubernetesWrapper,
+	fs *services.FunctionService,
+	es *services.EnvService,
+) *EnvHandler {
+	return &EnvHandler{l: l, functions: fs, service: es, kw: kw}
+}
+
+// the function of the request, or nil after writing the error
+func (h *EnvHandler) function(rw http.ResponseWriter, r *http.Request) *models.Function {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+	function, err := h.functions.GetFunction(vars["codeId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return nil
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return nil
+	}
+	return function
+}
+
+// List the function's environment variables. Values of secrets are left out
+func (h *EnvHandler) ListEnv(rw http.ResponseWriter, r *http.Request) {
+	function := h.function(rw, r)
+	if function == nil {
+		return
+	}
+	vars, err := h.service.ListEnv(function.ID.String())
+	if err != nil {
+		h.l.Print(err)
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	vars.ToJSON(rw)
+}
+
+/*
+Set an environment variable of the function. A deployed function's pods are restarted with it
+right away.
+*/
+func (h *EnvHandler) SetEnv(rw http.ResponseWriter, r *http.Request) {
+	var data *dtos.SetEnvDTO
+	if err := utils.FromJSON(r.Body, &data); err != nil || data == nil {
+		http.Error(rw, "Invalid body", 400)
+		return
+	}
+	if _, err := dtos.Validate(data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	function := h.function(rw, r)
+	if function == nil {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if err := services.ValidateEnv(name, data.Value); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	env, err := h.service.SetEnv(function, name, data.Value, data.Secret)
+	if errors.Is(err, secrets.ErrNoKey) {
+		http.Error(rw, "Secrets are not enabled on this server : "+err.Error(), 400)
+		return
+	}
+	if err != nil {
+		h.l.Print(err)
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	if !h.applyEnv(rw, function) {
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	env.ToJSON(rw)
+}
+
+// Delete an environment variable of the function. Restarts a deployed function's pods without it
+func (h *EnvHandler) DeleteEnv(rw http.ResponseWriter, r *http.Request) {
+	function := h.function(rw, r)
+	if function == nil {
+		return
+	}
+	deleted, err := h.service.DeleteEnv(function.ID.String(), mux.Vars(r)["name"])
+	if err != nil {
+		h.l.Print(err)
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	if !deleted {
+		http.Error(rw, "Variable not found", 404)
+		return
+	}
+	if !h.applyEnv(rw, function) {
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// sync the env to the cluster. false after writing the error
+func (h *EnvHandler) applyEnv(rw http.ResponseWriter, function *models.Function) bool {
+	restarted, err := h.service.ApplyEnv(h.kw, context.Background(), constants.Namespace, function.ID.String())
+	if err != nil {
+		h.l.Print(err)
+		http.Error(rw, "Cannot apply environment : "+err.Error(), 500)
+		return false
+	}
+	if restarted {
+		h.l.Print("Restarting function ", function.ID, " with its new environment")
+	}
+	return true
+}
@@ -2,16 +2,18 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 
 	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
 	"github.com/Cloudbase-Project/serverless/constants"
 	"github.com/Cloudbase-Project/serverless/dtos"
 	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/runtimes"
 	"github.com/Cloudbase-Project/serverless/services"
 	"github.com/Cloudbase-Project/serverless/utils"
 	"github.com/gorilla/mux"
@@ -19,10 +21,17 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
+// max size of an uploaded source archive
+const maxUploadSize = 10 * 1024 * 1024
+
 type FunctionHandler struct {
-	l       *log.Logger
-	service *services.FunctionService
-	kw      *kuberneteswrapper.KubernetesWrapper
+	l        *log.Logger
+	service  *services.FunctionService
+	kw       *kuberneteswrapper.KubernetesWrapper
+	runtimes *runtimes.Registry
+	queue    *services.BuildQueue
+	worker   *services.Worker
+	env      *services.EnvService
 }
 
 // create new function
@@ -30,9 +39,13 @@ func NewFunctionHandler(
 	client *kubernetes.Clientset,
 	l *log.Logger,
 	s *services.FunctionService,
+	rs *runtimes.Registry,
+	q *services.BuildQueue,
+	w *services.Worker,
+	es *services.EnvService,
 ) *FunctionHandler {
 	kw := kuberneteswrapper.NewWrapper(client)
-	return &FunctionHandler{l: l, service: s, kw: kw}
+	return &FunctionHandler{l: l, service: s, kw: kw, runtimes: rs, queue: q, worker: w, env: es}
 }
 
 // Get all functions created by this user.
@@ -64,6 +77,11 @@ func (f *FunctionHandler) GetFunction(rw http.ResponseWriter, r *http.Request) {
 	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
 	if err != nil {
 		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
 	}
 
 	err = function.ToJSON(rw)
@@ -82,7 +100,7 @@ func (f *FunctionHandler) UpdateFunction(rw http.ResponseWriter, r *http.Request
 	projectId := vars["projectId"]
 
 	var data *dtos.UpdateCodeDTO
-	utils.FromJSON(r.Body, data)
+	utils.FromJSON(r.Body, &data)
 
 	if _, err := dtos.Validate(data); err != nil {
 		http.Error(rw, "Validation error", 400)
@@ -93,39 +111,47 @@ func (f *FunctionHandler) UpdateFunction(rw http.ResponseWriter, r *http.Request
 	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
 	if err != nil {
 		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
 
+	runtime, ok := f.runtimes.Get(constants.Language(function.Language))
+	if !ok {
+		http.Error(rw, "Unsupported language : "+function.Language, 400)
+		return
 	}
 
 	// update the code.
 	function.Code = data.Code
-	function.BuildStatus = string(constants.Building)
+	function.SourceType = string(constants.InlineSource)
+	// validate the source before queueing. the build reads it again when it starts, and fetches git sources
+	_, err = f.service.GetBuildSource(function, runtime)
+	if err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	function.BuildStatus = string(constants.Queued)
 	// save it
 	f.service.SaveFunction(function)
 
-	imageName := utils.BuildImageName(function.ID.String())
-
-	// build image
-	f.kw.CreateImageBuilder(&kuberneteswrapper.ImageBuilder{
-		Ctx:        r.Context(),
-		Namespace:  constants.Namespace,
-		FunctionId: function.ID.String(),
-		Language:   constants.Language(function.Language),
-		ImageName:  imageName,
-	})
-
-	rw.Write([]byte("Building new image for your updated code"))
-
-	result := f.service.WatchImageBuilder(f.kw, function, constants.Namespace)
-	if result.Err != nil {
-		f.l.Print("error watching image builder", result.Err)
+	job, err := f.worker.SubmitBuild(function, constants.UpdateAction, false)
+	if err != nil {
+		f.l.Print(err)
+		http.Error(rw, "DB error", 500)
+		return
 	}
+	acceptJob(rw, job)
+}
 
-	function.BuildFailReason = result.Reason
-	function.BuildStatus = result.Status
-	function.LastAction = string(constants.UpdateAction)
-	function.DeployStatus = string(constants.RedeployRequired)
-	f.service.SaveFunction(function)
-
+// reply 202 Accepted with a background job. its progress is at /jobs/{id}
+func acceptJob(rw http.ResponseWriter, job *models.Job) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Location", "/jobs/"+job.ID.String())
+	rw.WriteHeader(http.StatusAccepted)
+	job.ToJSON(rw)
 }
 
 func (f *FunctionHandler) DeleteFunction(rw http.ResponseWriter, r *http.Request) {
@@ -137,11 +163,22 @@ func (f *FunctionHandler) DeleteFunction(rw http.ResponseWriter, r *http.Request
 
 	projectId := vars["projectId"]
 
+	function, err := f.service.GetFunction(codeId, ownerId, projectId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+
 	// delete it.
-	err := f.service.DeleteFunction(codeId, ownerId, projectId)
+	err = f.service.DeleteFunction(codeId, ownerId, projectId)
 	if err != nil {
 		f.l.Print(err)
 		http.Error(rw, "DB error", 500)
+		return
 	}
 	serviceName := utils.BuildServiceName(codeId)
 
@@ -156,6 +193,13 @@ func (f *FunctionHandler) DeleteFunction(rw http.ResponseWriter, r *http.Request
 		f.l.Print(err)
 		http.Error(rw, "Err deleting resources", 500)
 	}
+
+	if err := f.env.DeleteAllEnv(f.kw, context.Background(), constants.Namespace, codeId); err != nil {
+		f.l.Print("Cannot delete environment of ", codeId, " : ", err)
+	}
+	if err := f.service.DeleteGitCredentials(f.kw, context.Background(), constants.Namespace, codeId); err != nil {
+		f.l.Print("Cannot delete git credentials of ", codeId, " : ", err)
+	}
 }
 
 func (f *FunctionHandler) GetFunctionLogs(rw http.ResponseWriter, r *http.Request) {
@@ -196,6 +240,11 @@ func (f *FunctionHandler) DeployFunction(rw http.ResponseWriter, r *http.Request
 	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
 	if err != nil {
 		http.Error(rw, "DB error", 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
 	}
 
 	if function.BuildStatus == string(constants.BuildSuccess) &&
@@ -203,24 +252,8 @@ func (f *FunctionHandler) DeployFunction(rw http.ResponseWriter, r *http.Request
 		function.LastAction == string(constants.BuildAction) {
 		// proceed
 
-		deploymentLabel := map[string]string{"app": function.ID.String()}
-
-		replicas := int32(1)
-
-		imageName := utils.BuildImageName(function.ID.String())
-
-		err = f.service.DeployFunction(
-			f.kw,
-			r.Context(),
-			constants.Namespace,
-			function.ID.String(),
-			deploymentLabel,
-			imageName,
-			replicas,
-		)
-		if err != nil {
-			fmt.Printf("err: %v\n", err.Error())
-			http.Error(rw, "Error deploying your image.", 500)
+		if _, ok := f.runtimes.Get(constants.Language(function.Language)); !ok {
+			http.Error(rw, "Unsupported language : "+function.Language, 400)
 			return
 		}
 
@@ -228,27 +261,13 @@ func (f *FunctionHandler) DeployFunction(rw http.ResponseWriter, r *http.Request
 		function.DeployStatus = string(constants.Deploying)
 		f.service.SaveFunction(function)
 
-		rw = utils.SetSSEHeaders(rw)
-		fmt.Fprintf(rw, "data: %v\n\n", "Deploying your function...")
-
-		if f, ok := rw.(http.Flusher); ok {
-			f.Flush()
-		}
-
-		// Watch status
-		// watch for 1 min and then close everything
-
-		result := f.service.WatchDeployment(f.kw, function, constants.Namespace)
-		if result.Err != nil {
-			http.Error(rw, "Error watching deployment", 500)
+		job, err := f.worker.SubmitDeploy(function, constants.DeployJob)
+		if err != nil {
+			f.l.Print(err)
+			http.Error(rw, "DB error", 500)
+			return
 		}
-
-		function.DeployFailReason = result.Reason
-		function.DeployStatus = result.Status
-		function.LastAction = string(constants.DeployAction)
-		f.service.SaveFunction(function)
-
-		fmt.Fprintf(rw, "data: %v\n\n", "Deployed your function successfully")
+		acceptJob(rw, job)
 
 	} else {
 		http.Error(rw, "Cannot perform this action currently", 400)
@@ -263,6 +282,11 @@ func (f *FunctionHandler) BuildFunction(rw http.ResponseWriter, r *http.Request)
 		http.Error(rw, "Validation error : "+err.Error(), 400)
 		return
 	}
+	runtime, ok := f.runtimes.Get(data.Language)
+	if !ok {
+		http.Error(rw, "Validation error : unsupported language "+string(data.Language), 400)
+		return
+	}
 	ownerId := r.Context().Value("ownerId").(string)
 
 	vars := mux.Vars(r)
@@ -272,74 +296,514 @@ func (f *FunctionHandler) BuildFunction(rw http.ResponseWriter, r *http.Request)
 	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
 	if err != nil {
 		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
 	}
 
-	// update the code.
-	function.Code = data.Code
+	// update the code. without code the uploaded archive or the git source is built
+	if data.Code != "" {
+		function.Code = data.Code
+		function.SourceType = string(constants.InlineSource)
+	}
+	// dependency files left out are kept, unless they belong to another language
+	if function.Language != string(data.Language) {
+		function.Dependencies = ""
+		function.Lockfile = ""
+	}
 	function.Language = string(data.Language)
-	function.BuildStatus = string(constants.Building)
+	if data.Dependencies != "" {
+		function.Dependencies = data.Dependencies
+	}
+	if data.Lockfile != "" {
+		function.Lockfile = data.Lockfile
+	}
+	// validate the source before queueing. the build reads it again when it starts, and fetches git sources
+	_, err = f.service.GetBuildSource(function, runtime)
+	if err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	function.BuildStatus = string(constants.Queued)
 	// save it
 	f.service.SaveFunction(function)
 
-	// TODO: get these from env variables
-	Registry := os.Getenv("REGISTRY")
-	Project := os.Getenv("PROJECT_NAME")
+	job, err := f.worker.SubmitBuild(function, constants.BuildAction, false)
+	if err != nil {
+		f.l.Print(err)
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	acceptJob(rw, job)
+}
+
+// Get a build of a function and its position in the build queue
+func (f *FunctionHandler) GetBuild(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
 
-	imageName := Registry + "/" + Project + "/" + function.ID.String() + ":latest"
+	vars := mux.Vars(r)
+	projectId := vars["projectId"]
 
-	// create namespace if not exist
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
 	if err != nil {
-		// namespace already exists. ignore
-		fmt.Printf("err: %v\n", err)
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
 	}
 
-	// create kaniko pod
+	build, err := f.queue.GetBuild(function.ID.String(), vars["buildId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if build == nil {
+		http.Error(rw, "Build not found", 404)
+		return
+	}
 
-	_, err = f.kw.CreateImageBuilder(
-		&kuberneteswrapper.ImageBuilder{
-			Ctx:        r.Context(),
-			Namespace:  constants.Namespace,
-			FunctionId: function.ID.String(),
-			Language:   constants.Language(function.Language),
-			ImageName:  imageName,
-			Code:       function.Code,
-		})
+	rw.Header().Set("Content-Type", "application/json")
+	build.ToJSON(rw)
+}
 
+/*
+Cancel a build of a function. A queued build is cancelled right away. A running build's builder
+is stopped and removed; the build's final state follows on its job and GET .../builds/{buildId}.
+*/
+func (f *FunctionHandler) CancelBuild(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+
+	vars := mux.Vars(r)
+	projectId := vars["projectId"]
+
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
 	if err != nil {
-		http.Error(rw, "error : "+err.Error(), 400)
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
 	}
 
-	rw = utils.SetSSEHeaders(rw)
+	build, err := f.queue.Cancel(function.ID.String(), vars["buildId"])
+	if errors.Is(err, services.ErrBuildFinished) {
+		http.Error(rw, "Build already finished", 409)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if build == nil {
+		http.Error(rw, "Build not found", 404)
+		return
+	}
 
-	fmt.Fprintf(rw, "data: %v\n\n", "Building Image for your code")
+	rw.Header().Set("Content-Type", "application/json")
+	if build.Status == string(constants.Building) {
+		// stopping the builder takes a moment
+		rw.WriteHeader(http.StatusAccepted)
+	}
+	build.ToJSON(rw)
+}
 
-	if f, ok := rw.(http.Flusher); ok {
-		f.Flush()
+/*
+Point the function's deployment back at an earlier revision's image. Takes the revision number
+in the body, or rolls back to the last revision that built before the deployed one.
+*/
+func (f *FunctionHandler) RollbackFunction(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+
+	vars := mux.Vars(r)
+	projectId := vars["projectId"]
+
+	// the body is optional
+	data := dtos.RollbackDTO{}
+	utils.FromJSON(r.Body, &data)
+	if _, err := dtos.Validate(data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
 	}
 
-	result := f.service.WatchImageBuilder(f.kw, function, constants.Namespace)
-	if result.Err != nil {
-		http.Error(rw, "Error watching image builder", 500)
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+	switch function.DeployStatus {
+	case string(constants.NotDeployed):
+		http.Error(rw, "Function is not deployed", 400)
+		return
+	case string(constants.Deploying):
+		http.Error(rw, "A deployment is in progress", 409)
+		return
 	}
 
-	err = f.service.DeleteImageBuilder(f.kw, r.Context(), constants.Namespace)
+	var revision *models.FunctionRevision
+	if data.Revision == 0 {
+		deployed := function.DeployedRevision
+		if deployed == 0 {
+			// deployed before revisions were tracked. it runs the latest build
+			deployed = function.Revision
+		}
+		revision, err = f.service.PreviousRevision(function.ID.String(), deployed)
+	} else {
+		revision, err = f.service.GetRevision(function.ID.String(), data.Revision)
+	}
 	if err != nil {
-		fmt.Printf("err deleting image builder: %v\n", err.Error())
+		http.Error(rw, err.Error(), 500)
+		return
 	}
-	function.BuildFailReason = result.Reason
-	function.BuildStatus = result.Status
-	function.LastAction = string(constants.BuildAction)
+	if revision == nil {
+		http.Error(rw, "Revision not found", 404)
+		return
+	}
+	if revision.BuildStatus != string(constants.BuildSuccess) {
+		http.Error(rw, "Revision was not built successfully", 400)
+		return
+	}
+	if revision.ImageDeletedAt != nil {
+		http.Error(rw, "Revision's image was garbage collected", 400)
+		return
+	}
+	if revision.Number == function.DeployedRevision {
+		http.Error(rw, "Revision is already deployed", 400)
+		return
+	}
+
+	function.DeployStatus = string(constants.Deploying)
 	f.service.SaveFunction(function)
-	resp := struct {
-		Function models.Function
-		Message  string
-	}{
-		Function: *function,
-		Message:  "Built image for function",
+
+	job, err := f.worker.SubmitRollback(function, revision)
+	if err != nil {
+		f.l.Print(err)
+		http.Error(rw, "DB error", 500)
+		return
 	}
+	acceptJob(rw, job)
+}
 
-	json.NewEncoder(rw).Encode(resp)
+// Deployment history of the function, newest first
+func (f *FunctionHandler) ListRollouts(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
 
+	vars := mux.Vars(r)
+	projectId := vars["projectId"]
+
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+
+	rollouts, err := f.service.GetRollouts(function.ID.String())
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rollouts.ToJSON(rw)
+}
+
+// List the function's revisions, newest first
+func (f *FunctionHandler) ListRevisions(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+
+	vars := mux.Vars(r)
+	projectId := vars["projectId"]
+
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+
+	revisions, err := f.service.GetRevisions(function.ID.String())
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	revisions.ToJSON(rw)
+}
+
+// Get a revision of the function by its number
+func (f *FunctionHandler) GetRevision(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+
+	vars := mux.Vars(r)
+	projectId := vars["projectId"]
+
+	number, err := strconv.Atoi(vars["revision"])
+	if err != nil {
+		http.Error(rw, "Invalid revision", 400)
+		return
+	}
+
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+
+	revision, err := f.service.GetRevision(function.ID.String(), number)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if revision == nil {
+		http.Error(rw, "Revision not found", 404)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	revision.ToJSON(rw)
+}
+
+/*
+Upload a tar.gz or zip archive as the function's source. The next build without code builds it.
+
+The archive is sent as the request body.
+*/
+func (f *FunctionHandler) UploadSource(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+
+	vars := mux.Vars(r)
+	projectId := vars["projectId"]
+
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, maxUploadSize))
+	if err != nil {
+		http.Error(rw, "Archive too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	data, files, err := utils.NormalizeArchive(body)
+	if err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+
+	archive, err := f.service.SaveSourceArchive(function, data, files)
+	if err != nil {
+		f.l.Print(err)
+		http.Error(rw, "DB error", 500)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	archive.ToJSON(rw)
+}
+
+/*
+Set the function's cpu, memory and replica bounds. Checked against the project's maximums. A
+deployed function gets them right away: its pods are replaced if cpu or memory changed.
+*/
+func (f *FunctionHandler) SetResources(rw http.ResponseWriter, r *http.Request) {
+	var data *dtos.ResourcesDTO
+	utils.FromJSON(r.Body, &data)
+	if data == nil {
+		data = &dtos.ResourcesDTO{}
+	}
+	if _, err := dtos.Validate(data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	ownerId := r.Context().Value("ownerId").(string)
+
+	vars := mux.Vars(r)
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+
+	function.CPURequest = data.CPURequest
+	function.CPULimit = data.CPULimit
+	function.MemoryRequest = data.MemoryRequest
+	function.MemoryLimit = data.MemoryLimit
+	function.MinReplicas = data.MinReplicas
+	function.MaxReplicas = data.MaxReplicas
+	function.TargetCPU = data.TargetCPU
+	function.IdleTimeout = data.IdleTimeout
+	function.ScalingMetric = data.ScalingMetric
+	function.ScalingTarget = data.ScalingTarget
+	function.Scaler = data.Scaler
+	resources, err := f.service.Resources(function)
+	if err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	f.service.SaveFunction(function)
+
+	restarted, err := f.service.ApplyResources(
+		f.kw,
+		context.Background(),
+		constants.Namespace,
+		function.ID.String(),
+		resources,
+	)
+	if err != nil {
+		f.l.Print(err)
+		http.Error(rw, "Cannot apply resources : "+err.Error(), 500)
+		return
+	}
+	if restarted {
+		f.l.Print("Restarting function ", function.ID, " with its new resources")
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	function.ToJSON(rw)
+}
+
+/*
+Set the function's health check path and thresholds. A deployed function gets them right away,
+which replaces its pods.
+*/
+func (f *FunctionHandler) SetProbes(rw http.ResponseWriter, r *http.Request) {
+	var data *dtos.ProbesDTO
+	utils.FromJSON(r.Body, &data)
+	if data == nil {
+		data = &dtos.ProbesDTO{}
+	}
+	if _, err := dtos.Validate(data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	ownerId := r.Context().Value("ownerId").(string)
+
+	vars := mux.Vars(r)
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+	runtime, ok := f.runtimes.Get(constants.Language(function.Language))
+	if !ok {
+		http.Error(rw, "Unsupported language : "+function.Language, 400)
+		return
+	}
+
+	function.HealthPath = data.HealthPath
+	function.ProbePeriod = data.ProbePeriod
+	function.ProbeTimeout = data.ProbeTimeout
+	function.ProbeFailureThreshold = data.ProbeFailureThreshold
+	function.StartupTimeout = data.StartupTimeout
+	// the deployment runs the deployed revision, which may predate the runtime's health endpoint
+	probes, err := f.service.Probes(function, runtime.Port, function.DeployedRevision)
+	if err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	f.service.SaveFunction(function)
+
+	restarted, err := f.service.ApplyProbes(
+		f.kw,
+		context.Background(),
+		constants.Namespace,
+		function.ID.String(),
+		probes,
+	)
+	if err != nil {
+		f.l.Print(err)
+		http.Error(rw, "Cannot apply probes : "+err.Error(), 500)
+		return
+	}
+	if restarted {
+		f.l.Print("Restarting function ", function.ID, " with its new probes")
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	function.ToJSON(rw)
+}
+
+/*
+Make a subdirectory of a git repository the function's source. The next build without code
+fetches the ref and builds it; the commit it resolved to is recorded on the revision.
+*/
+func (f *FunctionHandler) SetGitSource(rw http.ResponseWriter, r *http.Request) {
+	var data *dtos.GitSourceDTO
+	utils.FromJSON(r.Body, &data)
+	if _, err := dtos.Validate(data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	ownerId := r.Context().Value("ownerId").(string)
+
+	vars := mux.Vars(r)
+	projectId := vars["projectId"]
+
+	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+
+	if err := utils.ValidateGitSource(data.URL, data.Ref, data.Subdirectory); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	err = f.service.SetGitSource(
+		f.kw,
+		context.Background(),
+		constants.Namespace,
+		function,
+		data.URL,
+		data.Ref,
+		data.Subdirectory,
+		data.Username,
+		data.Token,
+	)
+	if err != nil {
+		f.l.Print(err)
+		http.Error(rw, "Cannot set git source : "+err.Error(), 500)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	function.ToJSON(rw)
 }
 
 func (f *FunctionHandler) CreateFunction(rw http.ResponseWriter, r *http.Request) {
@@ -373,6 +837,11 @@ func (f *FunctionHandler) RedeployFunction(rw http.ResponseWriter, r *http.Reque
 	function, err := f.service.GetFunction(vars["codeId"], ownerId, projectId)
 	if err != nil {
 		http.Error(rw, "DB error", 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
 	}
 
 	if function.LastAction == string(constants.UpdateAction) &&
@@ -380,16 +849,16 @@ func (f *FunctionHandler) RedeployFunction(rw http.ResponseWriter, r *http.Reque
 		function.BuildStatus == string(constants.BuildSuccess) {
 		// proceed
 
-		err = f.kw.UpdateDeployment(&kuberneteswrapper.UpdateOptions{
-			Ctx:       context.Background(),
-			Namespace: constants.Namespace,
-			Name:      function.ID.String(),
-		})
+		function.DeployStatus = string(constants.Deploying)
+		f.service.SaveFunction(function)
+
+		job, err := f.worker.SubmitDeploy(function, constants.RedeployJob)
 		if err != nil {
 			f.l.Print(err)
 			http.Error(rw, "error occured when redeploying", 500)
+			return
 		}
-		rw.Write([]byte("Deploying your code..."))
+		acceptJob(rw, job)
 
 	} else {
 		http.Error(rw, "Cannot perform this action.", 400)
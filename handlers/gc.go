@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Cloudbase-Project/serverless/services"
+	"github.com/gorilla/mux"
+)
+
+type ImageGCHandler struct {
+	l         *log.Logger
+	configs   *services.ConfigService
+	collector *services.ImageCollector
+}
+
+func NewImageGCHandler(
+	l *log.Logger,
+	cs *services.ConfigService,
+	collector *services.ImageCollector,
+) *ImageGCHandler {
+	return &ImageGCHandler{l: l, configs: cs, collector: collector}
+}
+
+// Dry run of the image garbage collector for one project. Nothing is deleted
+func (h *ImageGCHandler) GetReport(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+
+	config, err := h.configs.GetConfig(mux.Vars(r)["projectId"], ownerId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if config == nil {
+		http.Error(rw, "Invalid projectId", 404)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	report := h.collector.Collect(ctx, &config.ID, true)
+
+	rw.Header().Set("Content-Type", "application/json")
+	report.ToJSON(rw)
+}
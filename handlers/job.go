@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/services"
+	"github.com/Cloudbase-Project/serverless/utils"
+	"github.com/gorilla/mux"
+)
+
+type JobHandler struct {
+	l       *log.Logger
+	service *services.JobService
+}
+
+func NewJobHandler(l *log.Logger, s *services.JobService) *JobHandler {
+	return &JobHandler{l: l, service: s}
+}
+
+// Get a job by id
+func (j *JobHandler) GetJob(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	job, err := j.service.GetJob(vars["jobId"], ownerId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if job == nil {
+		http.Error(rw, "Job not found", 404)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	job.ToJSON(rw)
+}
+
+// Stream a job's events as server sent events until the job is done or the client goes away
+func (j *JobHandler) StreamJobEvents(rw http.ResponseWriter, r *http.Request) {
+	ownerId := r.Context().Value("ownerId").(string)
+	vars := mux.Vars(r)
+
+	job, err := j.service.GetJob(vars["jobId"], ownerId)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if job == nil {
+		http.Error(rw, "Job not found", 404)
+		return
+	}
+
+	// subscribe before sending the current state so nothing is missed in between
+	events, cancel := j.service.Subscribe(job.ID)
+	defer cancel()
+
+	rw = utils.SetSSEHeaders(rw)
+	send := func(event services.JobEvent) {
+		payload, _ := json.Marshal(event)
+		fmt.Fprintf(rw, "data: %s\n\n", payload)
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	// the current state first. the job may already be done
+	if current, err := j.service.GetJob(vars["jobId"], ownerId); err == nil && current != nil {
+		job = current
+	}
+	send(services.JobEvent{Type: "status", Status: job.Status, Job: job, Time: job.UpdatedAt})
+	if job.Status == string(constants.JobSucceeded) || job.Status == string(constants.JobFailed) {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// job finished. its final state may have been dropped for a slow reader
+				if job, err := j.service.GetJob(vars["jobId"], ownerId); err == nil && job != nil {
+					send(services.JobEvent{Type: "status", Status: job.Status, Job: job, Time: job.UpdatedAt})
+				}
+				return
+			}
+			send(event)
+		}
+	}
+}
@@ -1,57 +1,104 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 
+	"github.com/Cloudbase-Project/serverless/constants"
 	"github.com/Cloudbase-Project/serverless/services"
+	"github.com/Cloudbase-Project/serverless/utils"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
 type ProxyHandler struct {
-	l       *log.Logger
-	service *services.ProxyService
+	l         *log.Logger
+	service   *services.ProxyService
+	activator *services.Activator
+	metrics   *services.RequestMetrics
 }
 
 // create new function
 func NewProxyHandler(
 	l *log.Logger,
 	s *services.ProxyService,
+	a *services.Activator,
+	m *services.RequestMetrics,
 ) *ProxyHandler {
-	return &ProxyHandler{l: l, service: s}
+	return &ProxyHandler{l: l, service: s, activator: a, metrics: m}
 }
 
+/*
+Forward a request to the function's service. A function scaled to zero is started first; the
+request waits until one of its pods is ready.
+
+/serve/{functionId}/path?query -> http://cloudbase-serverless-{functionId}-srv:4000/path?query
+*/
 func (p *ProxyHandler) ProxyRequest(rw http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 
 	functionId := vars["functionId"]
+	if _, err := uuid.Parse(functionId); err != nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
 
-	_, err := p.service.VerifyFunction(functionId)
+	function, err := p.service.VerifyFunction(functionId)
 	if err != nil {
-		http.Error(rw, err.Error(), 400)
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil || function.DeployStatus == string(constants.NotDeployed) {
+		http.Error(rw, "Function not found", 404)
+		return
 	}
 
-	urlString := r.URL.String()
-	x := strings.Split(urlString, "/serve/"+functionId)
+	// requests waiting for a cold start count as in flight too
+	done := p.metrics.Begin(functionId)
+	defer done()
 
-	functionURL := "http://cloudbase-serverless-" + functionId + "-srv:4000" + x[0]
+	release, err := p.activator.Acquire(r.Context(), function)
+	switch {
+	case errors.Is(err, services.ErrColdStartQueueFull):
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, services.ErrColdStartTimeout):
+		http.Error(rw, err.Error(), http.StatusGatewayTimeout)
+		return
+	case errors.Is(err, context.Canceled):
+		// the client went away
+		return
+	case err != nil:
+		p.l.Print(err)
+		http.Error(rw, "Cannot start function", http.StatusBadGateway)
+		return
+	}
+	defer release()
 
-	finalURL, err := url.Parse(functionURL)
+	finalURL, err := url.Parse("http://" + utils.BuildServiceName(functionId) + ":4000")
 	if err != nil {
 		http.Error(rw, err.Error(), 400)
+		return
 	}
 
+	path := strings.TrimPrefix(r.URL.Path, "/serve/"+functionId)
+	if path == "" {
+		path = "/"
+	}
 	proxy := httputil.NewSingleHostReverseProxy(finalURL)
 	r.URL.Host = finalURL.Host
 	r.URL.Scheme = finalURL.Scheme
-	r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
+	r.Header.Set("X-Forwarded-Host", r.Host)
 	r.Host = finalURL.Host
-	r.URL.Path = finalURL.Path
-	r.URL.RawPath = finalURL.RawPath
+	r.URL.Path = path
+	r.URL.RawPath = ""
 	proxy.ServeHTTP(rw, r)
 
 }
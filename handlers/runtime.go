@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Cloudbase-Project/serverless/runtimes"
+)
+
+type RuntimeHandler struct {
+	l        *log.Logger
+	runtimes *runtimes.Registry
+}
+
+func NewRuntimeHandler(l *log.Logger, rs *runtimes.Registry) *RuntimeHandler {
+	return &RuntimeHandler{l: l, runtimes: rs}
+}
+
+// List the runtimes functions can be built with
+func (h *RuntimeHandler) ListRuntimes(rw http.ResponseWriter, r *http.Request) {
+	list := h.runtimes.List()
+	rw.Header().Set("Content-Type", "application/json")
+	err := list.ToJSON(rw)
+	if err != nil {
+		http.Error(rw, "Unable to marshal JSON", http.StatusInternalServerError)
+	}
+}
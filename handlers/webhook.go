@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/dtos"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/services"
+	"github.com/Cloudbase-Project/serverless/utils"
+	"github.com/Cloudbase-Project/serverless/webhooks"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// max size of a webhook payload. pushes with many commits get large
+const maxWebhookSize = 5 * 1024 * 1024
+
+type WebhookHandler struct {
+	l       *log.Logger
+	service *services.FunctionService
+	worker  *services.Worker
+}
+
+func NewWebhookHandler(
+	l *log.Logger,
+	fs *services.FunctionService,
+	worker *services.Worker,
+) *WebhookHandler {
+	return &WebhookHandler{l: l, service: fs, worker: worker}
+}
+
+/*
+Create the push webhook of a function built from git, or replace its secret. The secret is
+returned once; configure it on the git host along with the url.
+*/
+func (h *WebhookHandler) CreateGitWebhook(rw http.ResponseWriter, r *http.Request) {
+	var data *dtos.GitWebhookDTO
+	utils.FromJSON(r.Body, &data)
+	if data == nil {
+		data = &dtos.GitWebhookDTO{}
+	}
+	if _, err := dtos.Validate(data); err != nil {
+		http.Error(rw, "Validation error : "+err.Error(), 400)
+		return
+	}
+	ownerId := r.Context().Value("ownerId").(string)
+
+	vars := mux.Vars(r)
+	function, err := h.service.GetFunction(vars["codeId"], ownerId, vars["projectId"])
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if function == nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+	if function.SourceType != string(constants.GitSource) {
+		http.Error(rw, "Function is not built from a git repository", 400)
+		return
+	}
+
+	secret, err := h.service.RotateWebhookSecret(function, data.AutoDeploy)
+	if err != nil {
+		h.l.Print(err)
+		http.Error(rw, "DB error", 500)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	hook := models.GitWebhook{URL: "/hooks/git/" + function.ID.String(), Secret: secret, AutoDeploy: function.AutoDeploy}
+	hook.ToJSON(rw)
+}
+
+/*
+Push webhook from GitHub, GitLab or Gitea. Verified with the function's secret. A push that
+moves the branch the function builds from queues a build, and a deploy after it if the webhook
+was created with autoDeploy. Other events and pushes are acknowledged and ignored.
+*/
+func (h *WebhookHandler) GitPush(rw http.ResponseWriter, r *http.Request) {
+	functionId, err := uuid.Parse(mux.Vars(r)["functionId"])
+	if err != nil {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(rw, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	function, err := h.service.GetFunctionById(functionId.String())
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	// functions without a secret look the same as missing ones
+	if function == nil || function.WebhookSecret == "" {
+		http.Error(rw, "Function not found", 404)
+		return
+	}
+
+	provider, err := webhooks.Detect(r.Header)
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	if err := webhooks.Verify(provider, r.Header, body, function.WebhookSecret); err != nil {
+		http.Error(rw, err.Error(), 401)
+		return
+	}
+	if !webhooks.IsPush(provider, r.Header) {
+		rw.Write([]byte("Ignored : not a push event\n"))
+		return
+	}
+	event, err := webhooks.ParsePush(provider, body)
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	if function.SourceType != string(constants.GitSource) {
+		rw.Write([]byte("Ignored : function is not built from git\n"))
+		return
+	}
+	if !event.Moves(function.GitRef) {
+		rw.Write([]byte("Ignored : push to " + event.Ref + "\n"))
+		return
+	}
+
+	latest, err := h.service.LatestRevision(function.ID.String())
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	if latest != nil && latest.SourceType == string(constants.GitSource) {
+		// redelivered push
+		if latest.GitCommit == event.After {
+			rw.Write([]byte("Ignored : commit already built\n"))
+			return
+		}
+		// the queued build fetches the branch when it starts, so it picks this push up
+		if latest.BuildStatus == string(constants.Queued) {
+			rw.Write([]byte("Ignored : a build is already queued\n"))
+			return
+		}
+	}
+
+	// a function with a deployment gets an update, so it can be redeployed
+	exists, err := h.worker.HasDeployment(function)
+	if err != nil {
+		h.l.Print(err)
+		http.Error(rw, "Cannot read the function's deployment", 500)
+		return
+	}
+	action := constants.BuildAction
+	if exists {
+		action = constants.UpdateAction
+	}
+	function.BuildStatus = string(constants.Queued)
+	h.service.SaveFunction(function)
+
+	job, err := h.worker.SubmitBuild(function, action, function.AutoDeploy)
+	if err != nil {
+		h.l.Print(err)
+		http.Error(rw, "DB error", 500)
+		return
+	}
+	h.l.Print("Push to ", event.Ref, " at ", event.After, " queued a build of function ", function.ID)
+	acceptJob(rw, job)
+}
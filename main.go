@@ -5,22 +5,23 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
 	"github.com/Cloudbase-Project/serverless/handlers"
 	"github.com/Cloudbase-Project/serverless/middlewares"
 	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/registry"
+	"github.com/Cloudbase-Project/serverless/runtimes"
+	"github.com/Cloudbase-Project/serverless/secrets"
 	"github.com/Cloudbase-Project/serverless/services"
+	"github.com/Cloudbase-Project/serverless/utils"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -58,6 +59,34 @@ func main() {
 		panic(err)
 	}
 
+	kw := kuberneteswrapper.NewWrapper(clientset)
+
+	// where images are pushed and how they are named. projects can use their own registry
+	regs, err := registry.FromEnv()
+	if err != nil {
+		panic(err)
+	}
+	if path, ok := os.LookupEnv("REGISTRY_CONFIG"); ok {
+		if err := regs.LoadFile(path); err != nil {
+			panic(err)
+		}
+	}
+
+	// builds and deployments read the registry credentials from a docker-config secret.
+	// keep it in sync with the env credentials if they are set.
+	if credentials, ok := os.LookupEnv("BASE64_CREDENTIALS"); ok {
+		err = kw.ApplyRegistrySecret(
+			context.Background(),
+			constants.Namespace,
+			regs.Default.SecretName,
+			regs.Default.Host,
+			credentials,
+		)
+		if err != nil {
+			logger.Print("Cannot create registry secret : ", err)
+		}
+	}
+
 	// dsn := "host=localhost user=gorm password=gorm dbname=gorm port=9920 sslmode=disable TimeZone=Asia/Shanghai"
 	dsn := os.Getenv("POSTGRES_URI")
 	fmt.Printf("dsn: %v\n", dsn)
@@ -75,19 +104,117 @@ func main() {
 
 	}
 
-	RequestCounter := promauto.NewCounter(
-		prometheus.CounterOpts{Name: "serverless_requests_total"},
+	db.AutoMigrate(
+		&models.Function{},
+		&models.Config{},
+		&models.SourceArchive{},
+		&models.FunctionRevision{},
+		&models.Rollout{},
+		&models.Build{},
+		&models.Job{},
+		&models.EnvVar{},
 	)
 
-	db.AutoMigrate(&models.Function{}, &models.Config{})
+	rs := runtimes.NewRegistry()
+	// operators can add runtimes from a directory of templates
+	if dir, ok := os.LookupEnv("RUNTIMES_DIR"); ok {
+		if err := rs.LoadDir(dir); err != nil {
+			logger.Fatal("Cannot load runtimes : ", err)
+		}
+	}
 
 	fs := services.NewFunctionService(db, logger)
 	cs := services.NewConfigService(db, logger)
 	ps := services.NewProxyService(db, logger)
 
-	function := handlers.NewFunctionHandler(clientset, logger, fs)
+	// reuse layers across builds and keep base images close to the builders
+	cache := services.BuildCacheFromEnv()
+	go func() {
+		if err := fs.WarmBuildCache(kw, rs, regs, cache); err != nil {
+			logger.Print("Cannot warm the build cache : ", err)
+		}
+	}()
+
+	// kaniko, buildkit, docker or podman
+	builder, err := services.NewImageBuilder(
+		os.Getenv("IMAGE_BUILDER"),
+		kw,
+		fs,
+		logger,
+		utils.GetEnvBool("LOCAL_BUILDER_PUSH", true),
+	)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// runtimes and projects can set their own
+	buildTimeout := utils.GetEnvDuration("BUILD_TIMEOUT", 15*time.Minute)
+
+	js := services.NewJobService(db, logger)
+	queue := services.NewBuildQueue(
+		db,
+		logger,
+		utils.GetEnvInt("BUILD_CONCURRENCY", 4),
+		utils.GetEnvInt("BUILD_PROJECT_CONCURRENCY", 2),
+		func(ctx context.Context, build *models.Build) *models.Build {
+			// resolved once, so streaming the build log doesn't query for it line by line
+			job, err := js.JobForBuild(ctx, build.ID)
+			if err != nil {
+				logger.Print("Cannot find the job of build ", build.ID, " : ", err)
+			}
+			return fs.RunBuild(ctx, builder, rs, regs, cache, buildTimeout, build, js.BuildLogger(job))
+		},
+	)
+	queueContext, stopQueue := context.WithCancel(context.Background())
+	defer stopQueue()
+	go queue.Start(queueContext)
+
+	// secret env values are encrypted with SECRETS_KEY. plain ones work without it
+	box, err := secrets.BoxFromEnv()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	es := services.NewEnvService(db, logger, box)
+
+	worker := services.NewWorker(logger, js, fs, queue, kw, rs, regs, es)
+	worker.Resume()
+
+	// remove images of deleted functions and old revisions from the registry
+	collector := services.NewImageCollector(db, logger, kw, fs, regs, utils.GetEnvInt("IMAGE_RETENTION", 10))
+	if interval := utils.GetEnvDuration("IMAGE_GC_INTERVAL", 24*time.Hour); interval > 0 {
+		go collector.Start(queueContext, interval, utils.GetEnvBool("IMAGE_GC_DRY_RUN", false))
+	}
+
+	// scale functions without requests to zero. SCALE_TO_ZERO_AFTER=0 keeps them running.
+	// request activity and cold start state live in this process, so scale to zero needs a single
+	// replica of the server: with more, one replica scales down a function another is serving.
+	// run more replicas only with SCALE_TO_ZERO_AFTER=0
+	activator := services.NewActivator(
+		db,
+		logger,
+		kw,
+		fs,
+		utils.GetEnvDuration("SCALE_TO_ZERO_AFTER", 15*time.Minute),
+		utils.GetEnvDuration("COLD_START_TIMEOUT", time.Minute),
+		utils.GetEnvInt("COLD_START_QUEUE", 100),
+	)
+	go activator.Start(queueContext)
+
+	// requests per function, counted at the proxy. functions with the builtin scaler are scaled on them
+	metrics := services.NewRequestMetrics()
+	autoscaler := services.NewAutoscaler(db, logger, kw, fs, metrics)
+	if interval := utils.GetEnvDuration("AUTOSCALE_INTERVAL", 15*time.Second); interval > 0 {
+		go autoscaler.Start(queueContext, interval)
+	}
+
+	function := handlers.NewFunctionHandler(clientset, logger, fs, rs, queue, worker, es)
+	jobHandler := handlers.NewJobHandler(logger, js)
 	configHandler := handlers.NewConfigHandler(logger, cs)
-	// proxyHandler := handlers.NewProxyHandler(logger, ps)
+	runtimeHandler := handlers.NewRuntimeHandler(logger, rs)
+	gcHandler := handlers.NewImageGCHandler(logger, cs, collector)
+	webhookHandler := handlers.NewWebhookHandler(logger, fs, worker)
+	envHandler := handlers.NewEnvHandler(logger, kw, fs, es)
+	proxyHandler := handlers.NewProxyHandler(logger, ps, activator, metrics)
 	// add function
 	router.HandleFunc("/function/{projectId}", middlewares.AuthMiddleware(function.CreateFunction)).
 		Methods(http.MethodPost)
@@ -98,6 +225,90 @@ func main() {
 	).
 		Methods(http.MethodPost)
 
+	// upload a source archive for the function
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/source",
+		middlewares.AuthMiddleware(function.UploadSource),
+	).
+		Methods(http.MethodPost)
+
+	// build the function from a git repository
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/source/git",
+		middlewares.AuthMiddleware(function.SetGitSource),
+	).
+		Methods(http.MethodPut)
+
+	// create the push webhook of a git function or replace its secret
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/source/git/webhook",
+		middlewares.AuthMiddleware(webhookHandler.CreateGitWebhook),
+	).
+		Methods(http.MethodPost)
+
+	// push webhooks from git hosts. verified with the function's webhook secret instead of a token
+	router.HandleFunc("/hooks/git/{functionId}", webhookHandler.GitPush).Methods(http.MethodPost)
+
+	// cpu, memory and replica bounds of the function
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/resources",
+		middlewares.AuthMiddleware(function.SetResources),
+	).
+		Methods(http.MethodPut)
+
+	// health check path and thresholds of the function
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/probes",
+		middlewares.AuthMiddleware(function.SetProbes),
+	).
+		Methods(http.MethodPut)
+
+	// environment variables of the function
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/env",
+		middlewares.AuthMiddleware(envHandler.ListEnv),
+	).
+		Methods(http.MethodGet)
+
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/env/{name}",
+		middlewares.AuthMiddleware(envHandler.SetEnv),
+	).
+		Methods(http.MethodPut)
+
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/env/{name}",
+		middlewares.AuthMiddleware(envHandler.DeleteEnv),
+	).
+		Methods(http.MethodDelete)
+
+	// get a build and its position in the build queue
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/builds/{buildId}",
+		middlewares.AuthMiddleware(function.GetBuild),
+	).
+		Methods(http.MethodGet)
+
+	// cancel a queued or running build
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/builds/{buildId}/cancel",
+		middlewares.AuthMiddleware(function.CancelBuild),
+	).
+		Methods(http.MethodPost)
+
+	// revisions of the function, newest first
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/revisions",
+		middlewares.AuthMiddleware(function.ListRevisions),
+	).
+		Methods(http.MethodGet)
+
+	router.HandleFunc(
+		"/function/{projectId}/{codeId}/revisions/{revision:[0-9]+}",
+		middlewares.AuthMiddleware(function.GetRevision),
+	).
+		Methods(http.MethodGet)
+
 	// list functions created by the user
 	router.HandleFunc("/functions/{projectId}", middlewares.AuthMiddleware(function.ListFunctions)).
 		Methods(http.MethodGet)
@@ -122,49 +333,36 @@ func main() {
 	router.HandleFunc("/function/{projectId}/{codeId}/deploy", middlewares.AuthMiddleware(function.DeployFunction)).
 		Methods(http.MethodPost)
 
-	router.HandleFunc("/function/{projectId}/{codeId}/redeploy", middlewares.AuthMiddleware(function.RedeployFunction)).
+	// point the deployment back at an earlier revision
+	router.HandleFunc("/function/{projectId}/{codeId}/rollback", middlewares.AuthMiddleware(function.RollbackFunction)).
 		Methods(http.MethodPost)
 
-		// ------------------ CONFIG ROUTES
-	router.HandleFunc("/config/", configHandler.CreateConfig).Methods(http.MethodPost)
-
-	router.HandleFunc("/serve/{functionId}", func(rw http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-
-		functionId := vars["functionId"]
+	// deployment history of the function
+	router.HandleFunc("/function/{projectId}/{codeId}/history", middlewares.AuthMiddleware(function.ListRollouts)).
+		Methods(http.MethodGet)
 
-		_, err := ps.VerifyFunction(functionId)
-		if err != nil {
-			http.Error(rw, err.Error(), 400)
-		}
+	router.HandleFunc("/function/{projectId}/{codeId}/redeploy", middlewares.AuthMiddleware(function.RedeployFunction)).
+		Methods(http.MethodPost)
 
-		urlString := r.URL.String()
-		fmt.Printf("urlString: %v\n", urlString)
-		x := strings.Split(urlString, "/serve/"+functionId)
+	// background build and deploy jobs
+	router.HandleFunc("/jobs/{jobId}", middlewares.AuthMiddleware(jobHandler.GetJob)).
+		Methods(http.MethodGet)
 
-		functionURL := "http://cloudbase-serverless-" + functionId + "-srv:4000" + x[0]
-		fmt.Printf("functionURL: %v\n", functionURL)
+	router.HandleFunc("/jobs/{jobId}/events", middlewares.AuthMiddleware(jobHandler.StreamJobEvents)).
+		Methods(http.MethodGet)
 
-		finalURL, err := url.Parse(functionURL)
-		fmt.Printf("finalURL: %v\n", finalURL)
-		if err != nil {
-			http.Error(rw, err.Error(), 400)
-		}
-		_, err = http.Get(functionURL)
-		RequestCounter.Inc()
+	// list the supported runtimes
+	router.HandleFunc("/runtimes", runtimeHandler.ListRuntimes).Methods(http.MethodGet)
 
-		proxy := httputil.NewSingleHostReverseProxy(finalURL)
-		r.URL.Host = finalURL.Host
-		r.URL.Scheme = finalURL.Scheme
-		r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-		r.Host = finalURL.Host
-		r.URL.Path = finalURL.Path
-		r.URL.RawPath = finalURL.RawPath
-		proxy.ServeHTTP(rw, r)
+	// images of the project the garbage collector would delete
+	router.HandleFunc("/images/{projectId}/gc", middlewares.AuthMiddleware(gcHandler.GetReport)).
+		Methods(http.MethodGet)
 
-		// http://backend.cloudbase.dev/deploy/asdadjpiqwjdpqidjp/qwwe?123=qwe -> proxy to -> http://cloudbase-serverless-asdadjpiqwjdpqidjp-srv:4000qwwe?123=qwe
+	// ------------------ CONFIG ROUTES
+	router.HandleFunc("/config/", configHandler.CreateConfig).Methods(http.MethodPost)
 
-	}).Methods(http.MethodGet)
+	// requests to functions. idle functions are scaled to zero and started by the first request
+	router.PathPrefix("/serve/{functionId}").HandlerFunc(proxyHandler.ProxyRequest)
 
 	router.HandleFunc("/testing", func(w http.ResponseWriter, r *http.Request) {
 	})
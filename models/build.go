@@ -0,0 +1,42 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Array of builds
+type Builds []*Build
+
+// A build of a function. Queued builds are kept here so they survive restarts.
+type Build struct {
+	ID         uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt  time.Time      `                                                       json:"createdAt"` // auto populated by gorm. queue order
+	UpdatedAt  time.Time      `                                                       json:"-"`         // auto populated by gorm
+	DeletedAt  gorm.DeletedAt `gorm:"index"                                           json:"-"`         // auto populated by gorm
+	FunctionID uuid.UUID      `gorm:"type:uuid;index"                                 json:"functionId"`
+	ConfigID   uuid.UUID      `gorm:"type:uuid;index"                                 json:"-"`        // the project. builds are scheduled fairly across projects
+	Revision   int            `                                                       json:"revision"` // the revision built
+	Action     string         `                                                       json:"action"`   // Build or Update
+	Status     string         `gorm:"default:'Queued';index"                          json:"status"`
+	FailReason string         `                                                       json:"failReason"`
+	StartedAt  *time.Time     `                                                       json:"startedAt"`
+	FinishedAt *time.Time     `                                                       json:"finishedAt"`
+	LogTail    string         `                                                       json:"logTail"` // last lines of the build log
+	// 1 based position in the build queue. 0 once the build has started
+	QueuePosition int `gorm:"-"                                               json:"queuePosition"`
+}
+
+func (b *Builds) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(b)
+}
+
+func (b *Build) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(b)
+}
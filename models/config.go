@@ -10,13 +10,17 @@ import (
 )
 
 type Config struct {
-	ID        uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
-	CreatedAt time.Time      `                                                       json:"-"`         // auto populated by gorm
-	UpdatedAt time.Time      `                                                       json:"-"`         // auto populated by gorm
-	DeletedAt gorm.DeletedAt `gorm:"index"                                           json:"-"`         // auto populated by gorm
-	ProjectId string         `                                                       json:"projectId"` // user table is controlled by cloudbase-main
-	Owner     string         `                                                       json:"owner"`
-	Enabled   bool           `                                                       json:"enabled"`
+	ID           uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt    time.Time      `                                                       json:"-"`         // auto populated by gorm
+	UpdatedAt    time.Time      `                                                       json:"-"`         // auto populated by gorm
+	DeletedAt    gorm.DeletedAt `gorm:"index"                                           json:"-"`         // auto populated by gorm
+	ProjectId    string         `                                                       json:"projectId"` // user table is controlled by cloudbase-main
+	Owner        string         `                                                       json:"owner"`
+	Enabled      bool           `                                                       json:"enabled"`
+	BuildTimeout int            `                                                       json:"buildTimeout"` // seconds. the runtime's or the server's timeout when 0
+	MaxCPU       string         `                                                       json:"maxCpu"`       // per function. unlimited when empty
+	MaxMemory    string         `                                                       json:"maxMemory"`    // per function. unlimited when empty
+	MaxReplicas  int            `                                                       json:"maxReplicas"`  // per function. unlimited when 0
 }
 
 func (f *Config) ToJSON(w io.Writer) error {
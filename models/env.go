@@ -0,0 +1,39 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Array of environment variables
+type EnvVars []*EnvVar
+
+/*
+An environment variable of a function. Secret values are stored encrypted and never returned;
+plain values are stored as is.
+*/
+type EnvVar struct {
+	ID         uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt  time.Time      `                                                       json:"createdAt"` // auto populated by gorm
+	UpdatedAt  time.Time      `                                                       json:"updatedAt"` // auto populated by gorm
+	DeletedAt  gorm.DeletedAt `gorm:"index"                                           json:"-"`         // auto populated by gorm
+	FunctionID uuid.UUID      `gorm:"type:uuid;uniqueIndex:idx_function_env"          json:"functionId"`
+	Name       string         `gorm:"uniqueIndex:idx_function_env"                    json:"name"`
+	Value      string         `                                                       json:"value"` // empty for secrets
+	Secret     bool           `                                                       json:"secret"`
+	Ciphertext []byte         `                                                       json:"-"` // the secret value, sealed with SECRETS_KEY
+}
+
+func (e *EnvVars) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(e)
+}
+
+func (e *EnvVar) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(e)
+}
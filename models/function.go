@@ -18,15 +18,46 @@ type Function struct {
 	UpdatedAt time.Time      `                                                       json:"-"` // auto populated by gorm
 	DeletedAt gorm.DeletedAt `gorm:"index"                                           json:"-"` // auto populated by gorm
 	// UserId           string         `                                                       json:"userId"` // user table is controlled by cloudbase-main
-	Code             string `                                                       json:"code"`
-	Language         string `                                                       json:"language"`
-	BuildStatus      string `gorm:"default:'NotBuilt'"                              json:"buildStatus"`
-	BuildFailReason  string `                                                       json:"buildFailReason"`
-	DeployStatus     string `gorm:"default:'NotDeployed'"                           json:"deployStatus"`
-	DeployFailReason string `                                                       json:"deployFailReason"`
-	LastAction       string `gorm:"default:'Create'"                                json:"lastAction"`
-	ConfigID         uuid.UUID
-	Config           Config
+	Code                  string     `                                                       json:"code"`
+	SourceType            string     `gorm:"default:'Inline'"                                json:"sourceType"`
+	SourceArchiveID       *uuid.UUID `gorm:"type:uuid"                                       json:"sourceArchiveId"`
+	GitURL                string     `                                                       json:"gitUrl"`
+	GitRef                string     `                                                       json:"gitRef"` // branch, tag or commit. the default branch when empty
+	GitSubdirectory       string     `                                                       json:"gitSubdirectory"`
+	WebhookSecret         string     `                                                       json:"-"`          // verifies push webhooks. webhooks are off when empty
+	AutoDeploy            bool       `                                                       json:"autoDeploy"` // deploy builds triggered by a push webhook
+	Language              string     `                                                       json:"language"`
+	Dependencies          string     `                                                       json:"dependencies"`
+	Lockfile              string     `                                                       json:"lockfile"`
+	BuildStatus           string     `gorm:"default:'NotBuilt'"                              json:"buildStatus"`
+	BuildFailReason       string     `                                                       json:"buildFailReason"`
+	Image                 string     `                                                       json:"image"`            // image of the latest successful build, tagged with its revision
+	ImageDigest           string     `                                                       json:"imageDigest"`      // sha256 digest of Image. deployments pin it
+	Revision              int        `                                                       json:"revision"`         // latest successfully built revision
+	BuildLog              string     `                                                       json:"buildLog"`         // last lines of the latest build's log
+	DeployedRevision      int        `                                                       json:"deployedRevision"` // revision the deployment runs. 0 if unknown
+	DeployStatus          string     `gorm:"default:'NotDeployed'"                           json:"deployStatus"`
+	DeployFailReason      string     `                                                       json:"deployFailReason"`
+	ImagesCollected       bool       `                                                       json:"-"` // the function was deleted and its images are gone
+	LastAction            string     `gorm:"default:'Create'"                                json:"lastAction"`
+	CPURequest            string     `                                                       json:"cpuRequest"`            // kubernetes quantity, like 250m. the default when empty
+	CPULimit              string     `                                                       json:"cpuLimit"`              // the project's max cpu when empty
+	MemoryRequest         string     `                                                       json:"memoryRequest"`         // kubernetes quantity, like 128Mi
+	MemoryLimit           string     `                                                       json:"memoryLimit"`           // the project's max memory when empty
+	MinReplicas           int        `                                                       json:"minReplicas"`           // 1 when 0
+	MaxReplicas           int        `                                                       json:"maxReplicas"`           // 3, or the project's max, when 0
+	TargetCPU             int        `                                                       json:"targetCpu"`             // average cpu utilization the hpa scales at, percent of the request. 15 when 0
+	IdleTimeout           int        `                                                       json:"idleTimeout"`           // seconds without requests before it is scaled to zero. the server's when 0, never when negative
+	Scaler                string     `                                                       json:"scaler"`                // HPA or Builtin. HPA when empty
+	ScalingMetric         string     `                                                       json:"scalingMetric"`         // CPU, Concurrency or RPS. CPU when empty
+	ScalingTarget         int        `                                                       json:"scalingTarget"`         // per pod concurrency or requests per second to scale at
+	HealthPath            string     `                                                       json:"healthPath"`            // path the probes check. the runtime's health endpoint when empty
+	ProbePeriod           int        `                                                       json:"probePeriod"`           // seconds between readiness and liveness checks. 10 when 0
+	ProbeTimeout          int        `                                                       json:"probeTimeout"`          // seconds a check may take. 1 when 0
+	ProbeFailureThreshold int        `                                                       json:"probeFailureThreshold"` // failed checks before a pod is unready or restarted. 3 when 0
+	StartupTimeout        int        `                                                       json:"startupTimeout"`        // seconds a pod has to pass its first check. 60 when 0
+	ConfigID              uuid.UUID
+	Config                Config
 }
 
 func (f *Functions) ToJSON(w io.Writer) error {
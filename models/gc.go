@@ -0,0 +1,37 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// An image found by the image garbage collector
+type CollectedImage struct {
+	FunctionID uuid.UUID `json:"functionId"`
+	// 0 for images that don't belong to a known revision
+	Revision int    `json:"revision,omitempty"`
+	Image    string `json:"image"`
+	Digest   string `json:"digest"`
+	// why the image is garbage
+	Reason string `json:"reason"`
+	// false in a dry run
+	Deleted bool `json:"deleted"`
+}
+
+// What a run of the image garbage collector deleted, or would delete in a dry run. Not persisted
+type ImageGCReport struct {
+	DryRun     bool              `json:"dryRun"`
+	Keep       int               `json:"keep"` // revisions kept per function
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt time.Time         `json:"finishedAt"`
+	Images     []*CollectedImage `json:"images"`
+	Errors     []string          `json:"errors"`
+}
+
+func (r *ImageGCReport) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(r)
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// A background build or deployment. Returned right away so the outcome isn't lost if the client goes away.
+type Job struct {
+	ID         uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt  time.Time      `                                                       json:"createdAt"` // auto populated by gorm
+	UpdatedAt  time.Time      `                                                       json:"-"`         // auto populated by gorm
+	DeletedAt  gorm.DeletedAt `gorm:"index"                                           json:"-"`         // auto populated by gorm
+	Type       string         `                                                       json:"type"`
+	Status     string         `gorm:"default:'Pending';index"                         json:"status"`
+	FunctionID uuid.UUID      `gorm:"type:uuid;index"                                 json:"functionId"`
+	ConfigID   uuid.UUID      `gorm:"type:uuid"                                       json:"-"`
+	Revision   int            `                                                       json:"revision,omitempty"`   // target of rollback jobs
+	BuildID    *uuid.UUID     `gorm:"type:uuid"                                       json:"buildId,omitempty"`    // set for build jobs
+	AutoDeploy bool           `                                                       json:"autoDeploy,omitempty"` // deploy once the build succeeded
+	StartedAt  *time.Time     `                                                       json:"startedAt"`
+	FinishedAt *time.Time     `                                                       json:"finishedAt"`
+	// final build or deploy status of the function
+	Result string `                                                       json:"result"`
+	Error  string `                                                       json:"error"`
+}
+
+func (j *Job) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(j)
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Array of revisions
+type FunctionRevisions []*FunctionRevision
+
+/*
+An immutable snapshot of a function taken when a build is queued. Revisions are numbered per
+function starting at 1 and keep the source, so any of them can be rebuilt or deployed again.
+*/
+type FunctionRevision struct {
+	ID              uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt       time.Time      `                                                       json:"createdAt"` // auto populated by gorm
+	UpdatedAt       time.Time      `                                                       json:"-"`         // auto populated by gorm
+	DeletedAt       gorm.DeletedAt `gorm:"index"                                           json:"-"`         // auto populated by gorm
+	FunctionID      uuid.UUID      `gorm:"type:uuid;uniqueIndex:idx_function_revision"     json:"functionId"`
+	Number          int            `gorm:"uniqueIndex:idx_function_revision"               json:"number"`
+	BuildID         uuid.UUID      `gorm:"type:uuid;index"                                 json:"buildId"`
+	Code            string         `                                                       json:"code"`
+	SourceType      string         `                                                       json:"sourceType"`
+	SourceArchiveID *uuid.UUID     `gorm:"type:uuid"                                       json:"sourceArchiveId"`
+	GitURL          string         `                                                       json:"gitUrl"`
+	GitRef          string         `                                                       json:"gitRef"`
+	GitSubdirectory string         `                                                       json:"gitSubdirectory"`
+	GitCommit       string         `                                                       json:"gitCommit"` // the ref resolved when the revision was built
+	Language        string         `                                                       json:"language"`
+	Dependencies    string         `                                                       json:"dependencies"`
+	Lockfile        string         `                                                       json:"lockfile"`
+	Image           string         `                                                       json:"image"`  // tagged with the revision number
+	Digest          string         `                                                       json:"digest"` // set once the image is pushed
+	BuildStatus     string         `gorm:"default:'Queued'"                                json:"buildStatus"`
+	BuildFailReason string         `                                                       json:"buildFailReason"`
+	ImageDeletedAt  *time.Time     `                                                       json:"imageDeletedAt"` // set once the image was garbage collected
+	HealthPath      string         `                                                       json:"healthPath"`     // health endpoint of the runtime the image was built with. probes check the port when empty
+	// built successfully and its image not garbage collected, so it can be rolled back to
+	CanRollback bool `gorm:"-"                                               json:"canRollback"`
+}
+
+func (r *FunctionRevisions) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(r)
+}
+
+func (r *FunctionRevision) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(r)
+}
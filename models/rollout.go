@@ -0,0 +1,39 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Array of rollouts
+type Rollouts []*Rollout
+
+// A change of a function's deployment: a deploy, a redeploy or a rollback. Kept as its deployment history.
+type Rollout struct {
+	ID         uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt  time.Time      `                                                       json:"createdAt"` // auto populated by gorm
+	UpdatedAt  time.Time      `                                                       json:"-"`         // auto populated by gorm
+	DeletedAt  gorm.DeletedAt `gorm:"index"                                           json:"-"`         // auto populated by gorm
+	FunctionID uuid.UUID      `gorm:"type:uuid;index"                                 json:"functionId"`
+	JobID      uuid.UUID      `gorm:"type:uuid;index"                                 json:"jobId"`
+	Action     string         `                                                       json:"action"` // Deploy, Redeploy or Rollback
+	Revision   int            `                                                       json:"revision"`
+	Image      string         `                                                       json:"image"`
+	Status     string         `gorm:"default:'Deploying'"                             json:"status"`
+	FailReason string         `                                                       json:"failReason"`
+	FinishedAt *time.Time     `                                                       json:"finishedAt"`
+}
+
+func (r *Rollouts) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(r)
+}
+
+func (r *Rollout) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(r)
+}
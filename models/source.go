@@ -0,0 +1,28 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// An uploaded source archive. Stored as a normalized gzipped tar.
+type SourceArchive struct {
+	ID         uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	CreatedAt  time.Time      `                                                       json:"-"` // auto populated by gorm
+	UpdatedAt  time.Time      `                                                       json:"-"` // auto populated by gorm
+	DeletedAt  gorm.DeletedAt `gorm:"index"                                           json:"-"` // auto populated by gorm
+	FunctionID uuid.UUID      `gorm:"type:uuid;index"                                 json:"functionId"`
+	Data       []byte         `                                                       json:"-"`
+	Size       int            `                                                       json:"size"`
+	Files      int            `                                                       json:"files"`
+	Checksum   string         `                                                       json:"checksum"` // sha256 of Data
+}
+
+func (s *SourceArchive) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(s)
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Where to point a git host's push webhook. The secret is only shown when it is created
+type GitWebhook struct {
+	URL        string `json:"url"`
+	Secret     string `json:"secret"`
+	AutoDeploy bool   `json:"autoDeploy"`
+}
+
+func (h *GitWebhook) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(h)
+}
@@ -0,0 +1,309 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifest types asked for when resolving a tag. the digest depends on the type returned
+var manifestTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// returned when the repository or manifest does not exist
+var ErrNotFound = errors.New("not found in registry")
+
+/*
+A client for the parts of the OCI distribution API needed to clean up images: listing tags,
+resolving tags to digests and deleting manifests. Handles basic and bearer token auth.
+*/
+type Client struct {
+	host     string
+	username string
+	password string
+	scheme   string
+	insecure bool
+	http     *http.Client
+
+	mu sync.Mutex
+	// Authorization header per repository, from the last challenge
+	auth map[string]string
+}
+
+// A client for the registry of config. username and password may be empty for anonymous access
+func NewClient(config Config, username string, password string) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &Client{
+		host:     config.Host,
+		username: username,
+		password: password,
+		scheme:   "https",
+		insecure: config.Insecure,
+		http:     &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		auth:     map[string]string{},
+	}
+}
+
+// Tags of a repository. repository is the path without the host
+func (c *Client) Tags(ctx context.Context, repository string) ([]string, error) {
+	var tags []string
+	path := "/v2/" + repository + "/tags/list"
+	for path != "" {
+		resp, err := c.do(ctx, http.MethodGet, repository, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+		path = nextPage(resp.Header.Get("Link"))
+	}
+	return tags, nil
+}
+
+// Digest of the manifest a tag points to
+func (c *Client) Digest(ctx context.Context, repository string, tag string) (string, error) {
+	headers := map[string]string{"Accept": strings.Join(manifestTypes, ", ")}
+	resp, err := c.do(ctx, http.MethodHead, repository, "/v2/"+repository+"/manifests/"+tag, headers)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("%v:%v: registry returned no digest", repository, tag)
+	}
+	return digest, nil
+}
+
+// Delete a manifest by digest. Every tag pointing to it goes with it
+func (c *Client) Delete(ctx context.Context, repository string, digest string) error {
+	resp, err := c.do(ctx, http.MethodDelete, repository, "/v2/"+repository+"/manifests/"+digest, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+/*
+Send a request, answering an auth challenge once if the registry asks for one. Errors for
+any status other than 2xx, ErrNotFound for 404.
+*/
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	repository string,
+	path string,
+	headers map[string]string,
+) (*http.Response, error) {
+	resp, err := c.send(ctx, method, repository, path, headers)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.authenticate(ctx, repository, challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = c.send(ctx, method, repository, path, headers); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v %v: %v %s", method, path, resp.Status, body)
+	}
+	return resp, nil
+}
+
+func (c *Client) send(
+	ctx context.Context,
+	method string,
+	repository string,
+	path string,
+	headers map[string]string,
+) (*http.Response, error) {
+	c.mu.Lock()
+	scheme := c.scheme
+	auth, authenticated := c.auth[repository]
+	c.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+c.host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if authenticated {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := c.http.Do(req)
+	// insecure registries may not speak https at all
+	if err != nil && c.insecure && scheme == "https" && ctx.Err() == nil {
+		c.mu.Lock()
+		c.scheme = "http"
+		c.mu.Unlock()
+		return c.send(ctx, method, repository, path, headers)
+	}
+	return resp, err
+}
+
+// answer a WWW-Authenticate challenge and remember the header for the repository
+func (c *Client) authenticate(ctx context.Context, repository string, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	var auth string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return errors.New("registry requires credentials")
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(c.username, c.password)
+		auth = req.Header.Get("Authorization")
+	case "bearer":
+		token, err := c.token(ctx, params)
+		if err != nil {
+			return err
+		}
+		auth = "Bearer " + token
+	default:
+		return fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+	c.mu.Lock()
+	c.auth[repository] = auth
+	c.mu.Unlock()
+	return nil
+}
+
+// get a bearer token from the registry's token service
+func (c *Client) token(ctx context.Context, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	if scope, ok := params["scope"]; ok {
+		query.Set("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %v", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.New("token service returned no token")
+}
+
+// split `Bearer realm="...",service="...",scope="..."` into the scheme and its parameters
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	scheme, rest, _ := cut(strings.TrimSpace(challenge), " ")
+	for rest != "" {
+		var key, value string
+		key, rest, _ = cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+	return scheme, params
+}
+
+// path of the next page from a `Link: </v2/...>; rel="next"` header. empty on the last page
+func nextPage(link string) string {
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return ""
+	}
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	next, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+	return next.RequestURI()
+}
+
+/*
+Split an image reference like host/path:tag@sha256:... into the host, the repository path, the
+tag and the digest. Tag and digest are empty when not given.
+*/
+func ParseImage(image string) (host string, repository string, tag string, digest string) {
+	image, digest, _ = cut(image, "@")
+	host, repository, _ = cut(image, "/")
+	// a colon after the last slash separates the tag. one before it is the host's port
+	if i := strings.LastIndex(repository, ":"); i >= 0 && !strings.Contains(repository[i:], "/") {
+		repository, tag = repository[:i], repository[i+1:]
+	}
+	return host, repository, tag, digest
+}
+
+// strings.Cut, which the go version we build with doesn't have yet
+func cut(s string, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
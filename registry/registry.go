@@ -0,0 +1,212 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultHost       = "ghcr.io"
+	DefaultNamespace  = "cloudbase-project"
+	DefaultRepository = "{namespace}/{function}"
+	DefaultTag        = "{revision}"
+	DefaultSecretName = "regcred"
+	// layers are cached per runtime so functions of the same runtime share them
+	DefaultCacheRepository = "{namespace}/cache/{runtime}"
+)
+
+// Where function images are pushed and how they are named.
+type Config struct {
+	// registry host, with the port if any. e.g. ghcr.io or registry.local:5000
+	Host string `json:"host"`
+	// path under the host the repositories are created in
+	Namespace string `json:"namespace"`
+	// repository path pattern. {namespace}, {project} and {function} are replaced
+	Repository string `json:"repository"`
+	// tag pattern. {revision} and {build} are replaced
+	Tag string `json:"tag"`
+	// layer cache repository pattern. {namespace}, {project} and {runtime} are replaced. empty
+	// turns the cache off
+	CacheRepository string `json:"cacheRepository"`
+	// plain http or a self signed certificate. for local and air-gapped registries
+	Insecure bool `json:"insecure"`
+	// docker-config secret with the credentials for the registry
+	SecretName string `json:"secretName"`
+}
+
+/*
+The registry configuration: a default and overrides for single projects. Fields left empty in
+an override are taken from the default.
+*/
+type Registries struct {
+	Default  Config            `json:"default"`
+	Projects map[string]Config `json:"projects"`
+}
+
+/*
+Registry configuration from the environment. REGISTRY, PROJECT_NAME, REGISTRY_REPOSITORY,
+REGISTRY_TAG, REGISTRY_CACHE_REPOSITORY, REGISTRY_INSECURE and REGISTRY_SECRET set the default.
+BUILD_CACHE=false turns the layer cache off.
+*/
+func FromEnv() (*Registries, error) {
+	insecure := false
+	if value, ok := os.LookupEnv("REGISTRY_INSECURE"); ok {
+		var err error
+		if insecure, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("REGISTRY_INSECURE: %w", err)
+		}
+	}
+	cacheRepository := getEnv("REGISTRY_CACHE_REPOSITORY", DefaultCacheRepository)
+	if value, ok := os.LookupEnv("BUILD_CACHE"); ok {
+		if cache, err := strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("BUILD_CACHE: %w", err)
+		} else if !cache {
+			cacheRepository = ""
+		}
+	}
+	r := &Registries{
+		Default: Config{
+			Host:            getEnv("REGISTRY", DefaultHost),
+			Namespace:       getEnv("PROJECT_NAME", DefaultNamespace),
+			Repository:      getEnv("REGISTRY_REPOSITORY", DefaultRepository),
+			Tag:             getEnv("REGISTRY_TAG", DefaultTag),
+			CacheRepository: cacheRepository,
+			Insecure:        insecure,
+			SecretName:      getEnv("REGISTRY_SECRET", DefaultSecretName),
+		},
+		Projects: map[string]Config{},
+	}
+	return r, r.Default.validate()
+}
+
+/*
+Load per project overrides from a JSON file:
+
+	{"projects": {"<projectId>": {"host": "registry.local:5000", "insecure": true, "secretName": "local-regcred"}}}
+
+A "default" object in the file replaces the fields it sets in the default.
+*/
+func (r *Registries) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file Registries
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	insecure := r.Default.Insecure || file.Default.Insecure
+	r.Default = file.Default.inherit(r.Default)
+	r.Default.Insecure = insecure
+	if err := r.Default.validate(); err != nil {
+		return err
+	}
+	for project, config := range file.Projects {
+		if err := config.inherit(r.Default).validate(); err != nil {
+			return fmt.Errorf("project %v: %w", project, err)
+		}
+		r.Projects[project] = config
+	}
+	return nil
+}
+
+// The registry configuration of a project
+func (r *Registries) For(projectId string) Config {
+	if config, ok := r.Projects[projectId]; ok {
+		return config.inherit(r.Default)
+	}
+	return r.Default
+}
+
+// Every configuration in use. The default comes first
+func (r *Registries) All() []Config {
+	all := []Config{r.Default}
+	for _, config := range r.Projects {
+		all = append(all, config.inherit(r.Default))
+	}
+	return all
+}
+
+// Repository of a function's images, with the host
+func (c Config) ImageRepository(projectId string, functionId string) string {
+	path := strings.NewReplacer(
+		"{namespace}", c.Namespace,
+		"{project}", projectId,
+		"{function}", functionId,
+	).Replace(c.Repository)
+	return c.Host + "/" + strings.Trim(path, "/")
+}
+
+// Tag of the image built for a revision
+func (c Config) ImageTag(revision int, buildId string) string {
+	return strings.NewReplacer(
+		"{revision}", strconv.Itoa(revision),
+		"{build}", buildId,
+	).Replace(c.Tag)
+}
+
+// Repository of the layer cache for builds of a runtime, with the host. Empty if caching is off
+func (c Config) ImageCacheRepository(projectId string, runtime string) string {
+	if c.CacheRepository == "" {
+		return ""
+	}
+	path := strings.NewReplacer(
+		"{namespace}", c.Namespace,
+		"{project}", projectId,
+		// repository names are lowercase
+		"{runtime}", strings.ToLower(runtime),
+	).Replace(c.CacheRepository)
+	return c.Host + "/" + strings.Trim(path, "/")
+}
+
+// fields not set are taken from parent
+func (c Config) inherit(parent Config) Config {
+	if c.Host == "" {
+		c.Host = parent.Host
+	}
+	if c.Namespace == "" {
+		c.Namespace = parent.Namespace
+	}
+	if c.Repository == "" {
+		c.Repository = parent.Repository
+	}
+	if c.Tag == "" {
+		c.Tag = parent.Tag
+	}
+	if c.SecretName == "" {
+		c.SecretName = parent.SecretName
+	}
+	if c.CacheRepository == "" {
+		c.CacheRepository = parent.CacheRepository
+	}
+	// insecure has to be set explicitly per project
+	return c
+}
+
+func (c Config) validate() error {
+	if c.Host == "" {
+		return errors.New("registry host is required")
+	}
+	if !strings.Contains(c.Repository, "{function}") {
+		return errors.New("repository pattern must contain {function}")
+	}
+	// every build needs its own tag or older revisions get overwritten
+	if !strings.Contains(c.Tag, "{revision}") && !strings.Contains(c.Tag, "{build}") {
+		return errors.New("tag pattern must contain {revision} or {build}")
+	}
+	if c.SecretName == "" {
+		return errors.New("registry secret name is required")
+	}
+	return nil
+}
+
+func getEnv(key string, def string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return def
+}
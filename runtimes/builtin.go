@@ -0,0 +1,183 @@
+package runtimes
+
+import "github.com/Cloudbase-Project/serverless/constants"
+
+var builtin = []*Runtime{
+	{
+		Name:                 constants.NODEJS,
+		Version:              "16",
+		SourceFile:           "index.js",
+		DependencyFile:       "package.json",
+		DependencyFormat:     NpmFormat,
+		LockFile:             "package-lock.json",
+		RequiredDependencies: map[string]string{"express": "^4.17.1"},
+		Port:                 4000,
+		HealthPath:           "/healthz",
+		Dockerfile:           nodejsDockerfile,
+		Files:                map[string]string{"cloudbase-health.js": nodejsHealth},
+	},
+	{
+		Name:       constants.GOLANG,
+		Version:    "1.17",
+		SourceFile: "handler.go",
+		Port:       4000,
+		HealthPath: "/healthz",
+		Dockerfile: golangDockerfile,
+		Files:      map[string]string{"main.go": golangMain, "go.mod": golangGoMod},
+	},
+	{
+		Name:             constants.PYTHON,
+		Version:          "3.10",
+		SourceFile:       "main.py",
+		DependencyFile:   "requirements.txt",
+		DependencyFormat: PipFormat,
+		Port:             4000,
+		HealthPath:       "/healthz",
+		Dockerfile:       pythonDockerfile,
+		Files:            map[string]string{"server.py": pythonServer},
+	},
+}
+
+// package-lock.json is only present when the user supplied one
+const nodejsDockerfile = `FROM node:16-alpine
+WORKDIR /app
+COPY package*.json ./
+RUN if [ -f package-lock.json ]; then npm ci; else npm install; fi
+COPY . .
+CMD ["node", "--require", "./cloudbase-health.js", "index.js"]
+`
+
+// preloaded before the user's index.js. answers /healthz on any http server it starts, so the
+// health check passes once the function listens and fails when its event loop is stuck.
+const nodejsHealth = `const http = require("http");
+
+const emit = http.Server.prototype.emit;
+http.Server.prototype.emit = function (event, request, response) {
+  if (event === "request" && request.url.split("?")[0] === "/healthz") {
+    response.writeHead(200, { "Content-Type": "text/plain" });
+    response.end("ok");
+    return true;
+  }
+  return emit.apply(this, arguments);
+};
+`
+
+// multi stage build. go mod tidy resolves whatever the user's handler imports.
+const golangDockerfile = `FROM golang:1.17-alpine AS build
+WORKDIR /src
+COPY . .
+RUN go mod tidy && CGO_ENABLED=0 go build -ldflags="-s -w" -o /function .
+
+FROM alpine:3.15 AS certs
+RUN apk add --no-cache ca-certificates
+
+FROM scratch
+COPY --from=certs /etc/ssl/certs/ca-certificates.crt /etc/ssl/certs/
+COPY --from=build /function /function
+EXPOSE 4000
+ENTRYPOINT ["/function"]
+`
+
+const golangGoMod = `module cloudbase.dev/function
+
+go 1.17
+`
+
+// wraps the user's Handle function in an http server listening on the function port. /healthz is for the probes.
+const golangMain = `package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+)
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "4000"
+	}
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	http.HandleFunc("/", Handle)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
+`
+
+// requirements.txt is always present in the context. it is empty when the user did not supply one.
+const pythonDockerfile = `FROM python:3.10-slim
+WORKDIR /app
+COPY requirements.txt .
+RUN pip install --no-cache-dir -r requirements.txt
+COPY . .
+EXPOSE 4000
+CMD ["python", "-u", "server.py"]
+`
+
+// serves the handle(request) function defined in the user's main.py on the function port.
+const pythonServer = `import json
+import os
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from urllib.parse import parse_qs, urlparse
+
+import main
+
+
+class Request:
+    def __init__(self, method, path, query, headers, body):
+        self.method = method
+        self.path = path
+        self.query = query
+        self.headers = headers
+        self.body = body
+
+    def json(self):
+        return json.loads(self.body or b"null")
+
+
+class Handler(BaseHTTPRequestHandler):
+    def handle_any(self):
+        url = urlparse(self.path)
+        if url.path == "/healthz":
+            self.send_response(200)
+            self.send_header("Content-Length", "2")
+            self.end_headers()
+            self.wfile.write(b"ok")
+            return
+        length = int(self.headers.get("Content-Length") or 0)
+        request = Request(
+            self.command,
+            url.path,
+            parse_qs(url.query),
+            dict(self.headers),
+            self.rfile.read(length) if length else b"",
+        )
+        status, headers = 200, {}
+        try:
+            result = main.handle(request)
+        except Exception as e:
+            result, status = str(e), 500
+        if isinstance(result, tuple):
+            result, status, headers = (list(result) + [{}])[:3]
+        if isinstance(result, (dict, list)):
+            result = json.dumps(result)
+            headers.setdefault("Content-Type", "application/json")
+        if result is None:
+            result = b""
+        if isinstance(result, str):
+            result = result.encode()
+        self.send_response(status)
+        for key, value in headers.items():
+            self.send_header(key, value)
+        self.send_header("Content-Length", str(len(result)))
+        self.end_headers()
+        self.wfile.write(result)
+
+    do_GET = do_POST = do_PUT = do_PATCH = do_DELETE = handle_any
+
+
+if __name__ == "__main__":
+    port = int(os.environ.get("PORT", "4000"))
+    ThreadingHTTPServer(("", port), Handler).serve_forever()
+`
@@ -0,0 +1,163 @@
+package runtimes
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// supported dependency manifest formats
+const (
+	NpmFormat = "npm"
+	PipFormat = "pip"
+)
+
+// max size of a dependency manifest or lockfile
+const MaxDependencyFileSize = 512 * 1024
+
+var npmPackageName = regexp.MustCompile(`^(@[a-z0-9-~][a-z0-9-._~]*/)?[a-z0-9-~][a-z0-9-._~]*$`)
+
+/*
+Validate the user's dependency manifest and lockfile and merge in the dependencies the runtime
+needs. Returns the files to add to the build context.
+*/
+func (rt *Runtime) DependencyFiles(manifest string, lockfile string) (map[string]string, error) {
+	if len(manifest) > MaxDependencyFileSize || len(lockfile) > MaxDependencyFileSize {
+		return nil, fmt.Errorf("dependency files must be smaller than %v bytes", MaxDependencyFileSize)
+	}
+	if rt.DependencyFile == "" {
+		if manifest != "" || lockfile != "" {
+			return nil, fmt.Errorf("runtime %v does not take a dependency manifest", rt.Name)
+		}
+		return map[string]string{}, nil
+	}
+	if lockfile != "" && rt.LockFile == "" {
+		return nil, fmt.Errorf("runtime %v does not take a lockfile", rt.Name)
+	}
+
+	var err error
+	switch rt.DependencyFormat {
+	case NpmFormat:
+		manifest, err = rt.mergeNpm(manifest, lockfile)
+	case PipFormat:
+		manifest, err = rt.mergePip(manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{rt.DependencyFile: manifest}
+	if lockfile != "" {
+		files[rt.LockFile] = lockfile
+	}
+	return files, nil
+}
+
+func (rt *Runtime) mergeNpm(manifest string, lockfile string) (string, error) {
+	pkg := map[string]interface{}{}
+	if strings.TrimSpace(manifest) != "" {
+		if err := json.Unmarshal([]byte(manifest), &pkg); err != nil {
+			return "", fmt.Errorf("invalid %v : %w", rt.DependencyFile, err)
+		}
+	}
+
+	dependencies := map[string]string{}
+	if raw, ok := pkg["dependencies"]; ok {
+		deps, ok := raw.(map[string]interface{})
+		if !ok {
+			return "", errors.New("dependencies must be an object")
+		}
+		for name, v := range deps {
+			version, ok := v.(string)
+			if !ok || version == "" {
+				return "", fmt.Errorf("invalid version for dependency %v", name)
+			}
+			if !npmPackageName.MatchString(name) {
+				return "", fmt.Errorf("invalid dependency name %v", name)
+			}
+			dependencies[name] = version
+		}
+	}
+
+	if lockfile != "" {
+		var lock map[string]interface{}
+		if err := json.Unmarshal([]byte(lockfile), &lock); err != nil {
+			return "", fmt.Errorf("invalid %v : %w", rt.LockFile, err)
+		}
+		if _, ok := lock["lockfileVersion"]; !ok {
+			return "", fmt.Errorf("invalid %v : lockfileVersion missing", rt.LockFile)
+		}
+		// the lockfile has to agree with the manifest, so required dependencies can't be added silently
+		for name := range rt.RequiredDependencies {
+			if _, ok := dependencies[name]; !ok {
+				return "", fmt.Errorf("%v must list %v when a lockfile is supplied", rt.DependencyFile, name)
+			}
+		}
+	}
+
+	// the user's version of a required dependency wins
+	for name, version := range rt.RequiredDependencies {
+		if _, ok := dependencies[name]; !ok {
+			dependencies[name] = version
+		}
+	}
+	pkg["dependencies"] = dependencies
+	if _, ok := pkg["name"]; !ok {
+		pkg["name"] = "user-code-worker"
+	}
+	if _, ok := pkg["version"]; !ok {
+		pkg["version"] = "1.0.0"
+	}
+	if _, ok := pkg["main"]; !ok {
+		pkg["main"] = rt.SourceFile
+	}
+
+	out, err := json.MarshalIndent(pkg, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out) + "\n", nil
+}
+
+func (rt *Runtime) mergePip(manifest string) (string, error) {
+	listed := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(manifest))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// only the manifest itself is in the build context
+		if strings.HasPrefix(line, "-r") || strings.HasPrefix(line, "-c") ||
+			strings.HasPrefix(line, "--requirement") || strings.HasPrefix(line, "--constraint") {
+			return "", fmt.Errorf("%v cannot reference other files", rt.DependencyFile)
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return strings.ContainsRune("=<>!~;[ @", r)
+		})
+		if len(fields) == 0 {
+			return "", fmt.Errorf("invalid requirement %v", line)
+		}
+		listed[strings.ToLower(fields[0])] = true
+	}
+
+	var required []string
+	for name := range rt.RequiredDependencies {
+		required = append(required, name)
+	}
+	sort.Strings(required)
+	for _, name := range required {
+		if !listed[strings.ToLower(name)] {
+			manifest = strings.TrimRight(manifest, "\n")
+			if manifest != "" {
+				manifest += "\n"
+			}
+			manifest += name + rt.RequiredDependencies[name] + "\n"
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,202 @@
+package runtimes
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var npmRuntime = &Runtime{
+	Name:                 "NODEJS",
+	SourceFile:           "index.js",
+	DependencyFile:       "package.json",
+	DependencyFormat:     NpmFormat,
+	LockFile:             "package-lock.json",
+	RequiredDependencies: map[string]string{"express": "^4.17.1"},
+}
+
+var pipRuntime = &Runtime{
+	Name:                 "PYTHON",
+	SourceFile:           "main.py",
+	DependencyFile:       "requirements.txt",
+	DependencyFormat:     PipFormat,
+	RequiredDependencies: map[string]string{"flask": "==2.2.2"},
+}
+
+func TestMergeNpm(t *testing.T) {
+	const lockfile = `{"name": "fn", "lockfileVersion": 2, "packages": {}}`
+	tests := []struct {
+		name         string
+		manifest     string
+		lockfile     string
+		dependencies map[string]string
+		fields       map[string]string
+		err          string
+	}{
+		{
+			name:         "no manifest",
+			dependencies: map[string]string{"express": "^4.17.1"},
+			fields:       map[string]string{"name": "user-code-worker", "version": "1.0.0", "main": "index.js"},
+		},
+		{
+			name:         "blank manifest",
+			manifest:     "  \n",
+			dependencies: map[string]string{"express": "^4.17.1"},
+		},
+		{
+			name:         "user dependencies are kept",
+			manifest:     `{"name": "hello", "dependencies": {"lodash": "^4.17.21", "@scope/pkg": "1.0.0"}}`,
+			dependencies: map[string]string{"lodash": "^4.17.21", "@scope/pkg": "1.0.0", "express": "^4.17.1"},
+			fields:       map[string]string{"name": "hello", "version": "1.0.0", "main": "index.js"},
+		},
+		{
+			name:         "user version of a required dependency wins",
+			manifest:     `{"dependencies": {"express": "4.18.2"}}`,
+			dependencies: map[string]string{"express": "4.18.2"},
+		},
+		{
+			name:         "lockfile with express listed",
+			manifest:     `{"dependencies": {"express": "^4.18.0"}}`,
+			lockfile:     lockfile,
+			dependencies: map[string]string{"express": "^4.18.0"},
+		},
+		{
+			name:     "lockfile without express listed",
+			manifest: `{"dependencies": {"lodash": "^4.17.21"}}`,
+			lockfile: lockfile,
+			err:      "package.json must list express when a lockfile is supplied",
+		},
+		{
+			name:     "lockfile without a version",
+			manifest: `{"dependencies": {"express": "^4.18.0"}}`,
+			lockfile: `{"name": "fn"}`,
+			err:      "lockfileVersion missing",
+		},
+		{name: "lockfile not json", manifest: `{}`, lockfile: "lockfileVersion: 2", err: "invalid package-lock.json"},
+		{name: "manifest not json", manifest: "express@4", err: "invalid package.json"},
+		{name: "dependencies not an object", manifest: `{"dependencies": ["express"]}`, err: "dependencies must be an object"},
+		{name: "version not a string", manifest: `{"dependencies": {"lodash": 4}}`, err: "invalid version for dependency lodash"},
+		{name: "empty version", manifest: `{"dependencies": {"lodash": ""}}`, err: "invalid version for dependency lodash"},
+		{name: "invalid name", manifest: `{"dependencies": {"../evil": "1.0.0"}}`, err: "invalid dependency name ../evil"},
+		{name: "upper case name", manifest: `{"dependencies": {"Lodash": "1.0.0"}}`, err: "invalid dependency name Lodash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := npmRuntime.DependencyFiles(tt.manifest, tt.lockfile)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("DependencyFiles() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DependencyFiles() error = %v", err)
+			}
+			var pkg struct {
+				Name         string            `json:"name"`
+				Version      string            `json:"version"`
+				Main         string            `json:"main"`
+				Dependencies map[string]string `json:"dependencies"`
+			}
+			if err := json.Unmarshal([]byte(files["package.json"]), &pkg); err != nil {
+				t.Fatalf("package.json is not json: %v", err)
+			}
+			if len(pkg.Dependencies) != len(tt.dependencies) {
+				t.Errorf("dependencies = %v, want %v", pkg.Dependencies, tt.dependencies)
+			}
+			for name, version := range tt.dependencies {
+				if pkg.Dependencies[name] != version {
+					t.Errorf("dependencies = %v, want %v", pkg.Dependencies, tt.dependencies)
+				}
+			}
+			got := map[string]string{"name": pkg.Name, "version": pkg.Version, "main": pkg.Main}
+			for field, want := range tt.fields {
+				if got[field] != want {
+					t.Errorf("%v = %q, want %q", field, got[field], want)
+				}
+			}
+			if lock, ok := files["package-lock.json"]; ok != (tt.lockfile != "") || lock != tt.lockfile {
+				t.Errorf("package-lock.json = %q, want %q", lock, tt.lockfile)
+			}
+		})
+	}
+}
+
+func TestMergePip(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     string
+		err      string
+	}{
+		{name: "no manifest", want: "flask==2.2.2\n"},
+		{name: "appended", manifest: "requests==2.28.1\n", want: "requests==2.28.1\nflask==2.2.2\n"},
+		{name: "appended without a trailing newline", manifest: "requests", want: "requests\nflask==2.2.2\n"},
+		{name: "listed pinned", manifest: "Flask==2.0.3\n", want: "Flask==2.0.3\n"},
+		{name: "listed with extras", manifest: "flask[async]>=2\n", want: "flask[async]>=2\n"},
+		{name: "listed with a marker", manifest: "flask; python_version >= '3.8'\n", want: "flask; python_version >= '3.8'\n"},
+		{name: "listed as a url", manifest: "flask @ https://example.com/flask.whl\n", want: "flask @ https://example.com/flask.whl\n"},
+		{
+			name:     "comments and blank lines",
+			manifest: "# web\n\nflask~=2.2\n",
+			want:     "# web\n\nflask~=2.2\n",
+		},
+		{name: "references a file", manifest: "-r base.txt\n", err: "cannot reference other files"},
+		{name: "references a constraint", manifest: "--constraint=c.txt\n", err: "cannot reference other files"},
+		{name: "only an operator", manifest: "==\n", err: "invalid requirement"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := pipRuntime.DependencyFiles(tt.manifest, "")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("DependencyFiles() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DependencyFiles() error = %v", err)
+			}
+			if got := files["requirements.txt"]; got != tt.want {
+				t.Errorf("requirements.txt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDependencyFiles(t *testing.T) {
+	golang := &Runtime{Name: "GOLANG", SourceFile: "handler.go"}
+	tests := []struct {
+		name     string
+		runtime  *Runtime
+		manifest string
+		lockfile string
+		files    int
+		err      string
+	}{
+		{name: "runtime without dependencies", runtime: golang},
+		{name: "manifest for a runtime without one", runtime: golang, manifest: "module x", err: "does not take a dependency manifest"},
+		{name: "lockfile for a runtime without one", runtime: pipRuntime, lockfile: "x", err: "does not take a lockfile"},
+		{name: "manifest too large", runtime: pipRuntime, manifest: strings.Repeat("a", MaxDependencyFileSize+1), err: "smaller than"},
+		{name: "lockfile too large", runtime: npmRuntime, lockfile: strings.Repeat("a", MaxDependencyFileSize+1), err: "smaller than"},
+		{name: "npm without a lockfile", runtime: npmRuntime, files: 1},
+		{name: "pip", runtime: pipRuntime, manifest: "requests\n", files: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := tt.runtime.DependencyFiles(tt.manifest, tt.lockfile)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("DependencyFiles() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DependencyFiles() error = %v", err)
+			}
+			if len(files) != tt.files {
+				t.Errorf("DependencyFiles() = %v, want %v files", files, tt.files)
+			}
+		})
+	}
+}
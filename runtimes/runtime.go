@@ -0,0 +1,225 @@
+package runtimes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+)
+
+// Array of runtimes
+type Runtimes []*Runtime
+
+// A runtime describes how to turn user code of one language into an image.
+type Runtime struct {
+	Name    constants.Language `json:"name"`
+	Version string             `json:"version"`
+	// file the user's code is written to
+	SourceFile string `json:"sourceFile"`
+	// file the user's dependency manifest is written to. empty if the runtime takes none
+	DependencyFile string `json:"dependencyFile,omitempty"`
+	// how the manifest is validated and merged. NpmFormat, PipFormat or empty to take it as is
+	DependencyFormat string `json:"dependencyFormat,omitempty"`
+	// file the user's lockfile is written to. empty if the runtime takes none
+	LockFile string `json:"lockFile,omitempty"`
+	// dependencies the runtime's scaffold needs. merged into the user's manifest
+	RequiredDependencies map[string]string `json:"requiredDependencies,omitempty"`
+	// port the function listens on. passed to the container as PORT
+	Port int32 `json:"port"`
+	// path the runtime's wrapper answers health checks on. probes check the port when empty
+	HealthPath string `json:"healthPath,omitempty"`
+	// build timeout in seconds. the server's default when 0
+	BuildTimeout int    `json:"buildTimeout,omitempty"`
+	Dockerfile   string `json:"-"`
+	// scaffold files added to the build context. path -> content
+	Files map[string]string `json:"-"`
+}
+
+type Registry struct {
+	mu       sync.RWMutex
+	runtimes map[constants.Language]*Runtime
+}
+
+// create a registry with the builtin runtimes registered
+func NewRegistry() *Registry {
+	r := &Registry{runtimes: map[constants.Language]*Runtime{}}
+	for _, rt := range builtin {
+		if err := r.Register(rt); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+func (rt *Runtime) validate() error {
+	if rt.Name == "" {
+		return errors.New("runtime name is required")
+	}
+	if rt.SourceFile == "" {
+		return fmt.Errorf("runtime %v: sourceFile is required", rt.Name)
+	}
+	if rt.Dockerfile == "" {
+		return fmt.Errorf("runtime %v: Dockerfile is required", rt.Name)
+	}
+	switch rt.DependencyFormat {
+	case "", NpmFormat, PipFormat:
+	default:
+		return fmt.Errorf("runtime %v: unknown dependencyFormat %v", rt.Name, rt.DependencyFormat)
+	}
+	if rt.LockFile != "" && rt.DependencyFile == "" {
+		return fmt.Errorf("runtime %v: lockFile requires a dependencyFile", rt.Name)
+	}
+	if rt.HealthPath != "" && !strings.HasPrefix(rt.HealthPath, "/") {
+		return fmt.Errorf("runtime %v: healthPath must start with /", rt.Name)
+	}
+	for path := range rt.Files {
+		if path == rt.SourceFile || path == rt.DependencyFile || path == rt.LockFile || path == "Dockerfile" {
+			return fmt.Errorf("runtime %v: scaffold file %v overlaps a generated file", rt.Name, path)
+		}
+	}
+	return nil
+}
+
+/*
+Images the runtime's Dockerfile builds from. Stages of the same Dockerfile, scratch and images
+named by build args are left out.
+*/
+func (rt *Runtime) BaseImages() []string {
+	var images []string
+	stages := map[string]bool{"scratch": true}
+	for _, line := range strings.Split(rt.Dockerfile, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		// skip flags like --platform
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		image := fields[0]
+		if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+			stages[strings.ToLower(fields[2])] = true
+		}
+		if stages[strings.ToLower(image)] || strings.Contains(image, "$") {
+			continue
+		}
+		images = append(images, image)
+	}
+	return images
+}
+
+// Register a runtime. Replaces any runtime registered with the same name.
+func (r *Registry) Register(rt *Runtime) error {
+	if rt.Port == 0 {
+		rt.Port = 4000
+	}
+	if err := rt.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runtimes[rt.Name] = rt
+	return nil
+}
+
+func (r *Registry) Get(name constants.Language) (*Runtime, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rt, ok := r.runtimes[name]
+	return rt, ok
+}
+
+// all registered runtimes sorted by name
+func (r *Registry) List() Runtimes {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make(Runtimes, 0, len(r.runtimes))
+	for _, rt := range r.runtimes {
+		list = append(list, rt)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+/*
+Register every runtime found in dir. Each subdirectory is one runtime:
+
+	<dir>/<runtime>/runtime.json  name, version, sourceFile, dependencyFile, dependencyFormat,
+	                              lockFile, requiredDependencies, port, healthPath, buildTimeout
+	<dir>/<runtime>/Dockerfile
+	<dir>/<runtime>/...           any other file is added to the build context as is
+*/
+func (r *Registry) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		rt, err := loadRuntime(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := r.Register(rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadRuntime(dir string) (*Runtime, error) {
+	var rt Runtime
+	manifest, err := os.ReadFile(filepath.Join(dir, "runtime.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(manifest, &rt); err != nil {
+		return nil, fmt.Errorf("%v: %w", dir, err)
+	}
+	rt.Files = map[string]string{}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		switch rel {
+		case "runtime.json":
+		case "Dockerfile":
+			rt.Dockerfile = string(content)
+		default:
+			rt.Files[filepath.ToSlash(rel)] = string(content)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+func (r *Runtimes) ToJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	return e.Encode(r)
+}
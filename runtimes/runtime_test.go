@@ -0,0 +1,175 @@
+package runtimes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+)
+
+func TestRegister(t *testing.T) {
+	valid := func() *Runtime {
+		return &Runtime{
+			Name:           "RUBY",
+			SourceFile:     "handler.rb",
+			DependencyFile: "Gemfile",
+			Dockerfile:     "FROM ruby:3.1\n",
+			Files:          map[string]string{"server.rb": "require 'webrick'"},
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(rt *Runtime)
+		err    string
+	}{
+		{name: "valid", change: func(rt *Runtime) {}},
+		{name: "no name", change: func(rt *Runtime) { rt.Name = "" }, err: "name is required"},
+		{name: "no source file", change: func(rt *Runtime) { rt.SourceFile = "" }, err: "sourceFile is required"},
+		{name: "no Dockerfile", change: func(rt *Runtime) { rt.Dockerfile = "" }, err: "Dockerfile is required"},
+		{
+			name:   "scaffold over the source file",
+			change: func(rt *Runtime) { rt.Files["handler.rb"] = "" },
+			err:    "overlaps a generated file",
+		},
+		{
+			name:   "scaffold over the dependency file",
+			change: func(rt *Runtime) { rt.Files["Gemfile"] = "" },
+			err:    "overlaps a generated file",
+		},
+		{
+			name:   "scaffold over the Dockerfile",
+			change: func(rt *Runtime) { rt.Files["Dockerfile"] = "FROM scratch" },
+			err:    "overlaps a generated file",
+		},
+		{
+			name:   "scaffold over the lockfile",
+			change: func(rt *Runtime) { rt.LockFile = "Gemfile.lock"; rt.Files["Gemfile.lock"] = "" },
+			err:    "overlaps a generated file",
+		},
+		{
+			name:   "unknown dependency format",
+			change: func(rt *Runtime) { rt.DependencyFormat = "bundler" },
+			err:    "unknown dependencyFormat bundler",
+		},
+		{
+			name:   "lockfile without a dependency file",
+			change: func(rt *Runtime) { rt.DependencyFile = ""; rt.LockFile = "Gemfile.lock" },
+			err:    "lockFile requires a dependencyFile",
+		},
+		{
+			name:   "relative health path",
+			change: func(rt *Runtime) { rt.HealthPath = "healthz" },
+			err:    "healthPath must start with /",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Registry{runtimes: map[constants.Language]*Runtime{}}
+			rt := valid()
+			tt.change(rt)
+			err := r.Register(rt)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Register() error = %v, want %q", err, tt.err)
+				}
+				if _, ok := r.Get(rt.Name); ok {
+					t.Error("Register() kept an invalid runtime")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Register() error = %v", err)
+			}
+			got, ok := r.Get(rt.Name)
+			if !ok || got != rt {
+				t.Fatalf("Get() = %v, %v, want the registered runtime", got, ok)
+			}
+			if got.Port != 4000 {
+				t.Errorf("Port = %v, want the default 4000", got.Port)
+			}
+		})
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	r := NewRegistry()
+	list := r.List()
+	if len(list) != len(builtin) {
+		t.Fatalf("List() has %v runtimes, want %v", len(list), len(builtin))
+	}
+	for i := 1; i < len(list); i++ {
+		if list[i-1].Name >= list[i].Name {
+			t.Errorf("List() is not sorted: %v before %v", list[i-1].Name, list[i].Name)
+		}
+	}
+	for _, name := range []constants.Language{constants.NODEJS, constants.GOLANG, constants.PYTHON} {
+		if _, ok := r.Get(name); !ok {
+			t.Errorf("Get(%v) = false, want the builtin runtime", name)
+		}
+	}
+
+	// a runtime registered under a builtin name replaces it
+	custom := &Runtime{Name: constants.NODEJS, SourceFile: "main.js", Dockerfile: "FROM node:18\n"}
+	if err := r.Register(custom); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := r.Get(constants.NODEJS); got != custom {
+		t.Errorf("Get(%v) = %+v, want the replacement", constants.NODEJS, got)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ruby/runtime.json", `{"name": "RUBY", "version": "3.1", "sourceFile": "handler.rb", "port": 8080}`)
+	write("ruby/Dockerfile", "FROM ruby:3.1\n")
+	write("ruby/server.rb", "require 'webrick'")
+	write("ruby/lib/helpers.rb", "module Helpers; end")
+	// files next to the runtime directories are ignored
+	write("README.md", "runtimes")
+
+	r := &Registry{runtimes: map[constants.Language]*Runtime{}}
+	if err := r.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	rt, ok := r.Get("RUBY")
+	if !ok {
+		t.Fatal("Get(RUBY) = false after LoadDir()")
+	}
+	if rt.Version != "3.1" || rt.SourceFile != "handler.rb" || rt.Port != 8080 {
+		t.Errorf("runtime = %+v", rt)
+	}
+	if rt.Dockerfile != "FROM ruby:3.1\n" {
+		t.Errorf("Dockerfile = %q", rt.Dockerfile)
+	}
+	want := map[string]string{"server.rb": "require 'webrick'", "lib/helpers.rb": "module Helpers; end"}
+	if len(rt.Files) != len(want) {
+		t.Errorf("Files = %v, want %v", rt.Files, want)
+	}
+	for name, content := range want {
+		if rt.Files[name] != content {
+			t.Errorf("Files[%v] = %q, want %q", name, rt.Files[name], content)
+		}
+	}
+
+	broken := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(broken, "bad"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(broken, "bad", "runtime.json"), []byte(`{"name": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.LoadDir(broken); err == nil {
+		t.Error("LoadDir() with an invalid runtime.json, want an error")
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Encryption of secret values stored in Postgres. Values are sealed with AES-256-GCM under the
+key in SECRETS_KEY and bound to what they belong to, so a ciphertext copied to another row
+doesn't decrypt.
+*/
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// returned when secrets are used without SECRETS_KEY set
+var ErrNoKey = errors.New("SECRETS_KEY is not set")
+
+// Seals and opens values with one key. Ciphertexts are the nonce followed by the sealed value
+type Box struct {
+	aead cipher.AEAD
+}
+
+// A box for a 32 byte key
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secrets key must be 32 bytes, got %v", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// A box for the base64 encoded key in SECRETS_KEY. nil without an error if it isn't set
+func BoxFromEnv() (*Box, error) {
+	encoded := os.Getenv("SECRETS_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("SECRETS_KEY: %w", err)
+	}
+	return NewBox(key)
+}
+
+// Encrypt plaintext. associated is authenticated but not stored; Open needs the same
+func (b *Box) Seal(plaintext []byte, associated []byte) ([]byte, error) {
+	if b == nil {
+		return nil, ErrNoKey
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, plaintext, associated), nil
+}
+
+// Decrypt a ciphertext from Seal
+func (b *Box) Open(ciphertext []byte, associated []byte) ([]byte, error) {
+	if b == nil {
+		return nil, ErrNoKey
+	}
+	size := b.aead.NonceSize()
+	if len(ciphertext) < size {
+		return nil, errors.New("ciphertext too short")
+	}
+	return b.aead.Open(nil, ciphertext[:size], ciphertext[size:], associated)
+}
@@ -0,0 +1,122 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestNewBox(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{name: "32 bytes", size: 32},
+		{name: "empty", size: 0, wantErr: true},
+		{name: "16 bytes", size: 16, wantErr: true},
+		{name: "64 bytes", size: 64, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			box, err := NewBox(make([]byte, tt.size))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewBox() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && box == nil {
+				t.Error("NewBox() = nil")
+			}
+		})
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	box, err := NewBox(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewBox(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := box.Seal([]byte("s3cret"), []byte("fn/TOKEN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same plaintext seals differently every time
+	again, err := box.Seal([]byte("s3cret"), []byte("fn/TOKEN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Error("Seal() reused a nonce")
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name       string
+		box        *Box
+		ciphertext []byte
+		associated string
+		want       string
+		wantErr    bool
+	}{
+		{name: "same key and associated data", box: box, ciphertext: sealed, associated: "fn/TOKEN", want: "s3cret"},
+		{name: "other row", box: box, ciphertext: sealed, associated: "fn/OTHER", wantErr: true},
+		{name: "other key", box: other, ciphertext: sealed, associated: "fn/TOKEN", wantErr: true},
+		{name: "tampered", box: box, ciphertext: tampered, associated: "fn/TOKEN", wantErr: true},
+		{name: "too short", box: box, ciphertext: sealed[:4], associated: "fn/TOKEN", wantErr: true},
+		{name: "empty", box: box, associated: "fn/TOKEN", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.box.Open(tt.ciphertext, []byte(tt.associated))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Open() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNilBox(t *testing.T) {
+	var box *Box
+	if _, err := box.Seal([]byte("value"), nil); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Seal() error = %v, want %v", err, ErrNoKey)
+	}
+	if _, err := box.Open([]byte("value"), nil); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Open() error = %v, want %v", err, ErrNoKey)
+	}
+}
+
+func TestBoxFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		box     bool
+		wantErr bool
+	}{
+		{name: "not set"},
+		{name: "32 bytes", key: base64.StdEncoding.EncodeToString(make([]byte, 32)), box: true},
+		{name: "not base64", key: "not a key!", wantErr: true},
+		{name: "too short", key: base64.StdEncoding.EncodeToString(make([]byte, 16)), wantErr: true},
+	}
+	defer os.Unsetenv("SECRETS_KEY")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("SECRETS_KEY", tt.key)
+			box, err := BoxFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BoxFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (box != nil) != tt.box {
+				t.Errorf("BoxFromEnv() = %v, want a box %v", box, tt.box)
+			}
+		})
+	}
+}
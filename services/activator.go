@@ -0,0 +1,315 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/utils"
+	"gorm.io/gorm"
+)
+
+var (
+	// too many requests are already waiting for the function to start
+	ErrColdStartQueueFull = errors.New("too many requests waiting for the function to start")
+	// the function had no ready pod within the cold start timeout
+	ErrColdStartTimeout = errors.New("function did not start in time")
+)
+
+// how often idle functions are looked for
+const idleCheckInterval = 30 * time.Second
+
+// how often a cold start checks for a ready pod
+const coldStartPollInterval = 250 * time.Millisecond
+
+/*
+Scales idle functions to zero and back up when a request comes in. Requests to a function that
+is scaled down wait in a bounded queue until one of its pods is ready.
+
+Activity is kept in memory. It is seeded with the time the server starts, so after a restart
+functions count as active for one idle window instead of looking idle since forever.
+*/
+type Activator struct {
+	db        *gorm.DB
+	l         *log.Logger
+	kw        *kuberneteswrapper.KubernetesWrapper
+	functions *FunctionService
+	// idle window of functions that don't set their own. 0 never scales to zero
+	idleAfter        time.Duration
+	coldStartTimeout time.Duration
+	// requests that can wait for one function to start
+	queueSize int
+
+	mu       sync.Mutex
+	activity map[string]*functionActivity
+}
+
+type functionActivity struct {
+	lastRequest time.Time
+	inflight    int
+	waiting     int
+	// a pod was ready and the function hasn't been scaled down since
+	ready bool
+	// scaled to zero and not started since
+	zero bool
+	// the running cold start. nil when there is none
+	starting *coldStart
+	// held while scaling, so a scale down and a cold start never overlap
+	scaling sync.Mutex
+}
+
+// no request is running or starting the function and the last one was longer than window ago
+func (activity *functionActivity) idleFor(window time.Duration, now time.Time) bool {
+	return activity.inflight == 0 && activity.starting == nil && now.Sub(activity.lastRequest) > window
+}
+
+type coldStart struct {
+	done chan struct{}
+	err  error
+}
+
+func NewActivator(
+	db *gorm.DB,
+	l *log.Logger,
+	kw *kuberneteswrapper.KubernetesWrapper,
+	fs *FunctionService,
+	idleAfter time.Duration,
+	coldStartTimeout time.Duration,
+	queueSize int,
+) *Activator {
+	return &Activator{
+		db:               db,
+		l:                l,
+		kw:               kw,
+		functions:        fs,
+		idleAfter:        idleAfter,
+		coldStartTimeout: coldStartTimeout,
+		queueSize:        queueSize,
+		activity:         map[string]*functionActivity{},
+	}
+}
+
+// activity of a function. a.mu must be held
+func (a *Activator) activityOf(functionId string) *functionActivity {
+	activity, ok := a.activity[functionId]
+	if !ok {
+		activity = &functionActivity{lastRequest: time.Now()}
+		a.activity[functionId] = activity
+	}
+	return activity
+}
+
+/*
+Record a request to the function and wait until it has a ready pod, starting it if it is scaled
+to zero. The function isn't scaled down until release is called. Returns ErrColdStartQueueFull
+if too many requests are already waiting and ErrColdStartTimeout if it didn't start in time.
+*/
+func (a *Activator) Acquire(ctx context.Context, function *models.Function) (func(), error) {
+	functionId := function.ID.String()
+	a.mu.Lock()
+	activity := a.activityOf(functionId)
+	activity.lastRequest = time.Now()
+	activity.inflight++
+	release := func() {
+		a.mu.Lock()
+		activity.inflight--
+		activity.lastRequest = time.Now()
+		a.mu.Unlock()
+	}
+	if activity.ready {
+		a.mu.Unlock()
+		return release, nil
+	}
+
+	if activity.waiting >= a.queueSize {
+		activity.inflight--
+		a.mu.Unlock()
+		return nil, ErrColdStartQueueFull
+	}
+	start := activity.starting
+	if start == nil {
+		start = &coldStart{done: make(chan struct{})}
+		activity.starting = start
+		go a.coldStart(function, activity, start)
+	}
+	activity.waiting++
+	a.mu.Unlock()
+
+	select {
+	case <-start.done:
+	case <-ctx.Done():
+	}
+	a.mu.Lock()
+	activity.waiting--
+	a.mu.Unlock()
+
+	err := ctx.Err()
+	if err == nil {
+		err = start.err
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// scale the function up if it is at zero and wait for a ready pod
+func (a *Activator) coldStart(function *models.Function, activity *functionActivity, start *coldStart) {
+	activity.scaling.Lock()
+	defer activity.scaling.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.coldStartTimeout)
+	defer cancel()
+	began := time.Now()
+	err := a.scaleUp(ctx, function)
+	if err != nil {
+		a.l.Print("Cold start of function ", function.ID, " failed : ", err)
+	} else if elapsed := time.Since(began); elapsed > time.Second {
+		a.l.Print("Cold started function ", function.ID, " in ", elapsed.Round(time.Millisecond))
+	}
+
+	a.mu.Lock()
+	activity.ready = err == nil
+	activity.zero = false
+	activity.starting = nil
+	start.err = err
+	close(start.done)
+	a.mu.Unlock()
+}
+
+func (a *Activator) scaleUp(ctx context.Context, function *models.Function) error {
+	functionId := function.ID.String()
+	replicas, err := a.kw.GetDeploymentReplicas(ctx, constants.Namespace, functionId)
+	if err != nil {
+		return err
+	}
+	if replicas == 0 {
+		resources, err := a.functions.Resources(function)
+		if err != nil {
+			return err
+		}
+		if err := a.kw.ScaleDeployment(ctx, constants.Namespace, functionId, resources.MinReplicas); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(coldStartPollInterval)
+	defer ticker.Stop()
+	for {
+		ready, err := a.kw.ReadyEndpoints(ctx, constants.Namespace, utils.BuildServiceName(functionId))
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if ready > 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ErrColdStartTimeout
+		case <-ticker.C:
+		}
+	}
+}
+
+// how long the function may be idle before it is scaled to zero. 0 if it never is
+func (a *Activator) idleWindow(function *models.Function) time.Duration {
+	if function.IdleTimeout < 0 {
+		return 0
+	}
+	if function.IdleTimeout > 0 {
+		return time.Duration(function.IdleTimeout) * time.Second
+	}
+	return a.idleAfter
+}
+
+// Scale idle functions to zero until ctx is done
+func (a *Activator) Start(ctx context.Context) {
+	a.seedActivity()
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.scaleIdle(ctx)
+		}
+	}
+}
+
+// count every deployed function as last requested now
+func (a *Activator) seedActivity() {
+	var functions models.Functions
+	err := a.db.Where("deploy_status = ?", string(constants.Deployed)).Find(&functions).Error
+	if err != nil {
+		a.l.Print("Cannot list functions to seed activity : ", err)
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, function := range functions {
+		a.activityOf(function.ID.String()).lastRequest = now
+	}
+}
+
+// scale every deployed function that had no request within its idle window to zero
+func (a *Activator) scaleIdle(ctx context.Context) {
+	var functions models.Functions
+	err := a.db.Where("deploy_status = ?", string(constants.Deployed)).Find(&functions).Error
+	if err != nil {
+		a.l.Print("Cannot list functions to scale down : ", err)
+		return
+	}
+	for _, function := range functions {
+		window := a.idleWindow(function)
+		if window == 0 {
+			continue
+		}
+		a.mu.Lock()
+		activity := a.activityOf(function.ID.String())
+		idle := !activity.zero && activity.idleFor(window, time.Now())
+		a.mu.Unlock()
+		if idle {
+			a.scaleDown(ctx, function, activity, window)
+		}
+	}
+}
+
+func (a *Activator) scaleDown(
+	ctx context.Context,
+	function *models.Function,
+	activity *functionActivity,
+	window time.Duration,
+) {
+	activity.scaling.Lock()
+	defer activity.scaling.Unlock()
+
+	// a request may have come in while waiting for the lock
+	a.mu.Lock()
+	if !activity.idleFor(window, time.Now()) {
+		a.mu.Unlock()
+		return
+	}
+	wasReady := activity.ready
+	activity.ready = false
+	a.mu.Unlock()
+
+	err := a.kw.ScaleDeployment(ctx, constants.Namespace, function.ID.String(), 0)
+	if err != nil {
+		a.l.Print("Cannot scale function ", function.ID, " to zero : ", err)
+		return
+	}
+	a.mu.Lock()
+	activity.zero = true
+	a.mu.Unlock()
+	if wasReady {
+		a.l.Print("Scaled function ", function.ID, " to zero after ", window, " without requests")
+	}
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/google/uuid"
+)
+
+func TestIdleWindow(t *testing.T) {
+	tests := []struct {
+		name        string
+		idleAfter   time.Duration
+		idleTimeout int
+		want        time.Duration
+	}{
+		{name: "server default", idleAfter: 15 * time.Minute, want: 15 * time.Minute},
+		{name: "scale to zero off", want: 0},
+		{name: "own timeout", idleAfter: 15 * time.Minute, idleTimeout: 60, want: time.Minute},
+		{name: "own timeout with scale to zero off", idleTimeout: 60, want: time.Minute},
+		{name: "never", idleAfter: 15 * time.Minute, idleTimeout: -1, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Activator{idleAfter: tt.idleAfter}
+			got := a.idleWindow(&models.Function{IdleTimeout: tt.idleTimeout})
+			if got != tt.want {
+				t.Errorf("idleWindow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdleFor(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		activity *functionActivity
+		want     bool
+	}{
+		{name: "idle", activity: &functionActivity{lastRequest: now.Add(-2 * time.Minute)}, want: true},
+		{name: "recent request", activity: &functionActivity{lastRequest: now.Add(-30 * time.Second)}},
+		{name: "exactly the window", activity: &functionActivity{lastRequest: now.Add(-time.Minute)}},
+		{name: "request running", activity: &functionActivity{lastRequest: now.Add(-2 * time.Minute), inflight: 1}},
+		{
+			name:     "starting",
+			activity: &functionActivity{lastRequest: now.Add(-2 * time.Minute), starting: &coldStart{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.activity.idleFor(time.Minute, now); got != tt.want {
+				t.Errorf("idleFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Acquire without a cold start of its own: the function is ready, the queue is full or another
+// request is already starting it
+func TestAcquire(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	failed := &coldStart{done: make(chan struct{}), err: ErrColdStartTimeout}
+	close(failed.done)
+	started := &coldStart{done: make(chan struct{})}
+	close(started.done)
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		activity *functionActivity
+		err      error
+	}{
+		{name: "ready", ctx: context.Background(), activity: &functionActivity{ready: true}},
+		{
+			name:     "queue full",
+			ctx:      context.Background(),
+			activity: &functionActivity{waiting: 2, starting: &coldStart{done: make(chan struct{})}},
+			err:      ErrColdStartQueueFull,
+		},
+		{name: "started by another request", ctx: context.Background(), activity: &functionActivity{starting: started}},
+		{
+			name:     "start failed",
+			ctx:      context.Background(),
+			activity: &functionActivity{starting: failed},
+			err:      ErrColdStartTimeout,
+		},
+		{
+			name:     "request cancelled while waiting",
+			ctx:      cancelled,
+			activity: &functionActivity{starting: &coldStart{done: make(chan struct{})}},
+			err:      context.Canceled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			function := &models.Function{ID: uuid.New()}
+			before := time.Now()
+			activity := tt.activity
+			waiting := activity.waiting
+			a := NewActivator(nil, log.New(os.Stderr, "", 0), nil, nil, time.Minute, time.Second, 2)
+			a.activity[function.ID.String()] = activity
+
+			release, err := a.Acquire(tt.ctx, function)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Acquire() error = %v, want %v", err, tt.err)
+			}
+			if activity.lastRequest.Before(before) {
+				t.Error("Acquire() did not record the request")
+			}
+			if err != nil {
+				if release != nil || activity.inflight != 0 || activity.waiting != waiting {
+					t.Errorf("Acquire() failed with inflight %v waiting %v", activity.inflight, activity.waiting)
+				}
+				return
+			}
+			if activity.inflight != 1 {
+				t.Errorf("Acquire() inflight = %v, want 1", activity.inflight)
+			}
+			release()
+			if activity.inflight != 0 {
+				t.Errorf("release() inflight = %v, want 0", activity.inflight)
+			}
+		})
+	}
+}
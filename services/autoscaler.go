@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"gorm.io/gorm"
+)
+
+// how long scaling down waits for the load to stay low, like the hpa's stabilization window
+const scaleDownStabilization = 2 * time.Minute
+
+/*
+Builtin scaler for functions that scale on requests without prometheus. Every interval it sets
+the replicas of each such function from the concurrency or requests per second measured at the
+proxy. Scaling up is immediate; scaling down uses the highest recommendation of the last
+couple of minutes so short dips don't churn pods. Functions at zero are left to the activator.
+*/
+type Autoscaler struct {
+	db        *gorm.DB
+	l         *log.Logger
+	kw        *kuberneteswrapper.KubernetesWrapper
+	functions *FunctionService
+	metrics   *RequestMetrics
+
+	// only used by the loop
+	samples         map[string]requestSample
+	recommendations map[string][]recommendation
+}
+
+type recommendation struct {
+	at       time.Time
+	replicas int32
+}
+
+func NewAutoscaler(
+	db *gorm.DB,
+	l *log.Logger,
+	kw *kuberneteswrapper.KubernetesWrapper,
+	fs *FunctionService,
+	metrics *RequestMetrics,
+) *Autoscaler {
+	return &Autoscaler{
+		db:              db,
+		l:               l,
+		kw:              kw,
+		functions:       fs,
+		metrics:         metrics,
+		samples:         map[string]requestSample{},
+		recommendations: map[string][]recommendation{},
+	}
+}
+
+// Scale functions every interval until ctx is done
+func (a *Autoscaler) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.scaleAll(ctx)
+		}
+	}
+}
+
+func (a *Autoscaler) scaleAll(ctx context.Context) {
+	var functions models.Functions
+	err := a.db.Where("deploy_status = ? AND scaler = ?", string(constants.Deployed), string(constants.BuiltinScaler)).
+		Find(&functions).Error
+	if err != nil {
+		a.l.Print("Cannot list functions to scale : ", err)
+		return
+	}
+	seen := map[string]bool{}
+	for _, function := range functions {
+		seen[function.ID.String()] = true
+		if err := a.scale(ctx, function); err != nil {
+			a.l.Print("Cannot scale function ", function.ID, " : ", err)
+		}
+	}
+	// forget functions that are gone or scaled otherwise
+	for functionId := range a.samples {
+		if !seen[functionId] {
+			delete(a.samples, functionId)
+			delete(a.recommendations, functionId)
+		}
+	}
+}
+
+func (a *Autoscaler) scale(ctx context.Context, function *models.Function) error {
+	functionId := function.ID.String()
+	rps, concurrency, sample := a.metrics.since(functionId, a.samples[functionId])
+	_, measured := a.samples[functionId]
+	a.samples[functionId] = sample
+	if !measured {
+		return nil
+	}
+
+	resources, err := a.functions.Resources(function)
+	if err != nil {
+		return err
+	}
+	current, err := a.kw.GetDeploymentReplicas(ctx, constants.Namespace, functionId)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		delete(a.recommendations, functionId)
+		return nil
+	}
+
+	value := concurrency
+	if resources.Metric == constants.RPSMetric {
+		value = rps
+	}
+	desired := a.stabilize(functionId, desiredReplicas(value, resources), current, time.Now())
+	if desired == current {
+		return nil
+	}
+	if err := a.kw.ScaleDeployment(ctx, constants.Namespace, functionId, desired); err != nil {
+		return err
+	}
+	a.l.Printf("Scaled function %v from %v to %v replicas at %.2f %v", functionId, current, desired, value, resources.Metric)
+	return nil
+}
+
+/*
+Record the recommendation and return the replicas to scale to. Scaling up follows the load right
+away, scaling down only goes to the highest recommendation within the stabilization window.
+*/
+func (a *Autoscaler) stabilize(functionId string, desired int32, current int32, now time.Time) int32 {
+	recent := []recommendation{{at: now, replicas: desired}}
+	highest := desired
+	for _, r := range a.recommendations[functionId] {
+		if now.Sub(r.at) < scaleDownStabilization {
+			recent = append(recent, r)
+			if r.replicas > highest {
+				highest = r.replicas
+			}
+		}
+	}
+	a.recommendations[functionId] = recent
+	if desired < current {
+		desired = highest
+		if desired > current {
+			desired = current
+		}
+	}
+	return desired
+}
+
+// replicas that keep the per pod value at the target, within the function's bounds
+func desiredReplicas(value float64, resources *FunctionResources) int32 {
+	replicas := int32(math.Ceil(value / float64(resources.Target)))
+	if replicas < resources.MinReplicas {
+		replicas = resources.MinReplicas
+	}
+	if replicas > resources.MaxReplicas {
+		replicas = resources.MaxReplicas
+	}
+	return replicas
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDesiredReplicas(t *testing.T) {
+	resources := &FunctionResources{MinReplicas: 1, MaxReplicas: 10, Target: 5}
+	tests := []struct {
+		name  string
+		value float64
+		want  int32
+	}{
+		{name: "no load", value: 0, want: 1},
+		{name: "below target", value: 3, want: 1},
+		{name: "at target", value: 5, want: 1},
+		{name: "just above target", value: 5.1, want: 2},
+		{name: "multiple of target", value: 20, want: 4},
+		{name: "above max", value: 500, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := desiredReplicas(tt.value, resources); got != tt.want {
+				t.Errorf("desiredReplicas(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+	if got := desiredReplicas(0, &FunctionResources{MinReplicas: 3, MaxReplicas: 5, Target: 1}); got != 3 {
+		t.Errorf("desiredReplicas() = %v, want the minimum 3", got)
+	}
+}
+
+func TestStabilize(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		history []recommendation
+		desired int32
+		current int32
+		want    int32
+	}{
+		{name: "scale up right away", history: []recommendation{{now.Add(-time.Minute), 2}}, desired: 6, current: 2, want: 6},
+		{name: "steady", desired: 3, current: 3, want: 3},
+		{name: "scale down without history", desired: 1, current: 4, want: 1},
+		{
+			name:    "scale down to the highest recent recommendation",
+			history: []recommendation{{now.Add(-time.Minute), 3}, {now.Add(-30 * time.Second), 2}},
+			desired: 1,
+			current: 4,
+			want:    3,
+		},
+		{
+			name:    "recent recommendation above the current replicas",
+			history: []recommendation{{now.Add(-time.Minute), 8}},
+			desired: 1,
+			current: 4,
+			want:    4,
+		},
+		{
+			name:    "old recommendations are ignored",
+			history: []recommendation{{now.Add(-scaleDownStabilization), 4}, {now.Add(-10 * time.Minute), 6}},
+			desired: 1,
+			current: 4,
+			want:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Autoscaler{recommendations: map[string][]recommendation{"fn": tt.history}}
+			if got := a.stabilize("fn", tt.desired, tt.current, now); got != tt.want {
+				t.Errorf("stabilize() = %v, want %v", got, tt.want)
+			}
+			recent := a.recommendations["fn"]
+			if len(recent) == 0 || recent[0].replicas != tt.desired || !recent[0].at.Equal(now) {
+				t.Errorf("stabilize() did not record %v replicas", tt.desired)
+			}
+			for _, r := range recent {
+				if now.Sub(r.at) >= scaleDownStabilization {
+					t.Errorf("stabilize() kept a recommendation from %v ago", now.Sub(r.at))
+				}
+			}
+		})
+	}
+}
+
+func TestSince(t *testing.T) {
+	now := time.Now()
+	// 20 requests and 10 request seconds within the last 10 seconds, none in flight
+	m := &RequestMetrics{functions: map[string]*requestStats{
+		"fn": {requests: 30, busy: 15, changed: now},
+	}}
+	tests := []struct {
+		name        string
+		functionId  string
+		last        requestSample
+		rps         float64
+		concurrency float64
+	}{
+		{name: "first sample", functionId: "fn"},
+		{
+			name:        "since the last sample",
+			functionId:  "fn",
+			last:        requestSample{at: now.Add(-10 * time.Second), requests: 10, busy: 5},
+			rps:         2,
+			concurrency: 1,
+		},
+		{name: "no requests", functionId: "other", last: requestSample{at: now.Add(-10 * time.Second)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rps, concurrency, sample := m.since(tt.functionId, tt.last)
+			// the sample is taken a little after now
+			if math.Abs(rps-tt.rps) > 0.01 || math.Abs(concurrency-tt.concurrency) > 0.01 {
+				t.Errorf("since() = %v rps %v concurrency, want %v rps %v concurrency", rps, concurrency, tt.rps, tt.concurrency)
+			}
+			if sample.at.Before(now) {
+				t.Errorf("since() sample at %v, before %v", sample.at, now)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/registry"
+	"github.com/Cloudbase-Project/serverless/runtimes"
+	"github.com/Cloudbase-Project/serverless/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// lines of build log kept on the build and the function
+const buildLogTailLines = 100
+
+/*
+Run a build taken off the build queue. Starts the build on builder, waits for it and records the
+outcome on the build and the function. A build that is already running (the server restarted
+while it was running) is watched instead of started again.
+
+Every line the builder logs is passed to onLog as it comes in. The tail of the log is kept on the
+build and the function.
+
+The build is stopped and its builder removed when ctx is cancelled (Cancelled) or when it runs
+longer than its timeout (TimedOut). The timeout is the project's, else the runtime's, else
+defaultTimeout. It counts from when the build started, across restarts.
+*/
+func (fs *FunctionService) RunBuild(
+	ctx context.Context,
+	builder ImageBuilder,
+	rs *runtimes.Registry,
+	regs *registry.Registries,
+	cache *BuildCache,
+	defaultTimeout time.Duration,
+	build *models.Build,
+	onLog func(line string),
+) *models.Build {
+	var function models.Function
+	if err := fs.db.First(&function, "id = ?", build.FunctionID).Error; err != nil {
+		return fs.finishBuild(build, nil, nil, WatchResult{Status: string(constants.BuildFailed), Reason: err.Error()})
+	}
+	revision, err := fs.revisionForBuild(&function, build)
+	if err != nil {
+		return fs.finishBuild(build, &function, nil, WatchResult{Status: string(constants.BuildFailed), Reason: err.Error()})
+	}
+
+	runtime, ok := rs.Get(constants.Language(revision.Language))
+	if !ok {
+		return fs.finishBuild(build, &function, revision, WatchResult{
+			Status: string(constants.BuildFailed),
+			Reason: "Unsupported language : " + revision.Language,
+		})
+	}
+	// build what was submitted, not what the function looks like now
+	source, err := fs.GetBuildSource(revisionSource(&function, revision), runtime)
+	if err != nil {
+		return fs.finishBuild(build, &function, revision, WatchResult{Status: string(constants.BuildFailed), Reason: err.Error()})
+	}
+	// the host is checked again now, and pinned, in case its name points somewhere else since it was set
+	if source.Git != nil {
+		source.Git.Resolve, err = utils.PinGitHost(ctx, source.Git.URL)
+		if err != nil {
+			return fs.finishBuild(build, &function, revision, WatchResult{Status: string(constants.BuildFailed), Reason: err.Error()})
+		}
+	}
+
+	registryConfig, projectId, err := fs.registryFor(regs, &function)
+	if err != nil {
+		return fs.finishBuild(build, &function, revision, WatchResult{Status: string(constants.BuildFailed), Reason: err.Error()})
+	}
+
+	timeout := fs.buildTimeout(&function, runtime, defaultTimeout)
+	startedAt := time.Now()
+	if build.StartedAt != nil {
+		startedAt = *build.StartedAt
+	}
+	buildContext, stopBuild := context.WithDeadline(ctx, startedAt.Add(timeout))
+	defer stopBuild()
+
+	function.BuildStatus = string(constants.Building)
+	fs.SaveFunction(&function)
+
+	buildId := build.ID.String()
+	revision.Image = registryConfig.ImageRepository(projectId, function.ID.String()) +
+		":" + registryConfig.ImageTag(revision.Number, buildId)
+	revision.BuildStatus = string(constants.Building)
+	revision.HealthPath = runtime.HealthPath
+	fs.db.Save(revision)
+
+	spec := &BuildSpec{
+		FunctionId:      function.ID.String(),
+		BuildId:         buildId,
+		Runtime:         runtime,
+		Image:           revision.Image,
+		Registry:        registryConfig,
+		CacheRepository: registryConfig.ImageCacheRepository(projectId, revision.Language),
+		Cache:           cache,
+		Source:          source,
+	}
+	if err := builder.Start(buildContext, spec); err != nil {
+		result, stopped := stoppedBuild(buildContext, timeout)
+		if !stopped {
+			result = WatchResult{Status: string(constants.BuildFailed), Reason: err.Error()}
+		}
+		builder.Cleanup(context.Background(), spec)
+		return fs.finishBuild(build, &function, revision, result)
+	}
+
+	tail := utils.NewLogTail(buildLogTailLines)
+	logsDone := make(chan struct{})
+	logContext, stopLogs := context.WithCancel(buildContext)
+	defer stopLogs()
+	go func() {
+		defer close(logsDone)
+		builder.Logs(logContext, spec, func(line string) {
+			tail.Add(line)
+			onLog(line)
+		})
+	}()
+
+	result := builder.Wait(buildContext, spec)
+	if stopped, ok := stoppedBuild(buildContext, timeout); ok && result.Status != string(constants.BuildSuccess) {
+		result = stopped
+	} else if result.Err != nil {
+		fs.l.Print("error watching image builder ", result.Err)
+		result = WatchResult{Status: string(constants.BuildFailed), Reason: result.Err.Error()}
+	}
+
+	// the containers are done, so the log streams end on their own. don't wait forever though.
+	// a stopped build's streams end with its context
+	select {
+	case <-logsDone:
+	case <-time.After(10 * time.Second):
+		stopLogs()
+	}
+	build.LogTail = tail.String()
+	function.BuildLog = build.LogTail
+	// the pod's status message is usually empty. the last thing the builder said is more useful
+	if result.Status == string(constants.BuildFailed) && result.Reason == "" {
+		result.Reason = tail.Last()
+	}
+
+	if err := builder.Cleanup(context.Background(), spec); err != nil {
+		fs.l.Print("err deleting image builder: ", err)
+	}
+	return fs.finishBuild(build, &function, revision, result)
+}
+
+// the outcome of a build whose context is done: TimedOut or Cancelled. false while it isn't done
+func stoppedBuild(ctx context.Context, timeout time.Duration) (WatchResult, bool) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return WatchResult{
+			Status: string(constants.BuildTimedOut),
+			Reason: fmt.Sprintf("Build did not finish within %v", timeout),
+		}, true
+	case ctx.Err() != nil:
+		return WatchResult{Status: string(constants.BuildCancelled), Reason: "Cancelled"}, true
+	}
+	return WatchResult{}, false
+}
+
+// the build timeout of the function: its project's, else its runtime's, else fallback
+func (fs *FunctionService) buildTimeout(
+	function *models.Function,
+	runtime *runtimes.Runtime,
+	fallback time.Duration,
+) time.Duration {
+	var config models.Config
+	if err := fs.db.Unscoped().First(&config, "id = ?", function.ConfigID).Error; err == nil && config.BuildTimeout > 0 {
+		return time.Duration(config.BuildTimeout) * time.Second
+	}
+	if runtime.BuildTimeout > 0 {
+		return time.Duration(runtime.BuildTimeout) * time.Second
+	}
+	return fallback
+}
+
+// record the outcome of a build on the build, its revision and its function
+func (fs *FunctionService) finishBuild(
+	build *models.Build,
+	function *models.Function,
+	revision *models.FunctionRevision,
+	result WatchResult,
+) *models.Build {
+	now := time.Now()
+	build.Status = result.Status
+	build.FailReason = result.Reason
+	build.FinishedAt = &now
+	fs.db.Save(build)
+
+	if revision != nil {
+		revision.BuildStatus = result.Status
+		revision.BuildFailReason = result.Reason
+		revision.Digest = result.Digest
+		if result.Commit != "" {
+			revision.GitCommit = result.Commit
+		}
+		fs.db.Save(revision)
+	}
+
+	if function == nil {
+		return build
+	}
+	function.BuildStatus = result.Status
+	function.BuildFailReason = result.Reason
+	function.LastAction = build.Action
+	if revision != nil && result.Status == string(constants.BuildSuccess) {
+		function.Revision = revision.Number
+		function.Image = revision.Image
+		function.ImageDigest = revision.Digest
+	}
+	if build.Action == string(constants.UpdateAction) {
+		function.DeployStatus = string(constants.RedeployRequired)
+	}
+	fs.SaveFunction(function)
+	return build
+}
+
+/*
+Follow the logs of every container of the image builder pod, init containers first, and pass
+them to onLine line by line. Returns when all containers are done or ctx is cancelled.
+*/
+func (fs *FunctionService) StreamBuildLogs(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	podName string,
+	onLine func(line string),
+) {
+	pod, err := waitForPodStart(kw, ctx, namespace, podName)
+	if err != nil {
+		return
+	}
+
+	var containers []string
+	for _, c := range pod.Spec.InitContainers {
+		containers = append(containers, c.Name)
+	}
+	for _, c := range pod.Spec.Containers {
+		containers = append(containers, c.Name)
+	}
+
+	for _, container := range containers {
+		// a container's logs can only be read once it has started
+		for {
+			stream, err := kw.KClient.CoreV1().
+				Pods(namespace).
+				GetLogs(podName, &corev1.PodLogOptions{Container: container, Follow: true}).
+				Stream(ctx)
+			if err == nil {
+				scanner := bufio.NewScanner(stream)
+				scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+				for scanner.Scan() {
+					onLine(scanner.Text())
+				}
+				stream.Close()
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// wait until the pod has been scheduled and its first container has started
+func waitForPodStart(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	podName string,
+) (*corev1.Pod, error) {
+	for {
+		pod, err := kw.KClient.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err == nil && pod.Status.Phase != corev1.PodPending {
+			return pod, nil
+		}
+		if err == nil {
+			statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+			for _, status := range statuses {
+				if status.State.Running != nil || status.State.Terminated != nil {
+					return pod, nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/registry"
+	"github.com/Cloudbase-Project/serverless/runtimes"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Everything an image builder needs to build one revision
+type BuildSpec struct {
+	FunctionId string
+	BuildId    string
+	Runtime    *runtimes.Runtime
+	// image to push, tagged
+	Image    string
+	Registry registry.Config
+	// repository for the layer cache. no layer cache when empty
+	CacheRepository string
+	Cache           *BuildCache
+	Source          *BuildSource
+}
+
+// the spec as options for the kubernetes wrapper
+func (s *BuildSpec) options(ctx context.Context) *kuberneteswrapper.ImageBuilder {
+	return &kuberneteswrapper.ImageBuilder{
+		Ctx:             ctx,
+		Namespace:       constants.Namespace,
+		FunctionId:      s.FunctionId,
+		BuildId:         s.BuildId,
+		Runtime:         s.Runtime,
+		ImageName:       s.Image,
+		RegistrySecret:  s.Registry.SecretName,
+		Insecure:        s.Registry.Insecure,
+		CacheRepository: s.CacheRepository,
+		CacheTTL:        s.Cache.TTL,
+		CacheVolume:     s.Cache.Volume,
+		Code:            s.Source.Code,
+		Source:          s.Source.Archive,
+		Git:             s.Source.Git,
+		DependencyFiles: s.Source.DependencyFiles,
+		DefaultFiles:    s.Source.DefaultFiles,
+	}
+}
+
+/*
+Builds function images and pushes them. RunBuild calls Start, follows Logs while it Waits and
+calls Cleanup at the end.
+*/
+type ImageBuilder interface {
+	// Start the build. A build that is already running is left alone so resumed builds can call it again
+	Start(ctx context.Context, spec *BuildSpec) error
+	// Pass the build's log lines to onLine until the build is done or ctx is cancelled
+	Logs(ctx context.Context, spec *BuildSpec, onLine func(line string))
+	// Wait for the build to finish. A successful result carries the digest of the pushed image
+	Wait(ctx context.Context, spec *BuildSpec) WatchResult
+	// Remove whatever the build left behind
+	Cleanup(ctx context.Context, spec *BuildSpec) error
+}
+
+/*
+The image builder named by kind: kaniko (the default), buildkit, docker or podman. kaniko and
+buildkit build in pods on the cluster, docker and podman with the local CLI.
+*/
+func NewImageBuilder(
+	kind string,
+	kw *kuberneteswrapper.KubernetesWrapper,
+	fs *FunctionService,
+	l *log.Logger,
+	push bool,
+) (ImageBuilder, error) {
+	switch kind {
+	case "", "kaniko":
+		return &podBuilder{kw: kw, functions: fs, create: kw.CreateImageBuilder}, nil
+	case "buildkit":
+		return &podBuilder{kw: kw, functions: fs, create: kw.CreateBuildKitBuilder}, nil
+	case "docker", "podman":
+		return NewLocalBuilder(l, kind, push), nil
+	}
+	return nil, fmt.Errorf("unknown image builder %v", kind)
+}
+
+// Builds in a pod on the cluster. create makes the pod for a build
+type podBuilder struct {
+	kw        *kuberneteswrapper.KubernetesWrapper
+	functions *FunctionService
+	create    func(ib *kuberneteswrapper.ImageBuilder) (*corev1.Pod, error)
+}
+
+func (b *podBuilder) Start(ctx context.Context, spec *BuildSpec) error {
+	_, err := b.create(spec.options(ctx))
+	// the server restarted while the build was running
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *podBuilder) Logs(ctx context.Context, spec *BuildSpec, onLine func(line string)) {
+	podName := kuberneteswrapper.BuilderName(spec.FunctionId, spec.BuildId)
+	b.functions.StreamBuildLogs(b.kw, ctx, constants.Namespace, podName, onLine)
+}
+
+func (b *podBuilder) Wait(ctx context.Context, spec *BuildSpec) WatchResult {
+	return b.functions.WatchImageBuilder(b.kw, ctx, spec.FunctionId, constants.Namespace, spec.BuildId)
+}
+
+func (b *podBuilder) Cleanup(ctx context.Context, spec *BuildSpec) error {
+	return b.functions.DeleteImageBuilder(b.kw, ctx, constants.Namespace, spec.FunctionId, spec.BuildId)
+}
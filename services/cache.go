@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"os"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/registry"
+	"github.com/Cloudbase-Project/serverless/runtimes"
+)
+
+/*
+Settings of the build cache. Layers are cached in the registry (see registry.Config) and base
+images on a PVC filled by the cache warmer.
+*/
+type BuildCache struct {
+	// PVC holding the base image cache. base images are pulled every build when empty
+	Volume string
+	// how long cached layers are reused, e.g. 168h. kaniko's default of two weeks when empty
+	TTL string
+}
+
+// Build cache settings from BUILD_CACHE_PVC and BUILD_CACHE_TTL
+func BuildCacheFromEnv() *BuildCache {
+	return &BuildCache{Volume: os.Getenv("BUILD_CACHE_PVC"), TTL: os.Getenv("BUILD_CACHE_TTL")}
+}
+
+// Pull the base images of every runtime into the base image cache
+func (fs *FunctionService) WarmBuildCache(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	rs *runtimes.Registry,
+	regs *registry.Registries,
+	cache *BuildCache,
+) error {
+	if cache.Volume == "" {
+		return nil
+	}
+	var images []string
+	seen := map[string]bool{}
+	for _, runtime := range rs.List() {
+		for _, image := range runtime.BaseImages() {
+			if !seen[image] {
+				seen[image] = true
+				images = append(images, image)
+			}
+		}
+	}
+	if len(images) == 0 {
+		return nil
+	}
+	_, err := kw.CreateCacheWarmer(
+		context.Background(),
+		constants.Namespace,
+		cache.Volume,
+		regs.Default.SecretName,
+		images,
+	)
+	return err
+}
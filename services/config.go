@@ -1,6 +1,7 @@
 package services
 
 import (
+	"errors"
 	"log"
 
 	"github.com/Cloudbase-Project/serverless/dtos"
@@ -21,14 +22,31 @@ func (cs *ConfigService) CreateConfig(
 	CreateConfigDTO *dtos.CreateConfigDTO,
 ) *models.Config {
 	config := models.Config{
-		Owner:     CreateConfigDTO.Owner,
-		ProjectId: CreateConfigDTO.ProjectId,
-		Enabled:   true,
+		Owner:        CreateConfigDTO.Owner,
+		ProjectId:    CreateConfigDTO.ProjectId,
+		Enabled:      true,
+		BuildTimeout: CreateConfigDTO.BuildTimeout,
+		MaxCPU:       CreateConfigDTO.MaxCPU,
+		MaxMemory:    CreateConfigDTO.MaxMemory,
+		MaxReplicas:  CreateConfigDTO.MaxReplicas,
 	}
-	_ := cs.db.Create(&config)
+	cs.db.Create(&config)
 	return &config
 }
 
+// Get the config of a project. nil if the owner has no such project
+func (cs *ConfigService) GetConfig(projectId string, ownerId string) (*models.Config, error) {
+	var config models.Config
+	err := cs.db.Where(&models.Config{Owner: ownerId, ProjectId: projectId}).First(&config).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
 func (cs *ConfigService) ToggleService(projectId string, ownerId string) (*models.Config, error) {
 	var config models.Config
 
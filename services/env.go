@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/secrets"
+	"gorm.io/gorm"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// max size of one value. all of a function's secrets have to fit in one kubernetes secret
+const maxEnvValueSize = 32 * 1024
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// variables the platform sets itself
+var reservedEnv = map[string]bool{"PORT": true}
+
+/*
+Environment variables and secrets of functions. They are kept in Postgres, secret values
+encrypted, and synced to a configmap and a secret per function that its pods read with envFrom.
+*/
+type EnvService struct {
+	db *gorm.DB
+	l  *log.Logger
+	// nil when SECRETS_KEY is not set. plain variables still work then
+	box *secrets.Box
+}
+
+func NewEnvService(db *gorm.DB, l *log.Logger, box *secrets.Box) *EnvService {
+	return &EnvService{db: db, l: l, box: box}
+}
+
+// Check a variable before it is stored
+func ValidateEnv(name string, value string) error {
+	if !envName.MatchString(name) {
+		return fmt.Errorf("invalid variable name %v", name)
+	}
+	if reservedEnv[name] {
+		return fmt.Errorf("%v is set by the platform", name)
+	}
+	if len(value) > maxEnvValueSize {
+		return fmt.Errorf("value is too large. max %v bytes", maxEnvValueSize)
+	}
+	return nil
+}
+
+// The function's variables sorted by name. Secret values are left out
+func (es *EnvService) ListEnv(functionId string) (models.EnvVars, error) {
+	var vars models.EnvVars
+	err := es.db.Where("function_id = ?", functionId).Order("name").Find(&vars).Error
+	return vars, err
+}
+
+// Create or replace a variable of the function
+func (es *EnvService) SetEnv(
+	function *models.Function,
+	name string,
+	value string,
+	secret bool,
+) (*models.EnvVar, error) {
+	if err := ValidateEnv(name, value); err != nil {
+		return nil, err
+	}
+	var env models.EnvVar
+	err := es.db.Where("function_id = ? AND name = ?", function.ID, name).First(&env).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	env.FunctionID = function.ID
+	env.Name = name
+	env.Secret = secret
+	env.Value = value
+	env.Ciphertext = nil
+	if secret {
+		sealed, err := es.box.Seal([]byte(value), envAssociatedData(function.ID.String(), name))
+		if err != nil {
+			return nil, err
+		}
+		env.Value = ""
+		env.Ciphertext = sealed
+	}
+	if err := es.db.Save(&env).Error; err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// Delete a variable of the function. Returns false if there was none
+func (es *EnvService) DeleteEnv(functionId string, name string) (bool, error) {
+	result := es.db.Unscoped().Where("function_id = ? AND name = ?", functionId, name).Delete(&models.EnvVar{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// secret values are bound to the function and the name they were set for
+func envAssociatedData(functionId string, name string) []byte {
+	return []byte(functionId + "/" + name)
+}
+
+/*
+Write the function's variables to its configmap and secret and return the checksum of all of
+them. Deployments carry the checksum, so a change restarts their pods.
+*/
+func (es *EnvService) SyncEnv(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	functionId string,
+) (string, error) {
+	vars, err := es.ListEnv(functionId)
+	if err != nil {
+		return "", err
+	}
+	plain := map[string]string{}
+	secret := map[string][]byte{}
+	for _, env := range vars {
+		if !env.Secret {
+			plain[env.Name] = env.Value
+			continue
+		}
+		value, err := es.box.Open(env.Ciphertext, envAssociatedData(functionId, env.Name))
+		if err != nil {
+			return "", fmt.Errorf("cannot decrypt %v: %w", env.Name, err)
+		}
+		secret[env.Name] = value
+	}
+
+	meta := metav1.ObjectMeta{
+		Name:   kuberneteswrapper.EnvName(functionId),
+		Labels: map[string]string{"app": functionId},
+	}
+	if err := kw.ApplyConfigMap(ctx, namespace, &corev1.ConfigMap{ObjectMeta: meta, Data: plain}); err != nil {
+		return "", err
+	}
+	err = kw.ApplySecret(ctx, namespace, &corev1.Secret{ObjectMeta: meta, Type: corev1.SecretTypeOpaque, Data: secret})
+	if err != nil {
+		return "", err
+	}
+	return envChecksum(plain, secret), nil
+}
+
+// sha256 over every name and value, in name order
+func envChecksum(plain map[string]string, secret map[string][]byte) string {
+	names := make([]string, 0, len(plain)+len(secret))
+	for name := range plain {
+		names = append(names, name)
+	}
+	for name := range secret {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		value, ok := plain[name]
+		if !ok {
+			value = string(secret[name])
+		}
+		fmt.Fprintf(hash, "%d:%s=%d:%s\n", len(name), name, len(value), value)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+/*
+Sync the function's variables and restart its pods if they changed. Returns whether the pods
+are restarted. Functions that aren't deployed only get the configmap and secret, which their
+first deploy picks up.
+*/
+func (es *EnvService) ApplyEnv(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	functionId string,
+) (bool, error) {
+	checksum, err := es.SyncEnv(kw, ctx, namespace, functionId)
+	if err != nil {
+		return false, err
+	}
+	restarted, err := kw.SetDeploymentEnv(ctx, namespace, functionId, checksum)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return restarted, err
+}
+
+// Remove the function's variables, from the db and the cluster
+func (es *EnvService) DeleteAllEnv(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	functionId string,
+) error {
+	if err := es.db.Unscoped().Where("function_id = ?", functionId).Delete(&models.EnvVar{}).Error; err != nil {
+		return err
+	}
+	options := &kuberneteswrapper.DeleteOptions{Ctx: ctx, Name: kuberneteswrapper.EnvName(functionId), Namespace: namespace}
+	if err := kw.DeleteConfigMap(options); err != nil {
+		return err
+	}
+	return kw.DeleteSecret(options)
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "DATABASE_URL", value: "postgres://db"},
+		{name: "_private"},
+		{name: "lower9"},
+		{name: "", wantErr: true},
+		{name: "9LIVES", wantErr: true},
+		{name: "WITH-DASH", wantErr: true},
+		{name: "WITH SPACE", wantErr: true},
+		{name: "PORT", value: "8080", wantErr: true},
+		{name: "LARGE", value: strings.Repeat("a", maxEnvValueSize)},
+		{name: "TOO_LARGE", value: strings.Repeat("a", maxEnvValueSize+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateEnv(tt.name, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateEnv(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvChecksum(t *testing.T) {
+	checksum := envChecksum(
+		map[string]string{"A": "1", "B": "2"},
+		map[string][]byte{"TOKEN": []byte("s3cret")},
+	)
+	tests := []struct {
+		name   string
+		plain  map[string]string
+		secret map[string][]byte
+		same   bool
+	}{
+		{
+			name:   "same variables",
+			plain:  map[string]string{"B": "2", "A": "1"},
+			secret: map[string][]byte{"TOKEN": []byte("s3cret")},
+			same:   true,
+		},
+		{
+			name:   "secret made plain",
+			plain:  map[string]string{"A": "1", "B": "2", "TOKEN": "s3cret"},
+			secret: map[string][]byte{},
+			same:   true,
+		},
+		{
+			name:   "changed value",
+			plain:  map[string]string{"A": "1", "B": "3"},
+			secret: map[string][]byte{"TOKEN": []byte("s3cret")},
+		},
+		{
+			name:   "changed secret",
+			plain:  map[string]string{"A": "1", "B": "2"},
+			secret: map[string][]byte{"TOKEN": []byte("rotated")},
+		},
+		{
+			name:   "removed variable",
+			plain:  map[string]string{"A": "1"},
+			secret: map[string][]byte{"TOKEN": []byte("s3cret")},
+		},
+		{
+			name:   "value moved between names",
+			plain:  map[string]string{"A": "12", "B": ""},
+			secret: map[string][]byte{"TOKEN": []byte("s3cret")},
+		},
+		{
+			name:   "separator in a value",
+			plain:  map[string]string{"A": "1\n1:B=1:2"},
+			secret: map[string][]byte{"TOKEN": []byte("s3cret")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := envChecksum(tt.plain, tt.secret)
+			if (got == checksum) != tt.same {
+				t.Errorf("envChecksum() = %v, want same as %v: %v", got, checksum, tt.same)
+			}
+		})
+	}
+	if envChecksum(nil, nil) == envChecksum(map[string]string{"A": ""}, nil) {
+		t.Error("envChecksum() is the same with and without an empty variable")
+	}
+}
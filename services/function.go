@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,7 +18,9 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/rest"
 )
 
@@ -29,7 +32,13 @@ type FunctionService struct {
 type WatchResult struct {
 	Status string
 	Reason string
-	Err    error
+	// digest of the pushed image. only set by successful image builds
+	Digest string
+	// commit a git source was fetched at. only set by successful image builds of git sources
+	Commit string
+	// the deployment is scaled to zero, so none of its pods ran yet. only set by deployment watches
+	Idle bool
+	Err  error
 }
 
 func NewFunctionService(db *gorm.DB, l *log.Logger) *FunctionService {
@@ -76,7 +85,9 @@ func (fs *FunctionService) GetFunction(
 		return nil, errors.New("Serverless is disabled")
 	}
 
-	if err := fs.db.First(&function, "id = ?", codeId).Error; err != nil {
+	// only functions of the caller's project
+	err := fs.db.Where("id = ? AND config_id = ?", codeId, config.ID).First(&function).Error
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, nil
 		} else {
@@ -86,6 +97,18 @@ func (fs *FunctionService) GetFunction(
 	return &function, nil
 }
 
+// Get a function by id, without checking who owns it. Used by background jobs
+func (fs *FunctionService) GetFunctionById(codeId string) (*models.Function, error) {
+	var function models.Function
+	if err := fs.db.First(&function, "id = ?", codeId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &function, nil
+}
+
 // Create a function in the db.
 func (fs *FunctionService) CreateFunction(
 	ownerId string,
@@ -136,7 +159,8 @@ func (fs *FunctionService) DeleteFunction(codeId string, ownerId string, project
 		return errors.New("Serverless is disabled")
 	}
 
-	if err := fs.db.Where("id = ?", codeId).Delete(&models.Function{}).Error; err != nil {
+	err := fs.db.Where("id = ? AND config_id = ?", codeId, config.ID).Delete(&models.Function{}).Error
+	if err != nil {
 		return err
 	}
 	return nil
@@ -150,7 +174,11 @@ func (fs *FunctionService) DeployFunction(
 	functionId string,
 	label map[string]string,
 	imageName string,
-	replicas int32,
+	registrySecret string,
+	resources *FunctionResources,
+	port int32,
+	envChecksum string,
+	probes *kuberneteswrapper.ProbeOptions,
 ) error {
 	// (ctx, funtionid, namespace, imagename, replicas, label)
 
@@ -160,7 +188,12 @@ func (fs *FunctionService) DeployFunction(
 		FunctionId:      functionId,
 		DeploymentLabel: label,
 		ImageName:       imageName,
-		Replicas:        replicas,
+		RegistrySecret:  registrySecret,
+		Replicas:        resources.MinReplicas,
+		Port:            port,
+		EnvChecksum:     envChecksum,
+		Resources:       resources.Requirements,
+		Probes:          probes,
 	})
 	if err != nil {
 		return err
@@ -172,133 +205,194 @@ func (fs *FunctionService) DeployFunction(
 		Namespace:       namespace,
 		FunctionId:      functionId,
 		DeploymentLabel: label,
+		TargetPort:      port,
 	})
 	if err != nil {
 		return err
 	}
-	_, err = kw.CreateHPA(&kuberneteswrapper.HPAOptions{
-		Ctx:        ctx,
-		Namespace:  namespace,
-		FunctionId: functionId,
-	})
+	err = fs.applyScaler(kw, ctx, namespace, functionId, resources)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+/*
+Why the deployment's rollout failed, if it did. Pods whose probes never pass leave the rollout
+stuck until its progress deadline.
+*/
+func deploymentFailure(deployment *appsv1.Deployment) (string, bool) {
+	// conditions from before the controller saw the latest change belong to the previous rollout
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return "", false
+	}
+	for _, condition := range deployment.Status.Conditions {
+		switch {
+		case condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == corev1.ConditionTrue:
+			return condition.Message, true
+		case condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded":
+			return "Pods did not become ready : " + condition.Message, true
+		}
+	}
+	return "", false
+}
+
+/*
+Watch the function's deployment until its rollout is available or fails. The controller fails a
+rollout that makes no progress within its progress deadline; the watch gives up a minute after
+that in case it never sees it. Watches the API server closes early are started again.
+*/
 func (fs *FunctionService) WatchDeployment(
 	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
 	function *models.Function,
 	namespace string,
 ) WatchResult {
-	watchContext := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, kuberneteswrapper.ProgressDeadline+time.Minute)
+	defer cancel()
 
 	label, _ := kw.BuildLabel("app", []string{function.ID.String()}) // TODO:
-	deploymentWatch, err := kw.GetDeploymentWatcher(
-		watchContext,
-		label.String(),
-		namespace,
-	)
-	if err != nil {
-		return WatchResult{Err: err}
-	}
-
-	dataChan := make(chan WatchResult)
-
-	go func(dataChan chan WatchResult) {
-		for event := range deploymentWatch.ResultChan() {
-			p, ok := event.Object.(*appsv1.Deployment)
-			if !ok {
-				continue
+	for {
+		deploymentWatch, err := kw.GetDeploymentWatcher(ctx, label.String(), namespace)
+		if err != nil && ctx.Err() == nil {
+			return WatchResult{Err: err}
+		}
+		if err == nil {
+			if result, done := fs.watchRollout(deploymentWatch); done {
+				return result
 			}
-			fmt.Printf("p: %v\n", p)
-			if p.Status.UpdatedReplicas == *p.Spec.Replicas &&
-				p.Status.Replicas == *p.Spec.Replicas &&
-				p.Status.AvailableReplicas == *p.Spec.Replicas &&
-				p.Status.ObservedGeneration >= p.GetObjectMeta().GetGeneration() {
-				// deployment complete
-				fs.l.Print("Deployment available replicas = required replicas")
-				if p.Status.Conditions[0].Type == appsv1.DeploymentAvailable {
-					fs.l.Print("Deployment Available")
-				}
-				dataChan <- WatchResult{Status: string(constants.Deployed), Err: nil}
-				deploymentWatch.Stop()
-				break
-			} else if p.Status.Conditions[0].Type == appsv1.DeploymentProgressing {
-				fs.l.Print("Deployment in Progress")
-			} else if p.Status.Conditions[0].Type == appsv1.DeploymentReplicaFailure {
-				fs.l.Print("Replica failure. Reason : ", p.Status.Conditions[0].Message)
-				dataChan <- WatchResult{Status: string(constants.DeploymentFailed), Reason: p.Status.Conditions[0].Message, Err: nil}
-				fs.SaveFunction(function)
-				deploymentWatch.Stop()
-				break
+		}
 
+		select {
+		case <-ctx.Done():
+			return WatchResult{
+				Status: string(constants.DeploymentFailed),
+				Reason: "Watch Timeout",
+				Err:    nil,
 			}
+		case <-time.After(time.Second):
+		}
+	}
+}
 
+// follow a deployment watch until the rollout is done. done is false if the watch closed before
+func (fs *FunctionService) watchRollout(deploymentWatch watch.Interface) (WatchResult, bool) {
+	defer deploymentWatch.Stop()
+	for event := range deploymentWatch.ResultChan() {
+		p, ok := event.Object.(*appsv1.Deployment)
+		if !ok {
+			continue
+		}
+		if event.Type == watch.Deleted {
+			return WatchResult{Status: string(constants.DeploymentFailed), Reason: "Deployment was deleted"}, true
+		}
+		result, done := rolloutResult(p)
+		if !done {
+			continue
 		}
-	}(dataChan)
-
-	select {
-	case <-watchContext.Done():
-		return WatchResult{
-			Status: string(constants.DeploymentFailed),
-			Reason: "Watch Timeout",
-			Err:    nil,
+		switch {
+		case result.Idle:
+			fs.l.Print("Deployment ", p.Name, " is scaled to zero. Deployed (idle)")
+		case result.Status == string(constants.Deployed):
+			fs.l.Print("Deployment ", p.Name, " available replicas = required replicas")
+		default:
+			fs.l.Print("Deployment ", p.Name, " failed. Reason : ", result.Reason)
 		}
-	case x := <-dataChan:
-		return x
+		return result, true
 	}
+	return WatchResult{}, false
 }
 
+// the result of a deployment's rollout. done is false while it is in progress
+func rolloutResult(p *appsv1.Deployment) (WatchResult, bool) {
+	if p.Status.UpdatedReplicas == *p.Spec.Replicas &&
+		p.Status.Replicas == *p.Spec.Replicas &&
+		p.Status.AvailableReplicas == *p.Spec.Replicas &&
+		p.Status.ObservedGeneration >= p.GetObjectMeta().GetGeneration() {
+		// deployment complete
+		if *p.Spec.Replicas == 0 {
+			// scaled to zero by the activator. the new pods start with the next request
+			return WatchResult{Status: string(constants.Deployed), Idle: true}, true
+		}
+		return WatchResult{Status: string(constants.Deployed), Err: nil}, true
+	}
+	if reason, failed := deploymentFailure(p); failed {
+		return WatchResult{Status: string(constants.DeploymentFailed), Reason: reason, Err: nil}, true
+	}
+	return WatchResult{}, false
+}
+
+/*
+Watch the image builder pod of a build until it succeeds or fails, or until ctx is done. Watches
+the API server closes early are started again.
+*/
 func (fs *FunctionService) WatchImageBuilder(
 	kw *kuberneteswrapper.KubernetesWrapper,
-	function *models.Function,
+	ctx context.Context,
+	functionId string,
 	namespace string,
+	buildId string,
 ) WatchResult {
+	for {
+		podWatch, err := kw.GetImageBuilderWatcher(ctx, kuberneteswrapper.BuilderName(functionId, buildId))
+		if err != nil {
+			return WatchResult{Err: err}
+		}
 
-	// watch for 1 min and then close everything
-	watchContext, cancelFunc := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancelFunc()
-
-	label, _ := kw.BuildLabel("builder", []string{function.ID.String()}) // TODO:
-	podWatch, err := kw.GetImageBuilderWatcher(watchContext, label.String())
-	if err != nil {
-		return WatchResult{Err: err}
-	}
-
-	dataChan := make(chan WatchResult)
-
-	go func(dataChan chan WatchResult) {
 		for event := range podWatch.ResultChan() {
 			p, ok := event.Object.(*corev1.Pod)
 			if !ok {
 				fmt.Println("unexpected type")
 				continue
 			}
+			if event.Type == watch.Deleted {
+				podWatch.Stop()
+				return WatchResult{Status: string(constants.BuildFailed), Reason: "Image builder was deleted"}
+			}
 			// Check Pod Phase. If its failed or succeeded.
 			switch p.Status.Phase {
 			case corev1.PodSucceeded:
-				// TODO: Commit status to DB
-				dataChan <- WatchResult{Status: string(constants.BuildSuccess), Reason: p.Status.Message, Err: nil}
 				podWatch.Stop()
-				break
+				return WatchResult{
+					Status: string(constants.BuildSuccess),
+					Reason: p.Status.Message,
+					Digest: builderDigest(p),
+					Commit: builderCommit(p),
+					Err:    nil,
+				}
 			case corev1.PodFailed:
-				// TODO: Commit status to DB with message
 				fmt.Println("Image build failed. Reason : ", p.Status.Message)
-				dataChan <- WatchResult{Status: string(constants.BuildFailed), Reason: p.Status.Message, Err: nil}
 				podWatch.Stop()
-				break
+				return WatchResult{Status: string(constants.BuildFailed), Reason: p.Status.Message, Err: nil}
 			}
 		}
-	}(dataChan)
 
-	select {
-	case <-watchContext.Done():
-		return WatchResult{Status: string(constants.BuildFailed), Reason: "Watch Timeout", Err: nil}
-	case x := <-dataChan:
-		return x
+		select {
+		case <-ctx.Done():
+			return WatchResult{Err: ctx.Err()}
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// the builder writes the image digest to its termination message
+func builderDigest(pod *corev1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated != nil && strings.HasPrefix(status.State.Terminated.Message, "sha256:") {
+			return strings.TrimSpace(status.State.Terminated.Message)
+		}
+	}
+	return ""
+}
+
+// the init container fetching a git source writes the commit to its termination message
+func builderCommit(pod *corev1.Pod) string {
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name == kuberneteswrapper.GitFetchContainer && status.State.Terminated != nil {
+			return strings.TrimSpace(status.State.Terminated.Message)
+		}
 	}
+	return ""
 }
 
 // Deletes the function's deployment and clusterIP service
@@ -400,9 +494,29 @@ func (fs *FunctionService) GetDeploymentLogs(
 	return err
 }
 
+/*
+Deletes the image builder pod of a build and the configmap holding its build context. Either
+may be missing, e.g. when the pod couldn't be created; the configmap is deleted regardless.
+*/
 func (fs *FunctionService) DeleteImageBuilder(
 	kw *kuberneteswrapper.KubernetesWrapper,
 	ctx context.Context, namespace string,
+	functionId string,
+	buildId string,
 ) error {
-	return kw.KClient.CoreV1().Pods(namespace).Delete(ctx, "kaniko-worker", metav1.DeleteOptions{})
+	podErr := kw.KClient.CoreV1().
+		Pods(namespace).
+		Delete(ctx, kuberneteswrapper.BuilderName(functionId, buildId), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(podErr) {
+		podErr = nil
+	}
+	err := kw.DeleteConfigMap(&kuberneteswrapper.DeleteOptions{
+		Ctx:       ctx,
+		Name:      kuberneteswrapper.BuildContextName(functionId, buildId),
+		Namespace: namespace,
+	})
+	if podErr != nil {
+		return podErr
+	}
+	return err
 }
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestRolloutResult(t *testing.T) {
+	deployment := func(replicas int32, generation int64, status appsv1.DeploymentStatus) *appsv1.Deployment {
+		d := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &replicas}, Status: status}
+		d.Generation = generation
+		return d
+	}
+	deadlineExceeded := appsv1.DeploymentCondition{
+		Type:    appsv1.DeploymentProgressing,
+		Status:  corev1.ConditionFalse,
+		Reason:  "ProgressDeadlineExceeded",
+		Message: "ReplicaSet has timed out progressing.",
+	}
+
+	tests := []struct {
+		name       string
+		deployment *appsv1.Deployment
+		done       bool
+		status     constants.DeploymentStatus
+		idle       bool
+	}{
+		{
+			name: "available",
+			deployment: deployment(2, 3, appsv1.DeploymentStatus{
+				ObservedGeneration: 3, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2,
+			}),
+			done:   true,
+			status: constants.Deployed,
+		},
+		{
+			name: "rolling",
+			deployment: deployment(2, 3, appsv1.DeploymentStatus{
+				ObservedGeneration: 3, Replicas: 3, UpdatedReplicas: 1, AvailableReplicas: 2,
+			}),
+		},
+		{
+			name: "not observed yet",
+			deployment: deployment(2, 4, appsv1.DeploymentStatus{
+				ObservedGeneration: 3, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2,
+			}),
+		},
+		{
+			name:       "scaled to zero",
+			deployment: deployment(0, 5, appsv1.DeploymentStatus{ObservedGeneration: 5}),
+			done:       true,
+			status:     constants.Deployed,
+			idle:       true,
+		},
+		{
+			name: "scaled to zero with pods terminating",
+			deployment: deployment(0, 5, appsv1.DeploymentStatus{
+				ObservedGeneration: 5, Replicas: 1, AvailableReplicas: 1,
+			}),
+		},
+		{
+			name: "progress deadline exceeded",
+			deployment: deployment(1, 2, appsv1.DeploymentStatus{
+				ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 1, AvailableReplicas: 1,
+				Conditions: []appsv1.DeploymentCondition{deadlineExceeded},
+			}),
+			done:   true,
+			status: constants.DeploymentFailed,
+		},
+		{
+			name: "deadline of the previous rollout",
+			deployment: deployment(1, 3, appsv1.DeploymentStatus{
+				ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 1, AvailableReplicas: 1,
+				Conditions: []appsv1.DeploymentCondition{deadlineExceeded},
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, done := rolloutResult(tt.deployment)
+			if done != tt.done {
+				t.Fatalf("rolloutResult() done = %v, want %v", done, tt.done)
+			}
+			if !done {
+				return
+			}
+			if result.Status != string(tt.status) || result.Idle != tt.idle {
+				t.Errorf("rolloutResult() = %v idle %v, want %v idle %v", result.Status, result.Idle, tt.status, tt.idle)
+			}
+			if tt.status == constants.DeploymentFailed && result.Reason == "" {
+				t.Error("rolloutResult() failed without a reason")
+			}
+		})
+	}
+}
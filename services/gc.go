@@ -0,0 +1,370 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/registry"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+/*
+Deletes images from the registry through the OCI distribution API. Every function keeps its
+newest keep revisions plus the revisions it is built at and deployed at. Deleted functions lose
+all their images, including ones that don't belong to a revision.
+
+The registry has to allow deletes and run its own blob garbage collection to free the space.
+*/
+type ImageCollector struct {
+	db         *gorm.DB
+	l          *log.Logger
+	kw         *kuberneteswrapper.KubernetesWrapper
+	functions  *FunctionService
+	registries *registry.Registries
+	keep       int
+
+	// one run at a time
+	mu sync.Mutex
+}
+
+func NewImageCollector(
+	db *gorm.DB,
+	l *log.Logger,
+	kw *kuberneteswrapper.KubernetesWrapper,
+	fs *FunctionService,
+	regs *registry.Registries,
+	keep int,
+) *ImageCollector {
+	return &ImageCollector{db: db, l: l, kw: kw, functions: fs, registries: regs, keep: keep}
+}
+
+// Collect every interval until ctx is done. A dry run only logs what would be deleted
+func (c *ImageCollector) Start(ctx context.Context, interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report := c.Collect(ctx, nil, dryRun)
+		c.l.Printf(
+			"Image GC done. %v images found, dry run : %v, %v errors",
+			len(report.Images), dryRun, len(report.Errors),
+		)
+		for _, err := range report.Errors {
+			c.l.Print("Image GC : ", err)
+		}
+	}
+}
+
+// Collect the images of every function, or only of one project's functions when configId is set
+func (c *ImageCollector) Collect(
+	ctx context.Context,
+	configId *uuid.UUID,
+	dryRun bool,
+) *models.ImageGCReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	run := &gcRun{
+		collector: c,
+		ctx:       ctx,
+		report: &models.ImageGCReport{
+			DryRun:    dryRun,
+			Keep:      c.keep,
+			StartedAt: time.Now(),
+			Images:    []*models.CollectedImage{},
+			Errors:    []string{},
+		},
+		clients: map[string]*registry.Client{},
+		seen:    map[string]bool{},
+	}
+
+	var functions models.Functions
+	query := c.db.Unscoped().Where("(deleted_at IS NULL OR images_collected = ?)", false)
+	if configId != nil {
+		query = query.Where("config_id = ?", *configId)
+	}
+	if err := query.Find(&functions).Error; err != nil {
+		run.report.Errors = append(run.report.Errors, err.Error())
+	}
+	for _, function := range functions {
+		if ctx.Err() != nil {
+			break
+		}
+		if function.DeletedAt.Valid {
+			run.collectDeleted(function)
+		} else {
+			run.collectRevisions(function)
+		}
+	}
+	run.report.FinishedAt = time.Now()
+	return run.report
+}
+
+// state of one collection run
+type gcRun struct {
+	collector *ImageCollector
+	ctx       context.Context
+	report    *models.ImageGCReport
+	// registry clients by host and pull secret
+	clients map[string]*registry.Client
+	// repository@digest already reported -> whether it was deleted
+	seen map[string]bool
+}
+
+func (r *gcRun) fail(function *models.Function, err error) {
+	r.report.Errors = append(r.report.Errors, fmt.Sprintf("function %v : %v", function.ID, err))
+}
+
+/*
+client for a registry host with the credentials of the function's project. images on a host the
+project doesn't push to anymore get the credentials of a configuration that still does
+*/
+func (r *gcRun) client(function *models.Function, host string) (*registry.Client, error) {
+	config, _, err := r.collector.functions.registryFor(r.collector.registries, function)
+	if err != nil {
+		return nil, err
+	}
+	if config.Host != host {
+		found := false
+		for _, other := range r.collector.registries.All() {
+			if other.Host == host {
+				config, found = other, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("registry %v is not configured", host)
+		}
+	}
+
+	key := config.Host + "/" + config.SecretName
+	if client, ok := r.clients[key]; ok {
+		return client, nil
+	}
+	username, password, err := r.collector.kw.GetRegistryCredentials(
+		r.ctx,
+		constants.Namespace,
+		config.SecretName,
+		host,
+	)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	client := registry.NewClient(config, username, password)
+	r.clients[key] = client
+	return client, nil
+}
+
+// revisions of the function with an image that is still in the registry, newest first
+func (r *gcRun) pushedRevisions(function *models.Function) (models.FunctionRevisions, error) {
+	var revisions models.FunctionRevisions
+	err := r.collector.db.
+		Where("function_id = ? AND build_status = ?", function.ID, constants.BuildSuccess).
+		Where("image <> '' AND image_deleted_at IS NULL").
+		Order("number desc").
+		Find(&revisions).Error
+	return revisions, err
+}
+
+// delete the images of old revisions of a live function
+func (r *gcRun) collectRevisions(function *models.Function) {
+	revisions, err := r.pushedRevisions(function)
+	if err != nil {
+		r.fail(function, err)
+		return
+	}
+
+	// digests still in use. a rebuild can produce the same image as a kept revision
+	kept := map[string]bool{}
+	var garbage models.FunctionRevisions
+	for i, revision := range revisions {
+		if i < r.collector.keep ||
+			revision.Number == function.Revision ||
+			revision.Number == function.DeployedRevision {
+			if digest, err := r.revisionDigest(function, revision); err == nil {
+				kept[digest] = true
+			}
+			continue
+		}
+		garbage = append(garbage, revision)
+	}
+	for _, revision := range garbage {
+		if err := r.deleteRevision(function, revision, "old revision", kept); err != nil {
+			r.fail(function, err)
+		}
+	}
+}
+
+// delete every image of a deleted function
+func (r *gcRun) collectDeleted(function *models.Function) {
+	failed := false
+	revisions, err := r.pushedRevisions(function)
+	if err != nil {
+		r.fail(function, err)
+		return
+	}
+	repositories := map[string]bool{}
+	for _, revision := range revisions {
+		host, repository, _, _ := registry.ParseImage(revision.Image)
+		repositories[host+"/"+repository] = true
+		if err := r.deleteRevision(function, revision, "function deleted", nil); err != nil {
+			r.fail(function, err)
+			failed = true
+		}
+	}
+
+	// whatever else is left in the function's repository. e.g. images pushed before revisions
+	config, projectId, err := r.collector.functions.registryFor(r.collector.registries, function)
+	if err != nil {
+		r.fail(function, err)
+		return
+	}
+	repositories[config.ImageRepository(projectId, function.ID.String())] = true
+	for image := range repositories {
+		if err := r.deleteRepository(function, image); err != nil {
+			r.fail(function, err)
+			failed = true
+		}
+	}
+
+	if !failed && !r.report.DryRun {
+		r.collector.db.Unscoped().Model(function).Update("images_collected", true)
+	}
+}
+
+// digest of a revision's image. asks the registry for images pushed before digests were recorded
+func (r *gcRun) revisionDigest(function *models.Function, revision *models.FunctionRevision) (string, error) {
+	if revision.Digest != "" {
+		return revision.Digest, nil
+	}
+	host, repository, tag, digest := registry.ParseImage(revision.Image)
+	if digest != "" {
+		return digest, nil
+	}
+	client, err := r.client(function, host)
+	if err != nil {
+		return "", err
+	}
+	return client.Digest(r.ctx, repository, tag)
+}
+
+// delete a revision's image unless its digest is kept
+func (r *gcRun) deleteRevision(
+	function *models.Function,
+	revision *models.FunctionRevision,
+	reason string,
+	kept map[string]bool,
+) error {
+	digest, err := r.revisionDigest(function, revision)
+	if errors.Is(err, registry.ErrNotFound) {
+		// already gone
+		r.markDeleted(revision)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if kept[digest] {
+		return nil
+	}
+	host, repository, _, _ := registry.ParseImage(revision.Image)
+	deleted, err := r.delete(function, host, repository, revision.Image, digest, revision.Number, reason)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		r.markDeleted(revision)
+	}
+	return nil
+}
+
+// delete every tag left in a repository
+func (r *gcRun) deleteRepository(function *models.Function, image string) error {
+	host, repository, _, _ := registry.ParseImage(image)
+	client, err := r.client(function, host)
+	if err != nil {
+		return err
+	}
+	tags, err := client.Tags(r.ctx, repository)
+	if errors.Is(err, registry.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		digest, err := client.Digest(r.ctx, repository, tag)
+		if errors.Is(err, registry.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := r.delete(function, host, repository, image+":"+tag, digest, 0, "function deleted"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// report an image and delete it unless this is a dry run. returns whether it was deleted
+func (r *gcRun) delete(
+	function *models.Function,
+	host string,
+	repository string,
+	image string,
+	digest string,
+	revision int,
+	reason string,
+) (bool, error) {
+	key := host + "/" + repository + "@" + digest
+	if deleted, ok := r.seen[key]; ok {
+		return deleted, nil
+	}
+	r.seen[key] = false
+
+	collected := &models.CollectedImage{
+		FunctionID: function.ID,
+		Revision:   revision,
+		Image:      image,
+		Digest:     digest,
+		Reason:     reason,
+	}
+	r.report.Images = append(r.report.Images, collected)
+	if r.report.DryRun {
+		return false, nil
+	}
+
+	client, err := r.client(function, host)
+	if err != nil {
+		return false, err
+	}
+	if err := client.Delete(r.ctx, repository, digest); err != nil && !errors.Is(err, registry.ErrNotFound) {
+		return false, err
+	}
+	collected.Deleted = true
+	r.seen[key] = true
+	return true, nil
+}
+
+func (r *gcRun) markDeleted(revision *models.FunctionRevision) {
+	if r.report.DryRun {
+		return
+	}
+	now := time.Now()
+	revision.ImageDeletedAt = &now
+	r.collector.db.Save(revision)
+}
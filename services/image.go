@@ -0,0 +1,33 @@
+package services
+
+import (
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/registry"
+)
+
+// The registry configuration of the function's project, with the project's id
+func (fs *FunctionService) registryFor(
+	regs *registry.Registries,
+	function *models.Function,
+) (registry.Config, string, error) {
+	var config models.Config
+	// deleted projects still need it to clean up their images
+	if err := fs.db.Unscoped().First(&config, "id = ?", function.ConfigID).Error; err != nil {
+		return registry.Config{}, "", err
+	}
+	return regs.For(config.ProjectId), config.ProjectId, nil
+}
+
+/*
+Pinned image reference of the function's latest build, so every replica runs the same image.
+Functions built before images were tracked fall back to :latest
+*/
+func functionImageRef(function *models.Function, config registry.Config, projectId string) string {
+	if function.Image == "" {
+		return config.ImageRepository(projectId, function.ID.String()) + ":latest"
+	}
+	if function.ImageDigest == "" {
+		return function.Image
+	}
+	return function.Image + "@" + function.ImageDigest
+}
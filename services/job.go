@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Something that happened to a job. Streamed to clients as server sent events.
+type JobEvent struct {
+	// "status" when the job's status changed, "message" for progress messages, "log" for build log lines
+	Type    string      `json:"type"`
+	Status  string      `json:"status,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Job     *models.Job `json:"job,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+type JobService struct {
+	db *gorm.DB
+	l  *log.Logger
+
+	mu          sync.Mutex
+	subscribers map[uuid.UUID][]chan JobEvent
+}
+
+func NewJobService(db *gorm.DB, l *log.Logger) *JobService {
+	return &JobService{db: db, l: l, subscribers: map[uuid.UUID][]chan JobEvent{}}
+}
+
+func (js *JobService) CreateJob(
+	function *models.Function,
+	jobType constants.JobType,
+	buildId *uuid.UUID,
+	revision int,
+	autoDeploy bool,
+) (*models.Job, error) {
+	job := models.Job{
+		Type:       string(jobType),
+		Status:     string(constants.JobPending),
+		FunctionID: function.ID,
+		ConfigID:   function.ConfigID,
+		BuildID:    buildId,
+		Revision:   revision,
+		AutoDeploy: autoDeploy,
+	}
+	if err := js.db.Create(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Get a job. Only the owner of the job's project can see it
+func (js *JobService) GetJob(jobId string, ownerId string) (*models.Job, error) {
+	var job models.Job
+	if err := js.db.First(&job, "id = ?", jobId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var config models.Config
+	if err := js.db.First(&config, "id = ?", job.ConfigID).Error; err != nil || config.Owner != ownerId {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+// jobs that were not finished when the server stopped
+func (js *JobService) unfinishedJobs() ([]*models.Job, error) {
+	var jobs []*models.Job
+	err := js.db.
+		Where("status IN ?", []string{string(constants.JobPending), string(constants.JobRunning)}).
+		Order("created_at").
+		Find(&jobs).Error
+	return jobs, err
+}
+
+func (js *JobService) SetRunning(job *models.Job) {
+	if job.Status == string(constants.JobRunning) {
+		return
+	}
+	now := time.Now()
+	job.Status = string(constants.JobRunning)
+	job.StartedAt = &now
+	js.db.Save(job)
+	js.Publish(job.ID, JobEvent{Type: "status", Status: job.Status, Job: job})
+}
+
+// Record the outcome of a job and tell its subscribers it is done
+func (js *JobService) Finish(job *models.Job, succeeded bool, result string, reason string) {
+	now := time.Now()
+	if job.StartedAt == nil {
+		job.StartedAt = &now
+	}
+	job.FinishedAt = &now
+	job.Result = result
+	job.Error = reason
+	job.Status = string(constants.JobFailed)
+	if succeeded {
+		job.Status = string(constants.JobSucceeded)
+	}
+	js.db.Save(job)
+	js.Publish(job.ID, JobEvent{Type: "status", Status: job.Status, Job: job})
+}
+
+func (js *JobService) Message(job *models.Job, message string) {
+	js.Publish(job.ID, JobEvent{Type: "message", Message: message})
+}
+
+// how long a starting build waits for the job following it to be created
+const buildJobWait = 5 * time.Second
+
+/*
+The job following a build. The job is created right after the build is queued, so a build that
+starts right away waits a moment for it. nil if there is none.
+*/
+func (js *JobService) JobForBuild(ctx context.Context, buildId uuid.UUID) (*models.Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, buildJobWait)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var job models.Job
+		err := js.db.Where("build_id = ?", buildId).First(&job).Error
+		if err == nil {
+			return &job, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns a function that publishes build log lines on the job following the build. Lines are dropped without a job
+func (js *JobService) BuildLogger(job *models.Job) func(line string) {
+	return func(line string) {
+		if job != nil {
+			js.Publish(job.ID, JobEvent{Type: "log", Message: line})
+		}
+	}
+}
+
+// send an event to everyone listening on the job. channels are closed once the job is done
+func (js *JobService) Publish(jobId uuid.UUID, event JobEvent) {
+	event.Time = time.Now()
+	done := event.Type == "status" &&
+		(event.Status == string(constants.JobSucceeded) || event.Status == string(constants.JobFailed))
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for _, ch := range js.subscribers[jobId] {
+		select {
+		case ch <- event:
+		default:
+			// slow reader. drop the event rather than hold up the job
+		}
+		if done {
+			close(ch)
+		}
+	}
+	if done {
+		delete(js.subscribers, jobId)
+	}
+}
+
+/*
+Listen to a job's events. The channel is closed when the job finishes. Call cancel to stop
+listening early.
+*/
+func (js *JobService) Subscribe(jobId uuid.UUID) (<-chan JobEvent, func()) {
+	ch := make(chan JobEvent, 64)
+	js.mu.Lock()
+	js.subscribers[jobId] = append(js.subscribers[jobId], ch)
+	js.mu.Unlock()
+
+	cancel := func() {
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		subs := js.subscribers[jobId]
+		for i, sub := range subs {
+			if sub == ch {
+				js.subscribers[jobId] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cancel
+}
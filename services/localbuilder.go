@@ -0,0 +1,271 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/registry"
+	"github.com/Cloudbase-Project/serverless/utils"
+)
+
+/*
+Builds with the docker or podman CLI on the machine the server runs on. Meant for developer
+laptops, so the build pipeline can be run without a cluster. The layer cache is the local
+engine's. Builds don't survive a restart of the server and start over when resumed. Git sources
+are fetched with the machine's git, and its credentials.
+*/
+type LocalBuilder struct {
+	l *log.Logger
+	// docker or podman
+	command string
+	// push the image after building it. without a push the image only exists locally and has no digest
+	push bool
+
+	mu     sync.Mutex
+	builds map[string]*localBuild
+}
+
+// a build running in the background
+type localBuild struct {
+	dir string
+	// build context to lay over a git source once it is fetched. nil for other sources
+	context []byte
+	// default dependency files of a git source
+	defaults []byte
+	lines    chan string
+	done     chan struct{}
+	result   WatchResult
+	// kills the CLI
+	cancel context.CancelFunc
+}
+
+func NewLocalBuilder(l *log.Logger, command string, push bool) *LocalBuilder {
+	return &LocalBuilder{l: l, command: command, push: push, builds: map[string]*localBuild{}}
+}
+
+func (b *LocalBuilder) Start(ctx context.Context, spec *BuildSpec) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.builds[spec.BuildId]; ok {
+		return nil
+	}
+
+	buildContext, err := kuberneteswrapper.BuildContext(spec.options(ctx))
+	if err != nil {
+		return err
+	}
+	defaults, err := kuberneteswrapper.BuildContextDefaults(spec.options(ctx))
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "build-"+spec.BuildId+"-")
+	if err != nil {
+		return err
+	}
+	// git sources are fetched when the build runs
+	if spec.Source.Git == nil {
+		if err := utils.ExtractArchive(buildContext, dir); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		buildContext = nil
+	}
+
+	// the build outlives the request that started it. Cleanup stops it
+	runContext, cancel := context.WithCancel(context.Background())
+	build := &localBuild{
+		dir:      dir,
+		context:  buildContext,
+		defaults: defaults,
+		cancel:   cancel,
+		// lines are dropped when nobody reads them rather than holding up the build
+		lines: make(chan string, 1024),
+		done:  make(chan struct{}),
+	}
+	b.builds[spec.BuildId] = build
+	go b.run(runContext, build, spec)
+	return nil
+}
+
+// build, push and read the digest back
+func (b *LocalBuilder) run(ctx context.Context, build *localBuild, spec *BuildSpec) {
+	defer close(build.done)
+	defer close(build.lines)
+
+	if spec.Source.Git != nil {
+		commit, err := b.fetch(ctx, build, spec)
+		if err != nil {
+			build.result = WatchResult{Status: string(constants.BuildFailed), Reason: err.Error()}
+			return
+		}
+		build.result.Commit = commit
+	}
+
+	err := b.exec(ctx, build, "build", "-t", spec.Image, "-f", filepath.Join(build.dir, "Dockerfile"), build.dir)
+	if err == nil && b.push {
+		args := []string{"push"}
+		if spec.Registry.Insecure && b.command == "podman" {
+			// docker reads insecure registries from the daemon's config instead
+			args = append(args, "--tls-verify=false")
+		}
+		err = b.exec(ctx, build, append(args, spec.Image)...)
+	}
+	if err != nil {
+		build.result = WatchResult{Status: string(constants.BuildFailed), Reason: err.Error()}
+		return
+	}
+
+	build.result.Status = string(constants.BuildSuccess)
+	if b.push {
+		build.result.Digest = b.digest(ctx, spec.Image)
+	}
+}
+
+/*
+Fetch the git source and lay out the build directory like the fetch container of a builder pod
+does: the default dependency files, the repository over them and the build context over that.
+Returns the commit.
+*/
+func (b *LocalBuilder) fetch(ctx context.Context, build *localBuild, spec *BuildSpec) (string, error) {
+	git := spec.Source.Git
+	b.line(build, "Fetching "+git.URL)
+	archive, _, commit, err := utils.FetchGitSource(ctx, git.URL, git.Ref, git.Subdirectory, git.Resolve)
+	if err != nil {
+		return "", err
+	}
+	b.line(build, "Fetched commit "+commit)
+	if _, ok, err := utils.ReadArchiveFile(archive, spec.Runtime.SourceFile); err != nil {
+		return "", err
+	} else if !ok {
+		return "", fmt.Errorf("source must contain %v", spec.Runtime.SourceFile)
+	}
+	for _, layer := range [][]byte{build.defaults, archive, build.context} {
+		if layer == nil {
+			continue
+		}
+		if err := utils.ExtractArchive(layer, build.dir); err != nil {
+			return "", err
+		}
+	}
+	return commit, nil
+}
+
+// pass a line on to the logs, dropping it when nobody reads them
+func (b *LocalBuilder) line(build *localBuild, line string) {
+	select {
+	case build.lines <- line:
+	default:
+	}
+}
+
+// run the CLI, passing its output on as log lines
+func (b *LocalBuilder) exec(ctx context.Context, build *localBuild, args ...string) error {
+	cmd := exec.CommandContext(ctx, b.command, args...)
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			b.line(build, scanner.Text())
+		}
+		io.Copy(io.Discard, reader)
+	}()
+
+	err := cmd.Run()
+	writer.Close()
+	<-scanned
+	return err
+}
+
+// digest the registry gave the pushed image
+func (b *LocalBuilder) digest(ctx context.Context, image string) string {
+	out, err := exec.CommandContext(
+		ctx, b.command, "image", "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", image,
+	).Output()
+	if err != nil {
+		b.l.Print("Cannot read the digest of ", image, " : ", err)
+		return ""
+	}
+	host, repository, _, _ := registry.ParseImage(image)
+	for _, line := range strings.Split(string(out), "\n") {
+		if name, digest := splitDigest(strings.TrimSpace(line)); name == host+"/"+repository {
+			return digest
+		}
+	}
+	return ""
+}
+
+func (b *LocalBuilder) get(buildId string) *localBuild {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.builds[buildId]
+}
+
+func (b *LocalBuilder) Logs(ctx context.Context, spec *BuildSpec, onLine func(line string)) {
+	build := b.get(spec.BuildId)
+	if build == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-build.lines:
+			if !ok {
+				return
+			}
+			onLine(line)
+		}
+	}
+}
+
+func (b *LocalBuilder) Wait(ctx context.Context, spec *BuildSpec) WatchResult {
+	build := b.get(spec.BuildId)
+	if build == nil {
+		return WatchResult{Status: string(constants.BuildFailed), Reason: "Build was not started"}
+	}
+	select {
+	case <-ctx.Done():
+		return WatchResult{Status: string(constants.BuildFailed), Reason: ctx.Err().Error()}
+	case <-build.done:
+		return build.result
+	}
+}
+
+func (b *LocalBuilder) Cleanup(ctx context.Context, spec *BuildSpec) error {
+	b.mu.Lock()
+	build, ok := b.builds[spec.BuildId]
+	delete(b.builds, spec.BuildId)
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	// a cancelled or timed out build is still running
+	build.cancel()
+	<-build.done
+	return os.RemoveAll(build.dir)
+}
+
+// split name@sha256:... into the name and the digest
+func splitDigest(reference string) (string, string) {
+	i := strings.LastIndex(reference, "@")
+	if i < 0 {
+		return reference, ""
+	}
+	return reference[:i], reference[i+1:]
+}
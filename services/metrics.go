@@ -0,0 +1,114 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// custom metrics of function deployments the hpa scales on, served by prometheus-adapter
+const (
+	RequestsPerSecondMetric = "serverless_requests_per_second"
+	InflightRequestsMetric  = "serverless_inflight_requests"
+)
+
+/*
+Requests to functions, counted at the proxy. Exported to prometheus labelled with the function
+and its namespace, and kept in memory for the builtin scaler.
+*/
+type RequestMetrics struct {
+	requests *prometheus.CounterVec
+	inflight *prometheus.GaugeVec
+
+	mu        sync.Mutex
+	functions map[string]*requestStats
+}
+
+type requestStats struct {
+	requests uint64
+	inflight int
+	// in-flight requests integrated over time, in request seconds. its rate is the concurrency
+	busy    float64
+	changed time.Time
+}
+
+// requests and busy time of a function up to a point in time
+type requestSample struct {
+	at       time.Time
+	requests uint64
+	busy     float64
+}
+
+func NewRequestMetrics() *RequestMetrics {
+	labels := []string{"function", "function_namespace"}
+	return &RequestMetrics{
+		requests: promauto.NewCounterVec(
+			prometheus.CounterOpts{Name: "serverless_requests_total", Help: "Requests proxied to functions"},
+			labels,
+		),
+		inflight: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{Name: InflightRequestsMetric, Help: "Requests to functions being handled"},
+			labels,
+		),
+		functions: map[string]*requestStats{},
+	}
+}
+
+// Count a request to the function. done is called once it has been answered
+func (m *RequestMetrics) Begin(functionId string) (done func()) {
+	m.requests.WithLabelValues(functionId, constants.Namespace).Inc()
+	inflight := m.inflight.WithLabelValues(functionId, constants.Namespace)
+	inflight.Inc()
+	m.change(functionId, 1)
+	return func() {
+		inflight.Dec()
+		m.change(functionId, -1)
+	}
+}
+
+func (m *RequestMetrics) change(functionId string, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats, ok := m.functions[functionId]
+	if !ok {
+		stats = &requestStats{changed: time.Now()}
+		m.functions[functionId] = stats
+	}
+	now := time.Now()
+	stats.busy += float64(stats.inflight) * now.Sub(stats.changed).Seconds()
+	stats.changed = now
+	stats.inflight += delta
+	if delta > 0 {
+		stats.requests++
+	}
+}
+
+func (m *RequestMetrics) sample(functionId string) requestSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	stats, ok := m.functions[functionId]
+	if !ok {
+		return requestSample{at: now}
+	}
+	busy := stats.busy + float64(stats.inflight)*now.Sub(stats.changed).Seconds()
+	return requestSample{at: now, requests: stats.requests, busy: busy}
+}
+
+/*
+Average requests per second and concurrency of the function since an earlier sample. Returns the
+new sample to pass next time.
+*/
+func (m *RequestMetrics) since(functionId string, last requestSample) (float64, float64, requestSample) {
+	current := m.sample(functionId)
+	elapsed := current.at.Sub(last.at).Seconds()
+	if last.at.IsZero() || elapsed <= 0 {
+		return 0, 0, current
+	}
+	rps := float64(current.requests-last.requests) / elapsed
+	concurrency := (current.busy - last.busy) / elapsed
+	return rps, concurrency, current
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/models"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// used for what a function doesn't set itself. seconds, except the threshold
+const (
+	defaultProbePeriod           = 10
+	defaultProbeTimeout          = 1
+	defaultProbeFailureThreshold = 3
+	defaultStartupTimeout        = 60
+)
+
+/*
+Resolve the probes of a function. healthPath is the health endpoint of the runtime the running
+image was built with; a path set on the function wins. Without either the probes only check that
+the port accepts connections.
+*/
+func ResolveProbes(function *models.Function, port int32, healthPath string) (*kuberneteswrapper.ProbeOptions, error) {
+	if function.HealthPath != "" {
+		if !strings.HasPrefix(function.HealthPath, "/") {
+			return nil, fmt.Errorf("healthPath must start with /")
+		}
+		healthPath = function.HealthPath
+	}
+	if function.ProbePeriod < 0 ||
+		function.ProbeTimeout < 0 ||
+		function.ProbeFailureThreshold < 0 ||
+		function.StartupTimeout < 0 {
+		return nil, fmt.Errorf("probe settings must not be negative")
+	}
+
+	probes := &kuberneteswrapper.ProbeOptions{
+		Path:             healthPath,
+		Port:             port,
+		PeriodSeconds:    int32(orDefault(function.ProbePeriod, defaultProbePeriod)),
+		TimeoutSeconds:   int32(orDefault(function.ProbeTimeout, defaultProbeTimeout)),
+		FailureThreshold: int32(orDefault(function.ProbeFailureThreshold, defaultProbeFailureThreshold)),
+		StartupSeconds:   int32(orDefault(function.StartupTimeout, defaultStartupTimeout)),
+	}
+	if probes.TimeoutSeconds > probes.PeriodSeconds {
+		return nil, fmt.Errorf("probeTimeout %v is longer than probePeriod %v", probes.TimeoutSeconds, probes.PeriodSeconds)
+	}
+	return probes, nil
+}
+
+func orDefault(value int, fallback int) int {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+/*
+Resolve the probes of the function running the image of a revision. Revisions built before
+runtimes had health endpoints get a port check.
+*/
+func (fs *FunctionService) Probes(
+	function *models.Function,
+	port int32,
+	revision int,
+) (*kuberneteswrapper.ProbeOptions, error) {
+	var healthPath string
+	if target, err := fs.GetRevision(function.ID.String(), revision); err != nil {
+		return nil, err
+	} else if target != nil {
+		healthPath = target.HealthPath
+	}
+	return ResolveProbes(function, port, healthPath)
+}
+
+/*
+Apply probes to a deployed function. Its pods are replaced if they changed. Returns whether
+they are. A function that isn't deployed gets them on its first deploy.
+*/
+func (fs *FunctionService) ApplyProbes(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	functionId string,
+	probes *kuberneteswrapper.ProbeOptions,
+) (bool, error) {
+	restarted, err := kw.SetDeploymentProbes(ctx, namespace, functionId, probes)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return restarted, err
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/models"
+)
+
+func TestResolveProbes(t *testing.T) {
+	tests := []struct {
+		name       string
+		function   models.Function
+		healthPath string
+		want       kuberneteswrapper.ProbeOptions
+		err        string
+	}{
+		{
+			name: "defaults without a health endpoint",
+			want: kuberneteswrapper.ProbeOptions{
+				Port: 8080, PeriodSeconds: 10, TimeoutSeconds: 1, FailureThreshold: 3, StartupSeconds: 60,
+			},
+		},
+		{
+			name:       "runtime health endpoint",
+			healthPath: "/healthz",
+			want: kuberneteswrapper.ProbeOptions{
+				Path: "/healthz", Port: 8080, PeriodSeconds: 10, TimeoutSeconds: 1, FailureThreshold: 3, StartupSeconds: 60,
+			},
+		},
+		{
+			name:       "function health path wins",
+			function:   models.Function{HealthPath: "/ready"},
+			healthPath: "/healthz",
+			want: kuberneteswrapper.ProbeOptions{
+				Path: "/ready", Port: 8080, PeriodSeconds: 10, TimeoutSeconds: 1, FailureThreshold: 3, StartupSeconds: 60,
+			},
+		},
+		{
+			name: "function settings",
+			function: models.Function{
+				ProbePeriod: 5, ProbeTimeout: 5, ProbeFailureThreshold: 1, StartupTimeout: 300,
+			},
+			want: kuberneteswrapper.ProbeOptions{
+				Port: 8080, PeriodSeconds: 5, TimeoutSeconds: 5, FailureThreshold: 1, StartupSeconds: 300,
+			},
+		},
+		{
+			name:     "timeout longer than the default period",
+			function: models.Function{ProbeTimeout: 11},
+			err:      "probeTimeout 11 is longer than probePeriod 10",
+		},
+		{
+			name:     "period shorter than the default timeout",
+			function: models.Function{ProbePeriod: 1},
+			want: kuberneteswrapper.ProbeOptions{
+				Port: 8080, PeriodSeconds: 1, TimeoutSeconds: 1, FailureThreshold: 3, StartupSeconds: 60,
+			},
+		},
+		{name: "relative health path", function: models.Function{HealthPath: "healthz"}, err: "healthPath must start with /"},
+		{name: "negative period", function: models.Function{ProbePeriod: -1}, err: "must not be negative"},
+		{name: "negative timeout", function: models.Function{ProbeTimeout: -1}, err: "must not be negative"},
+		{name: "negative threshold", function: models.Function{ProbeFailureThreshold: -1}, err: "must not be negative"},
+		{name: "negative startup timeout", function: models.Function{StartupTimeout: -1}, err: "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveProbes(&tt.function, 8080, tt.healthPath)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ResolveProbes() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveProbes() error = %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("ResolveProbes() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
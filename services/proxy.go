@@ -1,6 +1,7 @@
 package services
 
 import (
+	"errors"
 	"log"
 
 	"github.com/Cloudbase-Project/serverless/models"
@@ -16,9 +17,13 @@ func NewProxyService(db *gorm.DB, l *log.Logger) *ProxyService {
 	return &ProxyService{db: db, l: l}
 }
 
+// Get the function requests are proxied to. nil if there is none
 func (ps *ProxyService) VerifyFunction(functionId string) (*models.Function, error) {
 	var function models.Function
-	if err := ps.db.Where(&models.Function{ID: function.ID}).First(&function).Error; err != nil {
+	if err := ps.db.Where("id = ?", functionId).First(&function).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
 		return nil, err
 	}
 	return &function, nil
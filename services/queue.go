@@ -0,0 +1,386 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+/*
+Runs a build to completion and returns it with its final status. ctx is cancelled when the
+build is cancelled.
+*/
+type BuildRunner func(ctx context.Context, build *models.Build) *models.Build
+
+// returned when cancelling a build that is already done
+var ErrBuildFinished = errors.New("build already finished")
+
+/*
+Queue of builds waiting for a builder. At most GlobalLimit builds run at once and at most
+ProjectLimit per project. Builds leave the queue in FIFO order, except that the project with the
+fewest running builds goes first, so one busy project can't starve the others.
+
+The queue lives in the builds table, so queued builds survive a restart.
+*/
+type BuildQueue struct {
+	db           *gorm.DB
+	l            *log.Logger
+	globalLimit  int
+	projectLimit int
+	run          BuildRunner
+
+	mu sync.Mutex
+	// running builds per project
+	running      map[uuid.UUID]int
+	runningTotal int
+	subscribers  map[uuid.UUID][]chan models.Build
+	// cancels the context of each running build
+	cancels map[uuid.UUID]context.CancelFunc
+	wake    chan struct{}
+}
+
+func NewBuildQueue(
+	db *gorm.DB,
+	l *log.Logger,
+	globalLimit int,
+	projectLimit int,
+	run BuildRunner,
+) *BuildQueue {
+	return &BuildQueue{
+		db:           db,
+		l:            l,
+		globalLimit:  globalLimit,
+		projectLimit: projectLimit,
+		run:          run,
+		running:      map[uuid.UUID]int{},
+		subscribers:  map[uuid.UUID][]chan models.Build{},
+		cancels:      map[uuid.UUID]context.CancelFunc{},
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+/*
+Start dispatching builds until ctx is done. Builds that were running when the server stopped are
+picked up again first.
+*/
+func (q *BuildQueue) Start(ctx context.Context) {
+	var interrupted models.Builds
+	q.db.Where("status = ?", string(constants.Building)).Find(&interrupted)
+	q.mu.Lock()
+	for _, build := range interrupted {
+		q.l.Print("Resuming build ", build.ID)
+		q.start(build)
+	}
+	q.mu.Unlock()
+
+	// the ticker is only a safety net. enqueue and finished builds wake the loop
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		q.dispatch()
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Queue a build of the function. The function is snapshotted as a new revision
+func (q *BuildQueue) Enqueue(
+	function *models.Function,
+	action constants.LastAction,
+) (*models.Build, error) {
+	build := models.Build{
+		FunctionID: function.ID,
+		ConfigID:   function.ConfigID,
+		Action:     string(action),
+		Status:     string(constants.Queued),
+	}
+	// the build and the revision it builds are created together
+	err := q.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&build).Error; err != nil {
+			return err
+		}
+		revision, err := createRevision(tx, function, &build)
+		if err != nil {
+			return err
+		}
+		build.Revision = revision.Number
+		return tx.Model(&build).Update("revision", revision.Number).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.notifyWake()
+	build.QueuePosition, _ = q.Position(build.ID)
+	return &build, nil
+}
+
+// 1 based position of a build in the queue. 0 if it is not queued
+func (q *BuildQueue) Position(buildId uuid.UUID) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued, err := q.queued()
+	if err != nil {
+		return 0, err
+	}
+	for i, build := range q.order(queued) {
+		if build.ID == buildId {
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+/*
+Get notified of the build's status changes. The channel receives the build when it starts and
+when it finishes and is closed after that. Call cancel to stop listening early.
+*/
+func (q *BuildQueue) Subscribe(buildId uuid.UUID) (<-chan models.Build, func()) {
+	ch := make(chan models.Build, 2)
+	q.mu.Lock()
+	q.subscribers[buildId] = append(q.subscribers[buildId], ch)
+	q.mu.Unlock()
+
+	cancel := func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		subs := q.subscribers[buildId]
+		for i, sub := range subs {
+			if sub == ch {
+				q.subscribers[buildId] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cancel
+}
+
+func (q *BuildQueue) notifyWake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send the build to its subscribers. closes their channels once the build is done. q.mu must be held
+func (q *BuildQueue) publish(build *models.Build) {
+	done := build.Status != string(constants.Queued) && build.Status != string(constants.Building)
+	for _, ch := range q.subscribers[build.ID] {
+		select {
+		case ch <- *build:
+		default:
+		}
+		if done {
+			close(ch)
+		}
+	}
+	if done {
+		delete(q.subscribers, build.ID)
+	}
+}
+
+// queued builds in FIFO order. q.mu must be held
+func (q *BuildQueue) queued() (models.Builds, error) {
+	var queued models.Builds
+	err := q.db.Where("status = ?", string(constants.Queued)).Order("created_at").Find(&queued).Error
+	return queued, err
+}
+
+/*
+The order the queued builds would start in if slots were free: the oldest build of the project
+with the fewest running builds goes first. q.mu must be held
+*/
+func (q *BuildQueue) order(queued models.Builds) models.Builds {
+	running := map[uuid.UUID]int{}
+	for project, n := range q.running {
+		running[project] = n
+	}
+	remaining := append(models.Builds{}, queued...)
+	ordered := make(models.Builds, 0, len(queued))
+	for len(remaining) > 0 {
+		next := 0
+		for i, build := range remaining {
+			if running[build.ConfigID] < running[remaining[next].ConfigID] {
+				next = i
+			}
+		}
+		running[remaining[next].ConfigID]++
+		ordered = append(ordered, remaining[next])
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return ordered
+}
+
+// start as many queued builds as the limits allow
+func (q *BuildQueue) dispatch() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queued, err := q.queued()
+	if err != nil {
+		q.l.Print("Error reading build queue : ", err)
+		return
+	}
+	for _, build := range q.order(queued) {
+		if q.runningTotal >= q.globalLimit {
+			return
+		}
+		if q.running[build.ConfigID] >= q.projectLimit {
+			continue
+		}
+		now := time.Now()
+		// claim the build. it may have been removed from the queue in the meantime
+		result := q.db.Model(&models.Build{}).
+			Where("id = ? AND status = ?", build.ID, string(constants.Queued)).
+			Updates(map[string]interface{}{"status": string(constants.Building), "started_at": now})
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+		build.Status = string(constants.Building)
+		build.StartedAt = &now
+		q.start(build)
+	}
+}
+
+// run the build in the background. q.mu must be held
+func (q *BuildQueue) start(build *models.Build) {
+	q.running[build.ConfigID]++
+	q.runningTotal++
+	// not derived from Start's context. builds keep running through a shutdown and are resumed
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancels[build.ID] = cancel
+	q.publish(build)
+
+	go func() {
+		finished := q.safeRun(ctx, build)
+
+		q.mu.Lock()
+		cancel()
+		delete(q.cancels, build.ID)
+		q.running[build.ConfigID]--
+		if q.running[build.ConfigID] == 0 {
+			delete(q.running, build.ConfigID)
+		}
+		q.runningTotal--
+		q.publish(finished)
+		q.mu.Unlock()
+		q.notifyWake()
+	}()
+}
+
+// run the build. a panicking runner fails the build instead of leaking its slot
+func (q *BuildQueue) safeRun(ctx context.Context, build *models.Build) (finished *models.Build) {
+	defer func() {
+		if r := recover(); r != nil {
+			q.l.Print("Build ", build.ID, " panicked : ", r)
+			now := time.Now()
+			build.Status = string(constants.BuildFailed)
+			build.FailReason = "Internal error"
+			build.FinishedAt = &now
+			q.db.Save(build)
+			finished = build
+		}
+	}()
+	finished = q.run(ctx, build)
+	if finished == nil {
+		return build
+	}
+	return finished
+}
+
+// Get a build of the function
+func (q *BuildQueue) GetBuild(functionId string, buildId string) (*models.Build, error) {
+	var build models.Build
+	err := q.db.Where("id = ? AND function_id = ?", buildId, functionId).First(&build).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if build.Status == string(constants.Queued) {
+		build.QueuePosition, _ = q.Position(build.ID)
+	}
+	return &build, nil
+}
+
+/*
+Cancel a build of the function. A queued build is taken off the queue and marked Cancelled
+right away. A running build has its context cancelled; the runner stops the builder and records
+the outcome. Returns nil if there is no such build and ErrBuildFinished if it is already done.
+*/
+func (q *BuildQueue) Cancel(functionId string, buildId string) (*models.Build, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var build models.Build
+	err := q.db.Where("id = ? AND function_id = ?", buildId, functionId).First(&build).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cancel, ok := q.cancels[build.ID]; ok {
+		cancel()
+		return &build, nil
+	}
+	if build.Status != string(constants.Queued) {
+		return &build, ErrBuildFinished
+	}
+
+	now := time.Now()
+	reason := "Cancelled before it started"
+	err = q.db.Transaction(func(tx *gorm.DB) error {
+		// the build may have been dispatched since it was read
+		result := tx.Model(&models.Build{}).
+			Where("id = ? AND status = ?", build.ID, string(constants.Queued)).
+			Updates(map[string]interface{}{
+				"status":      string(constants.BuildCancelled),
+				"fail_reason": reason,
+				"finished_at": now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrBuildFinished
+		}
+		err := tx.Model(&models.FunctionRevision{}).
+			Where("function_id = ? AND number = ?", build.FunctionID, build.Revision).
+			Updates(map[string]interface{}{
+				"build_status":      string(constants.BuildCancelled),
+				"build_fail_reason": reason,
+			}).Error
+		if err != nil {
+			return err
+		}
+		// leave the function alone if another build of it has started since
+		return tx.Model(&models.Function{}).
+			Where("id = ? AND build_status = ?", build.FunctionID, string(constants.Queued)).
+			Updates(map[string]interface{}{
+				"build_status":      string(constants.BuildCancelled),
+				"build_fail_reason": reason,
+			}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	build.Status = string(constants.BuildCancelled)
+	build.FailReason = reason
+	build.FinishedAt = &now
+	q.publish(&build)
+	return &build, nil
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/google/uuid"
+)
+
+func TestBuildQueueOrder(t *testing.T) {
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+	// queued builds in FIFO order, named by project and position within it
+	names := map[*models.Build]string{}
+	build := func(project uuid.UUID, name string) *models.Build {
+		b := &models.Build{ID: uuid.New(), ConfigID: project}
+		names[b] = name
+		return b
+	}
+	a1, a2, a3 := build(a, "a1"), build(a, "a2"), build(a, "a3")
+	b1, b2 := build(b, "b1"), build(b, "b2")
+	c1, c2 := build(c, "c1"), build(c, "c2")
+
+	tests := []struct {
+		name    string
+		running map[uuid.UUID]int
+		queued  models.Builds
+		want    models.Builds
+	}{
+		{
+			name:   "empty",
+			queued: models.Builds{},
+			want:   models.Builds{},
+		},
+		{
+			name:   "one project keeps FIFO order",
+			queued: models.Builds{a1, a2, a3},
+			want:   models.Builds{a1, a2, a3},
+		},
+		{
+			name:   "projects take turns",
+			queued: models.Builds{a1, a2, a3, b1, b2, c1},
+			want:   models.Builds{a1, b1, c1, a2, b2, a3},
+		},
+		{
+			name:    "project with running builds goes last",
+			running: map[uuid.UUID]int{a: 1},
+			queued:  models.Builds{a1, a2, b1},
+			want:    models.Builds{b1, a1, a2},
+		},
+		{
+			// the oldest build wins a tie between projects with as many running builds
+			name:    "running builds count against each project",
+			running: map[uuid.UUID]int{a: 2, b: 1},
+			queued:  models.Builds{a1, b1, c1, c2},
+			want:    models.Builds{c1, b1, c2, a1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewBuildQueue(nil, nil, 10, 10, nil)
+			for project, n := range tt.running {
+				q.running[project] = n
+			}
+			got := q.order(tt.queued)
+			if len(got) != len(tt.want) {
+				t.Fatalf("order() returned %v builds, want %v", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("order()[%v] = %v, want %v", i, names[got[i]], names[tt.want[i]])
+				}
+			}
+			// order only looks at the running builds, it doesn't change them
+			for project, n := range q.running {
+				if tt.running[project] != n {
+					t.Errorf("order() changed the running builds of %v to %v", project, n)
+				}
+			}
+		})
+	}
+}
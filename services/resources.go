@@ -0,0 +1,310 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// used for what a function doesn't set itself
+const (
+	defaultCPURequest  = "250m"
+	defaultMinReplicas = 1
+	defaultMaxReplicas = 3
+	defaultTargetCPU   = 15
+)
+
+// per pod targets of the request metrics when a function doesn't set one
+var defaultScalingTargets = map[constants.ScalingMetric]int32{
+	constants.ConcurrencyMetric: 10,
+	constants.RPSMetric:         20,
+}
+
+// What a function's deployment and hpa run with, after defaults and the project's maximums
+type FunctionResources struct {
+	Requirements corev1.ResourceRequirements
+	MinReplicas  int32
+	MaxReplicas  int32
+	// average cpu utilization the hpa scales at, percent of the cpu request
+	TargetCPU int32
+	Scaler    constants.Scaler
+	Metric    constants.ScalingMetric
+	// per pod value of a request metric to scale at
+	Target int32
+}
+
+/*
+Resolve the function's resource spec against its project's maximums. Limits that aren't set
+default to the project's maximum, so every function stays within it. Errors describe what is
+invalid or above the maximum.
+*/
+func ResolveResources(function *models.Function, config *models.Config) (*FunctionResources, error) {
+	resources := &FunctionResources{
+		Requirements: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{},
+			Limits:   corev1.ResourceList{},
+		},
+	}
+	err := resolveResource(
+		resources.Requirements,
+		corev1.ResourceCPU,
+		function.CPURequest,
+		function.CPULimit,
+		defaultCPURequest,
+		config.MaxCPU,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = resolveResource(
+		resources.Requirements,
+		corev1.ResourceMemory,
+		function.MemoryRequest,
+		function.MemoryLimit,
+		"",
+		config.MaxMemory,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	minReplicas := function.MinReplicas
+	if minReplicas == 0 {
+		minReplicas = defaultMinReplicas
+	}
+	maxReplicas := function.MaxReplicas
+	if maxReplicas == 0 {
+		maxReplicas = defaultMaxReplicas
+		if config.MaxReplicas > 0 && maxReplicas > config.MaxReplicas {
+			maxReplicas = config.MaxReplicas
+		}
+		if maxReplicas < minReplicas {
+			maxReplicas = minReplicas
+		}
+	}
+	if minReplicas < 1 {
+		return nil, fmt.Errorf("minReplicas must be at least 1")
+	}
+	if maxReplicas < minReplicas {
+		return nil, fmt.Errorf("maxReplicas %v is below minReplicas %v", maxReplicas, minReplicas)
+	}
+	if config.MaxReplicas > 0 && maxReplicas > config.MaxReplicas {
+		return nil, fmt.Errorf("maxReplicas %v is above the project's max of %v", maxReplicas, config.MaxReplicas)
+	}
+	resources.MinReplicas = int32(minReplicas)
+	resources.MaxReplicas = int32(maxReplicas)
+
+	resources.TargetCPU = int32(function.TargetCPU)
+	if resources.TargetCPU == 0 {
+		resources.TargetCPU = defaultTargetCPU
+	}
+	if resources.TargetCPU < 1 || resources.TargetCPU > 100 {
+		return nil, fmt.Errorf("targetCpu must be between 1 and 100")
+	}
+
+	if err := resolveScaling(function, resources); err != nil {
+		return nil, err
+	}
+
+	// the api server drops empty lists. keep them nil so comparing with a deployment works
+	if len(resources.Requirements.Limits) == 0 {
+		resources.Requirements.Limits = nil
+	}
+	return resources, nil
+}
+
+// pick the scaler and the metric it scales on
+func resolveScaling(function *models.Function, resources *FunctionResources) error {
+	resources.Metric = constants.ScalingMetric(function.ScalingMetric)
+	if resources.Metric == "" {
+		resources.Metric = constants.CPUMetric
+	}
+	resources.Scaler = constants.Scaler(function.Scaler)
+	if resources.Scaler == "" {
+		resources.Scaler = constants.HPAScaler
+	}
+
+	switch resources.Metric {
+	case constants.CPUMetric:
+		if resources.Scaler == constants.BuiltinScaler {
+			return fmt.Errorf("the %v scaler scales on Concurrency or RPS", constants.BuiltinScaler)
+		}
+		return nil
+	case constants.ConcurrencyMetric, constants.RPSMetric:
+	default:
+		return fmt.Errorf("unknown scaling metric %v", resources.Metric)
+	}
+	switch resources.Scaler {
+	case constants.HPAScaler, constants.BuiltinScaler:
+	default:
+		return fmt.Errorf("unknown scaler %v", resources.Scaler)
+	}
+
+	resources.Target = int32(function.ScalingTarget)
+	if resources.Target == 0 {
+		resources.Target = defaultScalingTargets[resources.Metric]
+	}
+	if resources.Target < 0 {
+		return fmt.Errorf("scalingTarget must be positive")
+	}
+	return nil
+}
+
+/*
+Parse the request and limit of one resource into requirements. fallback is the request when
+none is set; it is lowered to the limit if that is smaller. Empty values are left out.
+*/
+func resolveResource(
+	requirements corev1.ResourceRequirements,
+	name corev1.ResourceName,
+	request string,
+	limit string,
+	fallback string,
+	max string,
+) error {
+	maxQuantity, err := parseQuantity(name, "project max", max)
+	if err != nil {
+		return err
+	}
+	requestQuantity, err := parseQuantity(name, "request", request)
+	if err != nil {
+		return err
+	}
+	limitQuantity, err := parseQuantity(name, "limit", limit)
+	if err != nil {
+		return err
+	}
+
+	if limitQuantity == nil {
+		limitQuantity = maxQuantity
+	}
+	if requestQuantity == nil && fallback != "" {
+		quantity := resource.MustParse(fallback)
+		requestQuantity = &quantity
+		if limitQuantity != nil && requestQuantity.Cmp(*limitQuantity) > 0 {
+			requestQuantity = limitQuantity
+		}
+	}
+
+	if requestQuantity != nil && maxQuantity != nil && requestQuantity.Cmp(*maxQuantity) > 0 {
+		return fmt.Errorf("%v request %v is above the project's max of %v", name, requestQuantity, maxQuantity)
+	}
+	if limitQuantity != nil && maxQuantity != nil && limitQuantity.Cmp(*maxQuantity) > 0 {
+		return fmt.Errorf("%v limit %v is above the project's max of %v", name, limitQuantity, maxQuantity)
+	}
+	if requestQuantity != nil && limitQuantity != nil && requestQuantity.Cmp(*limitQuantity) > 0 {
+		return fmt.Errorf("%v request %v is above its limit %v", name, requestQuantity, limitQuantity)
+	}
+
+	if requestQuantity != nil {
+		requirements.Requests[name] = *requestQuantity
+	}
+	if limitQuantity != nil {
+		requirements.Limits[name] = *limitQuantity
+	}
+	return nil
+}
+
+// nil for an empty value
+func parseQuantity(name corev1.ResourceName, what string, value string) (*resource.Quantity, error) {
+	if value == "" {
+		return nil, nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid %v %v %v", name, what, value)
+	}
+	return &quantity, nil
+}
+
+// Resolve the function's resources against the project it belongs to
+func (fs *FunctionService) Resources(function *models.Function) (*FunctionResources, error) {
+	var config models.Config
+	if err := fs.db.Unscoped().First(&config, "id = ?", function.ConfigID).Error; err != nil {
+		return nil, err
+	}
+	return ResolveResources(function, &config)
+}
+
+// the function's hpa with the resolved bounds
+func (r *FunctionResources) hpaOptions(
+	ctx context.Context,
+	namespace string,
+	functionId string,
+) *kuberneteswrapper.HPAOptions {
+	options := &kuberneteswrapper.HPAOptions{
+		Ctx:         ctx,
+		Namespace:   namespace,
+		FunctionId:  functionId,
+		MinReplicas: r.MinReplicas,
+		MaxReplicas: r.MaxReplicas,
+		TargetCPU:   r.TargetCPU,
+		TargetValue: r.Target,
+	}
+	switch r.Metric {
+	case constants.ConcurrencyMetric:
+		options.MetricName = InflightRequestsMetric
+	case constants.RPSMetric:
+		options.MetricName = RequestsPerSecondMetric
+	}
+	return options
+}
+
+/*
+Create or update the function's hpa. Functions scaled by the builtin scaler have none, so the
+two never fight over the replicas.
+*/
+func (fs *FunctionService) applyScaler(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	functionId string,
+	resources *FunctionResources,
+) error {
+	if resources.Scaler == constants.BuiltinScaler {
+		return kw.DeleteHPA(&kuberneteswrapper.DeleteOptions{Ctx: ctx, Name: functionId, Namespace: namespace})
+	}
+	return kw.ApplyHPA(resources.hpaOptions(ctx, namespace, functionId))
+}
+
+/*
+Apply resolved resources to a deployed function. Its pods are replaced if the cpu or memory
+changed; the hpa's bounds change in place. Returns whether the pods are replaced. A function
+that isn't deployed gets them on its first deploy.
+*/
+func (fs *FunctionService) ApplyResources(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	functionId string,
+	resources *FunctionResources,
+) (bool, error) {
+	restarted, err := kw.SetDeploymentResources(ctx, namespace, functionId, resources.Requirements)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return restarted, fs.applyScaler(kw, ctx, namespace, functionId, resources)
+}
+
+// Check a project's maximums before they are stored
+func ValidateProjectMaximums(maxCPU string, maxMemory string, maxReplicas int) error {
+	if _, err := parseQuantity(corev1.ResourceCPU, "project max", maxCPU); err != nil {
+		return err
+	}
+	if _, err := parseQuantity(corev1.ResourceMemory, "project max", maxMemory); err != nil {
+		return err
+	}
+	if maxReplicas < 0 {
+		return fmt.Errorf("invalid project max replicas %v", maxReplicas)
+	}
+	return nil
+}
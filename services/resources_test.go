@@ -0,0 +1,283 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestResolveResources(t *testing.T) {
+	// quantities of a resource list by name. missing ones are empty
+	quantities := func(list corev1.ResourceList) map[corev1.ResourceName]string {
+		got := map[corev1.ResourceName]string{}
+		for name, quantity := range list {
+			got[name] = quantity.String()
+		}
+		return got
+	}
+	type want struct {
+		requests    map[corev1.ResourceName]string
+		limits      map[corev1.ResourceName]string
+		minReplicas int32
+		maxReplicas int32
+		targetCPU   int32
+		scaler      constants.Scaler
+		metric      constants.ScalingMetric
+		target      int32
+	}
+
+	tests := []struct {
+		name     string
+		function models.Function
+		config   models.Config
+		want     want
+		err      string
+	}{
+		{
+			name: "defaults without project maximums",
+			want: want{
+				requests:    map[corev1.ResourceName]string{corev1.ResourceCPU: "250m"},
+				limits:      map[corev1.ResourceName]string{},
+				minReplicas: 1,
+				maxReplicas: 3,
+				targetCPU:   15,
+				scaler:      constants.HPAScaler,
+				metric:      constants.CPUMetric,
+			},
+		},
+		{
+			name:   "limits default to the project maximums",
+			config: models.Config{MaxCPU: "1", MaxMemory: "512Mi", MaxReplicas: 2},
+			want: want{
+				requests:    map[corev1.ResourceName]string{corev1.ResourceCPU: "250m"},
+				limits:      map[corev1.ResourceName]string{corev1.ResourceCPU: "1", corev1.ResourceMemory: "512Mi"},
+				minReplicas: 1,
+				maxReplicas: 2,
+				targetCPU:   15,
+				scaler:      constants.HPAScaler,
+				metric:      constants.CPUMetric,
+			},
+		},
+		{
+			name:   "default cpu request is lowered to a smaller max",
+			config: models.Config{MaxCPU: "100m"},
+			want: want{
+				requests:    map[corev1.ResourceName]string{corev1.ResourceCPU: "100m"},
+				limits:      map[corev1.ResourceName]string{corev1.ResourceCPU: "100m"},
+				minReplicas: 1,
+				maxReplicas: 3,
+				targetCPU:   15,
+				scaler:      constants.HPAScaler,
+				metric:      constants.CPUMetric,
+			},
+		},
+		{
+			name: "set by the function within the maximums",
+			function: models.Function{
+				CPURequest:    "500m",
+				CPULimit:      "1",
+				MemoryRequest: "128Mi",
+				MemoryLimit:   "256Mi",
+				MinReplicas:   2,
+				MaxReplicas:   5,
+				TargetCPU:     60,
+			},
+			config: models.Config{MaxCPU: "2", MaxMemory: "1Gi", MaxReplicas: 5},
+			want: want{
+				requests:    map[corev1.ResourceName]string{corev1.ResourceCPU: "500m", corev1.ResourceMemory: "128Mi"},
+				limits:      map[corev1.ResourceName]string{corev1.ResourceCPU: "1", corev1.ResourceMemory: "256Mi"},
+				minReplicas: 2,
+				maxReplicas: 5,
+				targetCPU:   60,
+				scaler:      constants.HPAScaler,
+				metric:      constants.CPUMetric,
+			},
+		},
+		{
+			name:     "default max replicas is raised to min replicas",
+			function: models.Function{MinReplicas: 4},
+			want: want{
+				requests:    map[corev1.ResourceName]string{corev1.ResourceCPU: "250m"},
+				limits:      map[corev1.ResourceName]string{},
+				minReplicas: 4,
+				maxReplicas: 4,
+				targetCPU:   15,
+				scaler:      constants.HPAScaler,
+				metric:      constants.CPUMetric,
+			},
+		},
+		{
+			name:     "request metric with the default target",
+			function: models.Function{ScalingMetric: string(constants.RPSMetric), Scaler: string(constants.BuiltinScaler)},
+			want: want{
+				requests:    map[corev1.ResourceName]string{corev1.ResourceCPU: "250m"},
+				limits:      map[corev1.ResourceName]string{},
+				minReplicas: 1,
+				maxReplicas: 3,
+				targetCPU:   15,
+				scaler:      constants.BuiltinScaler,
+				metric:      constants.RPSMetric,
+				target:      20,
+			},
+		},
+		{
+			name:     "request metric with its own target",
+			function: models.Function{ScalingMetric: string(constants.ConcurrencyMetric), ScalingTarget: 4},
+			want: want{
+				requests:    map[corev1.ResourceName]string{corev1.ResourceCPU: "250m"},
+				limits:      map[corev1.ResourceName]string{},
+				minReplicas: 1,
+				maxReplicas: 3,
+				targetCPU:   15,
+				scaler:      constants.HPAScaler,
+				metric:      constants.ConcurrencyMetric,
+				target:      4,
+			},
+		},
+		{
+			name:     "cpu request above the max",
+			function: models.Function{CPURequest: "2"},
+			config:   models.Config{MaxCPU: "1"},
+			err:      "cpu request 2 is above the project's max of 1",
+		},
+		{
+			name:     "memory limit above the max",
+			function: models.Function{MemoryLimit: "2Gi"},
+			config:   models.Config{MaxMemory: "1Gi"},
+			err:      "memory limit 2Gi is above the project's max of 1Gi",
+		},
+		{
+			name:     "request above the limit",
+			function: models.Function{MemoryRequest: "512Mi", MemoryLimit: "256Mi"},
+			err:      "memory request 512Mi is above its limit 256Mi",
+		},
+		{
+			name:     "invalid quantity",
+			function: models.Function{CPURequest: "lots"},
+			err:      "invalid cpu request lots",
+		},
+		{
+			name:     "negative quantity",
+			function: models.Function{MemoryLimit: "-1Gi"},
+			err:      "invalid memory limit -1Gi",
+		},
+		{
+			name:     "max replicas below min replicas",
+			function: models.Function{MinReplicas: 3, MaxReplicas: 2},
+			err:      "maxReplicas 2 is below minReplicas 3",
+		},
+		{
+			name:     "max replicas above the project's max",
+			function: models.Function{MaxReplicas: 10},
+			config:   models.Config{MaxReplicas: 5},
+			err:      "maxReplicas 10 is above the project's max of 5",
+		},
+		{
+			name:     "min replicas above the project's max",
+			function: models.Function{MinReplicas: 6},
+			config:   models.Config{MaxReplicas: 5},
+			err:      "maxReplicas 6 is above the project's max of 5",
+		},
+		{
+			name:     "negative min replicas",
+			function: models.Function{MinReplicas: -1},
+			err:      "minReplicas must be at least 1",
+		},
+		{
+			name:     "target cpu out of range",
+			function: models.Function{TargetCPU: 101},
+			err:      "targetCpu must be between 1 and 100",
+		},
+		{
+			name:     "builtin scaler on cpu",
+			function: models.Function{Scaler: string(constants.BuiltinScaler)},
+			err:      "scales on Concurrency or RPS",
+		},
+		{
+			name:     "unknown metric",
+			function: models.Function{ScalingMetric: "Memory"},
+			err:      "unknown scaling metric Memory",
+		},
+		{
+			name:     "unknown scaler",
+			function: models.Function{ScalingMetric: string(constants.RPSMetric), Scaler: "KEDA"},
+			err:      "unknown scaler KEDA",
+		},
+		{
+			name:     "negative scaling target",
+			function: models.Function{ScalingMetric: string(constants.RPSMetric), ScalingTarget: -5},
+			err:      "scalingTarget must be positive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveResources(&tt.function, &tt.config)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ResolveResources() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveResources() error = %v", err)
+			}
+			requests := quantities(got.Requirements.Requests)
+			limits := quantities(got.Requirements.Limits)
+			for _, check := range []struct {
+				what      string
+				got, want map[corev1.ResourceName]string
+			}{{"requests", requests, tt.want.requests}, {"limits", limits, tt.want.limits}} {
+				if len(check.got) != len(check.want) {
+					t.Errorf("%v = %v, want %v", check.what, check.got, check.want)
+					continue
+				}
+				for name, quantity := range check.want {
+					if check.got[name] != quantity {
+						t.Errorf("%v = %v, want %v", check.what, check.got, check.want)
+					}
+				}
+			}
+			// empty limits are nil so comparing with a deployment works
+			if len(tt.want.limits) == 0 && got.Requirements.Limits != nil {
+				t.Errorf("limits = %#v, want nil", got.Requirements.Limits)
+			}
+			if got.MinReplicas != tt.want.minReplicas || got.MaxReplicas != tt.want.maxReplicas {
+				t.Errorf("replicas = %v-%v, want %v-%v", got.MinReplicas, got.MaxReplicas, tt.want.minReplicas, tt.want.maxReplicas)
+			}
+			if got.TargetCPU != tt.want.targetCPU {
+				t.Errorf("TargetCPU = %v, want %v", got.TargetCPU, tt.want.targetCPU)
+			}
+			if got.Scaler != tt.want.scaler || got.Metric != tt.want.metric || got.Target != tt.want.target {
+				t.Errorf("scaling = %v on %v at %v, want %v on %v at %v",
+					got.Scaler, got.Metric, got.Target, tt.want.scaler, tt.want.metric, tt.want.target)
+			}
+		})
+	}
+}
+
+func TestValidateProjectMaximums(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxCPU      string
+		maxMemory   string
+		maxReplicas int
+		wantErr     bool
+	}{
+		{name: "unlimited"},
+		{name: "all set", maxCPU: "2", maxMemory: "1Gi", maxReplicas: 10},
+		{name: "invalid cpu", maxCPU: "two", wantErr: true},
+		{name: "zero memory", maxMemory: "0", wantErr: true},
+		{name: "negative replicas", maxReplicas: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateProjectMaximums(tt.maxCPU, tt.maxMemory, tt.maxReplicas)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateProjectMaximums() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
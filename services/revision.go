@@ -0,0 +1,166 @@
+package services
+
+import (
+	"errors"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+Snapshot the function as the next revision, built by build. Meant to run in the transaction
+that creates the build. The function row is locked so concurrent builds get distinct numbers.
+*/
+func createRevision(
+	tx *gorm.DB,
+	function *models.Function,
+	build *models.Build,
+) (*models.FunctionRevision, error) {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").
+		First(&models.Function{}, "id = ?", function.ID).Error; err != nil {
+		return nil, err
+	}
+	var last int
+	err := tx.Unscoped().
+		Model(&models.FunctionRevision{}).
+		Where("function_id = ?", function.ID).
+		Select("COALESCE(MAX(number), 0)").
+		Scan(&last).Error
+	if err != nil {
+		return nil, err
+	}
+
+	revision := models.FunctionRevision{
+		FunctionID:      function.ID,
+		Number:          last + 1,
+		BuildID:         build.ID,
+		Code:            function.Code,
+		SourceType:      function.SourceType,
+		SourceArchiveID: function.SourceArchiveID,
+		GitURL:          function.GitURL,
+		GitRef:          function.GitRef,
+		GitSubdirectory: function.GitSubdirectory,
+		Language:        function.Language,
+		Dependencies:    function.Dependencies,
+		Lockfile:        function.Lockfile,
+		BuildStatus:     string(constants.Queued),
+	}
+	if err := tx.Create(&revision).Error; err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// Revisions of a function, newest first
+func (fs *FunctionService) GetRevisions(functionId string) (models.FunctionRevisions, error) {
+	var revisions models.FunctionRevisions
+	err := fs.db.Where("function_id = ?", functionId).Order("number desc").Find(&revisions).Error
+	for _, revision := range revisions {
+		revision.CanRollback = canRollback(revision)
+	}
+	return revisions, err
+}
+
+// built successfully and the image is still in the registry
+func canRollback(revision *models.FunctionRevision) bool {
+	return revision.BuildStatus == string(constants.BuildSuccess) && revision.ImageDeletedAt == nil
+}
+
+// A revision of a function by number. nil if there is none
+func (fs *FunctionService) GetRevision(functionId string, number int) (*models.FunctionRevision, error) {
+	var revision models.FunctionRevision
+	err := fs.db.Where("function_id = ? AND number = ?", functionId, number).First(&revision).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	revision.CanRollback = canRollback(&revision)
+	return &revision, nil
+}
+
+// The newest revision of a function, built or not. nil if there is none
+func (fs *FunctionService) LatestRevision(functionId string) (*models.FunctionRevision, error) {
+	var revision models.FunctionRevision
+	err := fs.db.Where("function_id = ?", functionId).Order("number desc").First(&revision).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+/*
+The newest successfully built revision older than before whose image hasn't been garbage
+collected. nil if there is none
+*/
+func (fs *FunctionService) PreviousRevision(functionId string, before int) (*models.FunctionRevision, error) {
+	var revision models.FunctionRevision
+	err := fs.db.
+		Where("function_id = ? AND number < ? AND build_status = ?", functionId, before, constants.BuildSuccess).
+		Where("image_deleted_at IS NULL").
+		Order("number desc").
+		First(&revision).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	revision.CanRollback = true
+	return &revision, nil
+}
+
+// The revision a build builds. Builds queued before revisions existed get one on the spot
+func (fs *FunctionService) revisionForBuild(
+	function *models.Function,
+	build *models.Build,
+) (*models.FunctionRevision, error) {
+	var revision models.FunctionRevision
+	err := fs.db.Where("build_id = ?", build.ID).First(&revision).Error
+	if err == nil {
+		return &revision, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	var created *models.FunctionRevision
+	err = fs.db.Transaction(func(tx *gorm.DB) error {
+		created, err = createRevision(tx, function, build)
+		return err
+	})
+	return created, err
+}
+
+// The function as it was at the revision. Used to read the revision's source
+func revisionSource(function *models.Function, revision *models.FunctionRevision) *models.Function {
+	snapshot := *function
+	snapshot.Code = revision.Code
+	snapshot.SourceType = revision.SourceType
+	snapshot.SourceArchiveID = revision.SourceArchiveID
+	snapshot.GitURL = revision.GitURL
+	snapshot.GitRef = revision.GitRef
+	// rebuilding a revision builds the commit it was built from
+	if revision.GitCommit != "" {
+		snapshot.GitRef = revision.GitCommit
+	}
+	snapshot.GitSubdirectory = revision.GitSubdirectory
+	snapshot.Language = revision.Language
+	snapshot.Dependencies = revision.Dependencies
+	snapshot.Lockfile = revision.Lockfile
+	return &snapshot
+}
+
+// pinned image reference of a revision. falls back to the tag when the digest is unknown
+func revisionImageRef(revision *models.FunctionRevision) string {
+	if revision.Digest == "" {
+		return revision.Image
+	}
+	return revision.Image + "@" + revision.Digest
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"gorm.io/gorm"
+)
+
+// Record the start of a deployment change made by job. A resumed job gets its existing rollout back
+func (fs *FunctionService) startRollout(
+	function *models.Function,
+	job *models.Job,
+	revision int,
+	image string,
+) (*models.Rollout, error) {
+	var rollout models.Rollout
+	err := fs.db.Where("job_id = ?", job.ID).First(&rollout).Error
+	if err == nil {
+		return &rollout, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	rollout = models.Rollout{
+		FunctionID: function.ID,
+		JobID:      job.ID,
+		Action:     job.Type,
+		Revision:   revision,
+		Image:      image,
+		Status:     string(constants.Deploying),
+	}
+	if err := fs.db.Create(&rollout).Error; err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
+
+// record the outcome of a rollout
+func (fs *FunctionService) finishRollout(rollout *models.Rollout, result WatchResult) {
+	now := time.Now()
+	rollout.Status = result.Status
+	rollout.FailReason = result.Reason
+	rollout.FinishedAt = &now
+	fs.db.Save(rollout)
+}
+
+// Deployment history of a function, newest first
+func (fs *FunctionService) GetRollouts(functionId string) (models.Rollouts, error) {
+	var rollouts models.Rollouts
+	err := fs.db.Where("function_id = ?", functionId).Order("created_at desc").Find(&rollouts).Error
+	return rollouts, err
+}
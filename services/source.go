@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/runtimes"
+	"github.com/Cloudbase-Project/serverless/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Everything the image builder needs from the function's source
+type BuildSource struct {
+	// inline code. empty when building from an archive or git
+	Code string
+	// normalized source archive. nil when building inline code or git
+	Archive []byte
+	// repository the builder fetches. nil when building inline code or an archive
+	Git *kuberneteswrapper.GitSource
+	// validated dependency manifest and lockfile. path -> content
+	DependencyFiles map[string]string
+	// dependency files a git source gets when its repository has none. path -> content
+	DefaultFiles map[string]string
+}
+
+// Store a normalized archive and make it the function's source.
+func (fs *FunctionService) SaveSourceArchive(
+	function *models.Function,
+	data []byte,
+	files int,
+) (*models.SourceArchive, error) {
+	sum := sha256.Sum256(data)
+	archive := models.SourceArchive{
+		FunctionID: function.ID,
+		Data:       data,
+		Size:       len(data),
+		Files:      files,
+		Checksum:   hex.EncodeToString(sum[:]),
+	}
+	if err := fs.db.Create(&archive).Error; err != nil {
+		return nil, err
+	}
+
+	function.Code = ""
+	function.SourceType = string(constants.ArchiveSource)
+	function.SourceArchiveID = &archive.ID
+	if err := fs.db.Save(function).Error; err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
+
+/*
+Make a subdirectory of a git repository the function's source. Every build fetches the ref again.
+The function's git credentials are replaced with username and token, or removed without a token.
+*/
+func (fs *FunctionService) SetGitSource(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	function *models.Function,
+	repository string,
+	ref string,
+	subdirectory string,
+	username string,
+	token string,
+) error {
+	if err := utils.ValidateGitSource(repository, ref, subdirectory); err != nil {
+		return err
+	}
+	name := kuberneteswrapper.GitCredentialsName(function.ID.String())
+	var err error
+	if token == "" {
+		err = kw.DeleteSecret(&kuberneteswrapper.DeleteOptions{Ctx: ctx, Name: name, Namespace: namespace})
+	} else {
+		if username == "" {
+			// what git hosts expect along with an access token
+			username = "git"
+		}
+		err = kw.ApplySecret(ctx, namespace, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"function": function.ID.String()}},
+			Type:       corev1.SecretTypeOpaque,
+			Data:       map[string][]byte{"username": []byte(username), "token": []byte(token)},
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	subdirectory, _ = utils.GitSubdirectory(subdirectory)
+	function.Code = ""
+	function.SourceType = string(constants.GitSource)
+	function.GitURL = repository
+	function.GitRef = ref
+	function.GitSubdirectory = subdirectory
+	return fs.db.Save(function).Error
+}
+
+/*
+Give the function a new random webhook secret, which replaces the old one. With autoDeploy
+builds triggered by a push are deployed once they succeed.
+*/
+func (fs *FunctionService) RotateWebhookSecret(function *models.Function, autoDeploy bool) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	function.WebhookSecret = hex.EncodeToString(secret)
+	function.AutoDeploy = autoDeploy
+	if err := fs.db.Save(function).Error; err != nil {
+		return "", err
+	}
+	return function.WebhookSecret, nil
+}
+
+// the uploaded archive of an archive source
+func (fs *FunctionService) sourceArchive(function *models.Function) ([]byte, error) {
+	if function.SourceArchiveID == nil {
+		return nil, errors.New("no source archive uploaded")
+	}
+	var archive models.SourceArchive
+	if err := fs.db.First(&archive, "id = ?", function.SourceArchiveID).Error; err != nil {
+		return nil, err
+	}
+	return archive.Data, nil
+}
+
+/*
+Collect the source of a function for a build with the given runtime. Dependency files not set on
+the function are taken from the archive if it has them. Git sources aren't fetched here; the
+builder fetches them, and uses the repository's dependency files over the runtime's defaults.
+*/
+func (fs *FunctionService) GetBuildSource(
+	function *models.Function,
+	runtime *runtimes.Runtime,
+) (*BuildSource, error) {
+	source := &BuildSource{}
+	manifest, lockfile := function.Dependencies, function.Lockfile
+
+	switch function.SourceType {
+	case string(constants.GitSource):
+		if err := utils.ValidateGitSource(function.GitURL, function.GitRef, function.GitSubdirectory); err != nil {
+			return nil, err
+		}
+		subdirectory, _ := utils.GitSubdirectory(function.GitSubdirectory)
+		source.Git = &kuberneteswrapper.GitSource{
+			URL:          function.GitURL,
+			Ref:          function.GitRef,
+			Subdirectory: subdirectory,
+		}
+		if manifest == "" && lockfile == "" {
+			defaults, err := runtime.DependencyFiles("", "")
+			if err != nil {
+				return nil, err
+			}
+			source.DefaultFiles = defaults
+			source.DependencyFiles = map[string]string{}
+			return source, nil
+		}
+	case string(constants.ArchiveSource):
+		data, err := fs.sourceArchive(function)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok, err := utils.ReadArchiveFile(data, runtime.SourceFile); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("source must contain %v", runtime.SourceFile)
+		}
+		if manifest == "" && runtime.DependencyFile != "" {
+			content, _, err := utils.ReadArchiveFile(data, runtime.DependencyFile)
+			if err != nil {
+				return nil, err
+			}
+			manifest = string(content)
+		}
+		if lockfile == "" && runtime.LockFile != "" {
+			content, _, err := utils.ReadArchiveFile(data, runtime.LockFile)
+			if err != nil {
+				return nil, err
+			}
+			lockfile = string(content)
+		}
+		source.Archive = data
+	default:
+		if function.Code == "" {
+			return nil, errors.New("Code is required")
+		}
+		source.Code = function.Code
+	}
+
+	dependencyFiles, err := runtime.DependencyFiles(manifest, lockfile)
+	if err != nil {
+		return nil, err
+	}
+	source.DependencyFiles = dependencyFiles
+	return source, nil
+}
+
+// Delete the secret with the function's git credentials
+func (fs *FunctionService) DeleteGitCredentials(
+	kw *kuberneteswrapper.KubernetesWrapper,
+	ctx context.Context,
+	namespace string,
+	functionId string,
+) error {
+	return kw.DeleteSecret(&kuberneteswrapper.DeleteOptions{
+		Ctx:       ctx,
+		Name:      kuberneteswrapper.GitCredentialsName(functionId),
+		Namespace: namespace,
+	})
+}
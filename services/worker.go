@@ -0,0 +1,335 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	kuberneteswrapper "github.com/Cloudbase-Project/serverless/KubernetesWrapper"
+	"github.com/Cloudbase-Project/serverless/constants"
+	"github.com/Cloudbase-Project/serverless/models"
+	"github.com/Cloudbase-Project/serverless/registry"
+	"github.com/Cloudbase-Project/serverless/runtimes"
+)
+
+/*
+Runs jobs in the background. Builds are handed to the build queue and followed from there,
+deployments are created and watched here. Jobs are persisted, so unfinished jobs are picked up
+again after a restart.
+*/
+type Worker struct {
+	l          *log.Logger
+	jobs       *JobService
+	functions  *FunctionService
+	queue      *BuildQueue
+	kw         *kuberneteswrapper.KubernetesWrapper
+	runtimes   *runtimes.Registry
+	registries *registry.Registries
+	env        *EnvService
+}
+
+func NewWorker(
+	l *log.Logger,
+	js *JobService,
+	fs *FunctionService,
+	q *BuildQueue,
+	kw *kuberneteswrapper.KubernetesWrapper,
+	rs *runtimes.Registry,
+	regs *registry.Registries,
+	es *EnvService,
+) *Worker {
+	return &Worker{l: l, jobs: js, functions: fs, queue: q, kw: kw, runtimes: rs, registries: regs, env: es}
+}
+
+// Pick up the jobs that were not finished when the server stopped
+func (w *Worker) Resume() {
+	jobs, err := w.jobs.unfinishedJobs()
+	if err != nil {
+		w.l.Print("Error reading unfinished jobs : ", err)
+		return
+	}
+	for _, job := range jobs {
+		w.l.Print("Resuming job ", job.ID)
+		switch constants.JobType(job.Type) {
+		case constants.BuildJob, constants.UpdateJob:
+			go w.followBuild(job)
+		case constants.DeployJob, constants.RedeployJob, constants.RollbackJob:
+			// a running deploy job already changed the deployment. only the watch is left
+			go w.runDeploy(job, job.Status == string(constants.JobRunning))
+		}
+	}
+}
+
+// Queue a build of the function and return the job following it. With deploy the function is deployed once it built
+func (w *Worker) SubmitBuild(
+	function *models.Function,
+	action constants.LastAction,
+	deploy bool,
+) (*models.Job, error) {
+	build, err := w.queue.Enqueue(function, action)
+	if err != nil {
+		return nil, err
+	}
+	jobType := constants.BuildJob
+	if action == constants.UpdateAction {
+		jobType = constants.UpdateJob
+	}
+	job, err := w.jobs.CreateJob(function, jobType, &build.ID, 0, deploy)
+	if err != nil {
+		return nil, err
+	}
+	go w.followBuild(job)
+	return job, nil
+}
+
+// Deploy the function in the background. jobType is DeployJob or RedeployJob
+func (w *Worker) SubmitDeploy(
+	function *models.Function,
+	jobType constants.JobType,
+) (*models.Job, error) {
+	job, err := w.jobs.CreateJob(function, jobType, nil, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	go w.runDeploy(job, false)
+	return job, nil
+}
+
+// Point the function's deployment back at an earlier revision in the background
+func (w *Worker) SubmitRollback(
+	function *models.Function,
+	revision *models.FunctionRevision,
+) (*models.Job, error) {
+	job, err := w.jobs.CreateJob(function, constants.RollbackJob, nil, revision.Number, false)
+	if err != nil {
+		return nil, err
+	}
+	go w.runDeploy(job, false)
+	return job, nil
+}
+
+// mirror the build's progress on the job until the build is done
+func (w *Worker) followBuild(job *models.Job) {
+	updates, cancel := w.queue.Subscribe(*job.BuildID)
+	defer cancel()
+
+	// the build may have moved on before we subscribed
+	build, err := w.queue.GetBuild(job.FunctionID.String(), job.BuildID.String())
+	if err != nil || build == nil {
+		w.jobs.Finish(job, false, string(constants.BuildFailed), "Build not found")
+		return
+	}
+	if w.buildChanged(job, build) {
+		return
+	}
+	w.jobs.Message(job, fmt.Sprintf("Build queued at position %v", build.QueuePosition))
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if position, err := w.queue.Position(build.ID); err == nil && position > 0 {
+				w.jobs.Message(job, fmt.Sprintf("Build queued at position %v", position))
+			}
+		case update, ok := <-updates:
+			if !ok {
+				// the build finished and its final state was dropped. read it back
+				if build, err = w.queue.GetBuild(job.FunctionID.String(), job.BuildID.String()); err == nil && build != nil {
+					w.buildChanged(job, build)
+				}
+				return
+			}
+			if w.buildChanged(job, &update) {
+				return
+			}
+		}
+	}
+}
+
+// update the job from the build. returns true once the build is done
+func (w *Worker) buildChanged(job *models.Job, build *models.Build) bool {
+	switch build.Status {
+	case string(constants.Queued):
+		return false
+	case string(constants.Building):
+		w.jobs.SetRunning(job)
+		w.jobs.Message(job, "Building Image for your code")
+		return false
+	}
+	succeeded := build.Status == string(constants.BuildSuccess)
+	w.jobs.Finish(job, succeeded, build.Status, build.FailReason)
+	if succeeded && job.AutoDeploy {
+		w.deployBuild(job)
+	}
+	return true
+}
+
+/*
+Whether the function has a deployment. A function whose first deploy failed has none, whatever
+its deploy status says.
+*/
+func (w *Worker) HasDeployment(function *models.Function) (bool, error) {
+	return w.kw.DeploymentExists(context.Background(), constants.Namespace, function.ID.String())
+}
+
+// deploy the function a build job built. the first deploy creates the deployment, later ones update it
+func (w *Worker) deployBuild(job *models.Job) {
+	function, err := w.functions.GetFunctionById(job.FunctionID.String())
+	if err != nil || function == nil {
+		w.l.Print("Cannot deploy after build ", job.ID, " : function not found")
+		return
+	}
+	exists, err := w.HasDeployment(function)
+	if err != nil {
+		w.l.Print("Cannot deploy after build ", job.ID, " : ", err)
+		return
+	}
+	jobType := constants.DeployJob
+	if exists {
+		jobType = constants.RedeployJob
+	}
+	function.DeployStatus = string(constants.Deploying)
+	w.functions.SaveFunction(function)
+	if _, err := w.SubmitDeploy(function, jobType); err != nil {
+		w.l.Print("Cannot deploy after build ", job.ID, " : ", err)
+	}
+}
+
+/*
+Create or update the function's deployment and watch it until it is available or fails. Deploys
+and redeploys run the function's latest image, rollbacks the image of the job's revision. Images
+are referenced by digest so a rollout always runs exactly the image that was built.
+Every run is recorded as a rollout in the function's deployment history.
+*/
+func (w *Worker) runDeploy(job *models.Job, resume bool) {
+	function, err := w.functions.GetFunctionById(job.FunctionID.String())
+	if err != nil || function == nil {
+		w.jobs.Finish(job, false, string(constants.DeploymentFailed), "Function not found")
+		return
+	}
+	runtime, ok := w.runtimes.Get(constants.Language(function.Language))
+	if !ok {
+		w.jobs.Finish(job, false, string(constants.DeploymentFailed), "Unsupported language : "+function.Language)
+		return
+	}
+
+	registryConfig, projectId, err := w.functions.registryFor(w.registries, function)
+	if err != nil {
+		w.jobs.Finish(job, false, string(constants.DeploymentFailed), err.Error())
+		return
+	}
+	image := functionImageRef(function, registryConfig, projectId)
+	revision := function.Revision
+	if constants.JobType(job.Type) == constants.RollbackJob {
+		target, err := w.functions.GetRevision(function.ID.String(), job.Revision)
+		if err != nil || target == nil {
+			w.jobs.Finish(job, false, string(constants.DeploymentFailed), "Revision not found")
+			return
+		}
+		image = revisionImageRef(target)
+		revision = target.Number
+	}
+	rollout, err := w.functions.startRollout(function, job, revision, image)
+	if err != nil {
+		w.l.Print("Error recording rollout : ", err)
+	}
+
+	w.jobs.SetRunning(job)
+	ctx := context.Background()
+	if !resume {
+		// every rollout runs with the function's current environment
+		var envChecksum string
+		var resources *FunctionResources
+		var probes *kuberneteswrapper.ProbeOptions
+		envChecksum, err = w.env.SyncEnv(w.kw, ctx, constants.Namespace, function.ID.String())
+		if err != nil {
+			err = fmt.Errorf("cannot sync environment: %w", err)
+		} else if resources, err = w.functions.Resources(function); err != nil {
+			err = fmt.Errorf("invalid resources: %w", err)
+		} else if probes, err = w.functions.Probes(function, runtime.Port, revision); err != nil {
+			err = fmt.Errorf("invalid probes: %w", err)
+		} else {
+			switch constants.JobType(job.Type) {
+			case constants.DeployJob:
+				err = w.functions.DeployFunction(
+					w.kw,
+					ctx,
+					constants.Namespace,
+					function.ID.String(),
+					map[string]string{"app": function.ID.String()},
+					image,
+					registryConfig.SecretName,
+					resources,
+					runtime.Port,
+					envChecksum,
+					probes,
+				)
+			case constants.RedeployJob:
+				err = w.kw.UpdateDeployment(&kuberneteswrapper.UpdateOptions{
+					Ctx:       ctx,
+					Namespace: constants.Namespace,
+					Name:      function.ID.String(),
+					// also undoes a rollback
+					ImageName:      image,
+					RegistrySecret: registryConfig.SecretName,
+					EnvChecksum:    envChecksum,
+					Resources:      &resources.Requirements,
+					Probes:         probes,
+				})
+			case constants.RollbackJob:
+				w.jobs.Message(job, fmt.Sprintf("Rolling back to revision %v", revision))
+				err = w.kw.UpdateDeployment(&kuberneteswrapper.UpdateOptions{
+					Ctx:            ctx,
+					Namespace:      constants.Namespace,
+					Name:           function.ID.String(),
+					ImageName:      image,
+					RegistrySecret: registryConfig.SecretName,
+					EnvChecksum:    envChecksum,
+					Resources:      &resources.Requirements,
+					Probes:         probes,
+				})
+			}
+			// updates also pick up changed replica bounds and scaling
+			if err == nil && constants.JobType(job.Type) != constants.DeployJob {
+				err = w.functions.applyScaler(w.kw, ctx, constants.Namespace, function.ID.String(), resources)
+			}
+		}
+		if err != nil {
+			w.l.Print(err)
+			function.DeployStatus = string(constants.DeploymentFailed)
+			function.DeployFailReason = err.Error()
+			w.functions.SaveFunction(function)
+			if rollout != nil {
+				w.functions.finishRollout(rollout, WatchResult{Status: function.DeployStatus, Reason: err.Error()})
+			}
+			w.jobs.Finish(job, false, function.DeployStatus, err.Error())
+			return
+		}
+	}
+
+	w.jobs.Message(job, "Deploying your function...")
+	result := w.functions.WatchDeployment(w.kw, ctx, function, constants.Namespace)
+	if result.Err != nil {
+		result = WatchResult{Status: string(constants.DeploymentFailed), Reason: result.Err.Error()}
+	}
+	if result.Idle {
+		w.jobs.Message(job, "Deployed (idle) : the function is scaled to zero and starts on its next request")
+	}
+
+	function.DeployFailReason = result.Reason
+	function.DeployStatus = result.Status
+	function.LastAction = string(constants.DeployAction)
+	if constants.JobType(job.Type) == constants.RollbackJob {
+		function.LastAction = string(constants.RollbackAction)
+	}
+	if result.Status == string(constants.Deployed) {
+		function.DeployedRevision = revision
+	}
+	w.functions.SaveFunction(function)
+	if rollout != nil {
+		w.functions.finishRollout(rollout, result)
+	}
+	w.jobs.Finish(job, result.Status == string(constants.Deployed), result.Status, result.Reason)
+}
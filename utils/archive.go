@@ -0,0 +1,284 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// max size of the normalized (gzipped tar) archive. it has to fit in a ConfigMap
+	MaxSourceArchiveSize = 900 * 1024
+	// max total size of the files in an archive once extracted
+	MaxSourceSize = 50 * 1024 * 1024
+	// max number of files in an archive
+	MaxSourceFiles = 5000
+)
+
+var ErrUnsupportedArchive = errors.New("unsupported archive. upload a tar.gz or zip file")
+
+type archiveFile struct {
+	name string
+	mode int64
+	data []byte
+}
+
+/*
+Checks a user uploaded tar.gz or zip archive and repacks it into a gzipped tar holding only
+regular files. Paths escaping the archive root, links and oversized archives are rejected.
+
+Returns the normalized archive and the number of files in it.
+*/
+func NormalizeArchive(data []byte) ([]byte, int, error) {
+	var files []archiveFile
+	var err error
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		files, err = readTarGz(data)
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		files, err = readZip(data)
+	default:
+		return nil, 0, ErrUnsupportedArchive
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(files) == 0 {
+		return nil, 0, errors.New("archive is empty")
+	}
+
+	normalized, err := writeTarGz(files)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(normalized) > MaxSourceArchiveSize {
+		return nil, 0, fmt.Errorf("archive is too large. max %v bytes compressed", MaxSourceArchiveSize)
+	}
+	return normalized, len(files), nil
+}
+
+/*
+Create a gzipped tar build context from a normalized archive (can be nil) and a set of files.
+Files replace archive entries with the same path. Content is stored byte for byte.
+*/
+func BuildContextArchive(base []byte, files map[string]string) ([]byte, error) {
+	var entries []archiveFile
+	if base != nil {
+		var err error
+		entries, err = readTarGz(base)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cleaned := map[string]string{}
+	var names []string
+	for name, content := range files {
+		name, err := cleanArchivePath(name)
+		if err != nil {
+			return nil, err
+		}
+		cleaned[name] = content
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	kept := entries[:0]
+	for _, entry := range entries {
+		if _, ok := cleaned[entry.name]; !ok {
+			kept = append(kept, entry)
+		}
+	}
+	for _, name := range names {
+		kept = append(kept, archiveFile{name: name, mode: 0644, data: []byte(cleaned[name])})
+	}
+	return writeTarGz(kept)
+}
+
+func writeTarGz(files []archiveFile) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     file.name,
+			Mode:     file.mode,
+			Size:     int64(len(file.data)),
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Unix(0, 0),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Read a single file from a normalized archive. ok is false if the file is not in it.
+func ReadArchiveFile(archive []byte, name string) (content []byte, ok bool, err error) {
+	files, err := readTarGz(archive)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, file := range files {
+		if file.name == name {
+			return file.data, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Write the files of a normalized archive into dir.
+func ExtractArchive(archive []byte, dir string) error {
+	files, err := readTarGz(archive)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		target := filepath.Join(dir, filepath.FromSlash(file.name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, file.data, os.FileMode(file.mode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clean an archive entry name. errors if it is absolute or escapes the archive root
+func cleanArchivePath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	cleaned := path.Clean(name)
+	if path.IsAbs(name) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("illegal path in archive: %v", name)
+	}
+	return cleaned, nil
+}
+
+// keeps track of the limits while reading an archive
+type archiveLimits struct {
+	size  int64
+	files int
+}
+
+func (l *archiveLimits) add(size int64) error {
+	l.size += size
+	l.files++
+	if l.size > MaxSourceSize {
+		return fmt.Errorf("archive is too large. max %v bytes extracted", MaxSourceSize)
+	}
+	if l.files > MaxSourceFiles {
+		return fmt.Errorf("archive has too many files. max %v", MaxSourceFiles)
+	}
+	return nil
+}
+
+// read at most limit bytes from r. errors if there is more
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("archive is too large. max %v bytes extracted", MaxSourceSize)
+	}
+	return data, nil
+}
+
+func readTarGz(data []byte) ([]archiveFile, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	var files []archiveFile
+	limits := &archiveLimits{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			return nil, fmt.Errorf("unsupported file type in archive: %v", header.Name)
+		}
+		name, err := cleanArchivePath(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		content, err := readLimited(tr, MaxSourceSize-limits.size)
+		if err != nil {
+			return nil, err
+		}
+		if err := limits.add(int64(len(content))); err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{name: name, mode: header.Mode&0755 | 0644, data: content})
+	}
+	return files, nil
+}
+
+func readZip(data []byte) ([]archiveFile, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []archiveFile
+	limits := &archiveLimits{}
+	for _, entry := range zr.File {
+		mode := entry.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		if !mode.IsRegular() {
+			return nil, fmt.Errorf("unsupported file type in archive: %v", entry.Name)
+		}
+		name, err := cleanArchivePath(entry.Name)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := readLimited(rc, MaxSourceSize-limits.size)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := limits.add(int64(len(content))); err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{name: name, mode: int64(mode.Perm()&0755 | 0644), data: content})
+	}
+	return files, nil
+}
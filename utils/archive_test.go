@@ -0,0 +1,309 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// an entry of a test archive. typeflag defaults to a regular file
+type entry struct {
+	name     string
+	body     string
+	size     int
+	typeflag byte
+	link     string
+}
+
+func (e entry) data() []byte {
+	if e.size > 0 {
+		return make([]byte, e.size)
+	}
+	return []byte(e.body)
+}
+
+func tarGz(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		typeflag := e.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: typeflag, Linkname: e.link}
+		if typeflag == tar.TypeReg {
+			header.Size = int64(len(e.data()))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if typeflag == tar.TypeReg {
+			if _, err := tw.Write(e.data()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		mode := os.FileMode(0644)
+		body := e.data()
+		if e.typeflag == tar.TypeSymlink {
+			mode = os.ModeSymlink | 0777
+			body = []byte(e.link)
+		}
+		header.SetMode(mode)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// n empty files
+func manyFiles(n int) []entry {
+	entries := make([]entry, n)
+	for i := range entries {
+		entries[i] = entry{name: fmt.Sprintf("f/%v.py", i)}
+	}
+	return entries
+}
+
+func TestCleanArchivePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "main.py", want: "main.py"},
+		{name: "./src/main.py", want: "src/main.py"},
+		{name: "src//lib/../main.py", want: "src/main.py"},
+		{name: "a/../b", want: "b"},
+		{name: "src\\main.py", want: "src/main.py"},
+		{name: "..", wantErr: true},
+		{name: "../main.py", wantErr: true},
+		{name: "src/../../main.py", wantErr: true},
+		{name: "..\\main.py", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+		{name: "\\etc\\passwd", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cleanArchivePath(tt.name)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("cleanArchivePath(%q) = %q, want an error", tt.name, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cleanArchivePath(%q) error = %v", tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("cleanArchivePath(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeArchive(t *testing.T) {
+	random := make([]byte, MaxSourceArchiveSize+1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+		files   map[string]string
+		err     string
+	}{
+		{
+			name: "tar.gz",
+			archive: func(t *testing.T) []byte {
+				return tarGz(t,
+					entry{name: "src/", typeflag: tar.TypeDir},
+					entry{name: "./main.py", body: "print(1)"},
+					entry{name: "src/lib.py", body: "x = 1"},
+				)
+			},
+			files: map[string]string{"main.py": "print(1)", "src/lib.py": "x = 1"},
+		},
+		{
+			name: "zip",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, entry{name: "main.py", body: "print(1)"}, entry{name: "src/lib.py", body: "x = 1"})
+			},
+			files: map[string]string{"main.py": "print(1)", "src/lib.py": "x = 1"},
+		},
+		{
+			name:    "tar.gz parent path",
+			archive: func(t *testing.T) []byte { return tarGz(t, entry{name: "../main.py", body: "x"}) },
+			err:     "illegal path",
+		},
+		{
+			name:    "tar.gz nested parent path",
+			archive: func(t *testing.T) []byte { return tarGz(t, entry{name: "src/../../main.py", body: "x"}) },
+			err:     "illegal path",
+		},
+		{
+			name:    "zip parent path",
+			archive: func(t *testing.T) []byte { return zipArchive(t, entry{name: "../../main.py", body: "x"}) },
+			err:     "illegal path",
+		},
+		{
+			name:    "tar.gz absolute path",
+			archive: func(t *testing.T) []byte { return tarGz(t, entry{name: "/etc/cron.d/job", body: "x"}) },
+			err:     "illegal path",
+		},
+		{
+			name:    "zip absolute path",
+			archive: func(t *testing.T) []byte { return zipArchive(t, entry{name: "/etc/cron.d/job", body: "x"}) },
+			err:     "illegal path",
+		},
+		{
+			name: "tar.gz symlink",
+			archive: func(t *testing.T) []byte {
+				return tarGz(t, entry{name: "main.py", typeflag: tar.TypeSymlink, link: "/etc/passwd"})
+			},
+			err: "unsupported file type",
+		},
+		{
+			name: "tar.gz hard link",
+			archive: func(t *testing.T) []byte {
+				return tarGz(t, entry{name: "a.py", body: "x"}, entry{name: "b.py", typeflag: tar.TypeLink, link: "a.py"})
+			},
+			err: "unsupported file type",
+		},
+		{
+			name: "zip symlink",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, entry{name: "main.py", typeflag: tar.TypeSymlink, link: "/etc/passwd"})
+			},
+			err: "unsupported file type",
+		},
+		{
+			name:    "tar.gz over the extracted size",
+			archive: func(t *testing.T) []byte { return tarGz(t, entry{name: "big.bin", size: MaxSourceSize + 1}) },
+			err:     "too large",
+		},
+		{
+			name: "tar.gz over the extracted size in total",
+			archive: func(t *testing.T) []byte {
+				return tarGz(t, entry{name: "a.bin", size: MaxSourceSize / 2}, entry{name: "b.bin", size: MaxSourceSize/2 + 1})
+			},
+			err: "too large",
+		},
+		{
+			name:    "zip over the extracted size",
+			archive: func(t *testing.T) []byte { return zipArchive(t, entry{name: "big.bin", size: MaxSourceSize + 1}) },
+			err:     "too large",
+		},
+		{
+			name:    "over the compressed size",
+			archive: func(t *testing.T) []byte { return tarGz(t, entry{name: "random.bin", body: string(random)}) },
+			err:     "too large",
+		},
+		{
+			name:    "tar.gz at the file limit",
+			archive: func(t *testing.T) []byte { return tarGz(t, manyFiles(MaxSourceFiles)...) },
+		},
+		{
+			name:    "tar.gz over the file limit",
+			archive: func(t *testing.T) []byte { return tarGz(t, manyFiles(MaxSourceFiles+1)...) },
+			err:     "too many files",
+		},
+		{
+			name:    "zip over the file limit",
+			archive: func(t *testing.T) []byte { return zipArchive(t, manyFiles(MaxSourceFiles+1)...) },
+			err:     "too many files",
+		},
+		{
+			name:    "empty",
+			archive: func(t *testing.T) []byte { return tarGz(t, entry{name: "src/", typeflag: tar.TypeDir}) },
+			err:     "empty",
+		},
+		{
+			name:    "not an archive",
+			archive: func(t *testing.T) []byte { return []byte("print(1)") },
+			err:     ErrUnsupportedArchive.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			normalized, count, err := NormalizeArchive(tt.archive(t))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("NormalizeArchive() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeArchive() error = %v", err)
+			}
+			if tt.files == nil {
+				return
+			}
+			if count != len(tt.files) {
+				t.Errorf("NormalizeArchive() count = %v, want %v", count, len(tt.files))
+			}
+			for name, want := range tt.files {
+				got, ok, err := ReadArchiveFile(normalized, name)
+				if err != nil || !ok {
+					t.Fatalf("ReadArchiveFile(%q) = %v, %v", name, ok, err)
+				}
+				if string(got) != want {
+					t.Errorf("ReadArchiveFile(%q) = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildContextArchive(t *testing.T) {
+	base, _, err := NormalizeArchive(tarGz(t, entry{name: "main.py", body: "old"}, entry{name: "lib.py", body: "x"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	context, err := BuildContextArchive(base, map[string]string{"./main.py": "new", "Dockerfile": "FROM python"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"main.py": "new", "lib.py": "x", "Dockerfile": "FROM python"} {
+		got, ok, err := ReadArchiveFile(context, name)
+		if err != nil || !ok || string(got) != want {
+			t.Errorf("ReadArchiveFile(%q) = %q, %v, %v, want %q", name, got, ok, err, want)
+		}
+	}
+
+	if _, err := BuildContextArchive(base, map[string]string{"../Dockerfile": "FROM python"}); err == nil {
+		t.Error("BuildContextArchive() with a parent path, want an error")
+	}
+}
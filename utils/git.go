@@ -0,0 +1,274 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+/*
+default ports of the accepted url schemes. only http(s), where the fetch can be pinned to the
+addresses that were checked; ssh and git would resolve the host again
+*/
+var gitPorts = map[string]string{"https": "443", "http": "80"}
+
+/*
+private, loopback, link-local, shared, benchmarking, documentation, reserved and translation
+ranges. git sources can't be fetched from them. ipv4 mapped addresses are checked as ipv4
+*/
+var internalNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"100::/64",
+	"2001:db8::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// names that resolve inside the cluster or the local network
+var internalSuffixes = []string{".local", ".localhost", ".internal", ".svc"}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+/*
+Checks a git source before it is stored. Only https and http urls of public hosts are accepted,
+so local paths, git's command running transports and hosts inside the cluster can't be used.
+Credentials don't belong in the url; they are set on the function.
+*/
+func ValidateGitSource(repository string, ref string, subdirectory string) error {
+	_, host, _, err := gitHost(repository)
+	if err != nil {
+		return err
+	}
+	if err := checkGitHost(host); err != nil {
+		return err
+	}
+	if strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \t\n:") {
+		return fmt.Errorf("invalid git ref %v", ref)
+	}
+	if _, err := GitSubdirectory(subdirectory); err != nil {
+		return err
+	}
+	return nil
+}
+
+// clean a subdirectory of a repository. "" for the root. errors if it leaves the repository
+func GitSubdirectory(subdirectory string) (string, error) {
+	if subdirectory == "" {
+		return "", nil
+	}
+	cleaned, err := cleanArchivePath(strings.Trim(subdirectory, "/"))
+	if err != nil {
+		return "", fmt.Errorf("invalid subdirectory %v", subdirectory)
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// scheme, host and port of a git url
+func gitHost(repository string) (string, string, string, error) {
+	u, err := url.Parse(repository)
+	if err != nil || u.Host == "" || strings.HasPrefix(u.Host, "-") {
+		return "", "", "", fmt.Errorf("invalid git url %v", repository)
+	}
+	port, ok := gitPorts[u.Scheme]
+	if !ok {
+		return "", "", "", fmt.Errorf("unsupported git url scheme %v", u.Scheme)
+	}
+	if _, ok := u.User.Password(); ok {
+		return "", "", "", errors.New("git url must not contain a password")
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return u.Scheme, u.Hostname(), port, nil
+}
+
+// errors for hosts that are or look internal. names are checked again once resolved
+func checkGitHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return checkGitAddress(host, ip)
+	}
+	// single label names are looked up in the cluster's search domains
+	if host == "localhost" || !strings.Contains(host, ".") {
+		return fmt.Errorf("git host %v is not public", host)
+	}
+	for _, suffix := range internalSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return fmt.Errorf("git host %v is not public", host)
+		}
+	}
+	return nil
+}
+
+func checkGitAddress(host string, ip net.IP) error {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() || ip.IsLinkLocalUnicast() {
+		return fmt.Errorf("git host %v is not public", host)
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("git host %v is not public", host)
+		}
+	}
+	return nil
+}
+
+/*
+Resolve the host of a git url and check every address it resolves to. Returns a curl resolve
+entry (host:port:addresses) that pins http and https fetches to the checked addresses, so the
+name can't be pointed elsewhere in between. Empty for ip hosts.
+*/
+func PinGitHost(ctx context.Context, repository string) (string, error) {
+	_, host, port, err := gitHost(repository)
+	if err != nil {
+		return "", err
+	}
+	if err := checkGitHost(host); err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return "", nil
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve git host %v : %w", host, err)
+	}
+	var pinned []string
+	for _, address := range addresses {
+		if err := checkGitAddress(host, address.IP); err != nil {
+			return "", err
+		}
+		if address.IP.To4() == nil {
+			pinned = append(pinned, "["+address.IP.String()+"]")
+		} else {
+			pinned = append(pinned, address.IP.String())
+		}
+	}
+	if len(pinned) == 0 {
+		return "", fmt.Errorf("git host %v has no addresses", host)
+	}
+	return host + ":" + port + ":" + strings.Join(pinned, ","), nil
+}
+
+/*
+Fetch one commit of a git repository and pack the files of subdirectory into a normalized
+archive, as if it had been uploaded. ref is a branch, tag or commit sha; the default branch
+when empty. Only that commit is fetched, without history. resolve is the entry from PinGitHost.
+Used by the local image builder; builders on the cluster fetch in the builder pod.
+
+Returns the archive, the number of files in it and the sha of the commit.
+*/
+func FetchGitSource(
+	ctx context.Context,
+	repository string,
+	ref string,
+	subdirectory string,
+	resolve string,
+) ([]byte, int, string, error) {
+	if err := ValidateGitSource(repository, ref, subdirectory); err != nil {
+		return nil, 0, "", err
+	}
+	subdirectory, _ = GitSubdirectory(subdirectory)
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	dir, err := os.MkdirTemp("", "git-source-")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := git(ctx, dir, "init", "-q"); err != nil {
+		return nil, 0, "", err
+	}
+	// redirects would go to hosts that weren't checked
+	fetch := []string{"-c", "http.followRedirects=false", "fetch", "-q", "--depth=1", "--no-tags", repository, ref}
+	if resolve != "" {
+		fetch = append([]string{"-c", "http.curloptResolve=" + resolve}, fetch...)
+	}
+	if _, err := git(ctx, dir, fetch...); err != nil {
+		return nil, 0, "", err
+	}
+	commit, err := git(ctx, dir, "rev-parse", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	commit = strings.TrimSpace(commit)
+
+	tree := commit
+	if subdirectory != "" {
+		tree += ":" + path.Clean(subdirectory)
+	}
+	archive, err := git(ctx, dir, "archive", "--format=tar.gz", tree)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	data, files, err := NormalizeArchive([]byte(archive))
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return data, files, commit, nil
+}
+
+// run git in dir without ever asking for credentials. errors carry what git printed
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		command := args[0]
+		// past -c name=value options
+		for i := 0; command == "-c" && i+2 < len(args); i += 2 {
+			command = args[i+2]
+		}
+		return "", fmt.Errorf("git %v: %v", command, message)
+	}
+	if stdout.Len() > MaxSourceSize {
+		return "", fmt.Errorf("source is too large. max %v bytes", MaxSourceSize)
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+)
+
+// Keeps the last few lines of a log. Safe for concurrent use
+type LogTail struct {
+	mu    sync.Mutex
+	lines []string
+	max   int
+}
+
+func NewLogTail(max int) *LogTail {
+	return &LogTail{max: max}
+}
+
+func (t *LogTail) Add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// the kept lines joined by newlines
+func (t *LogTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+// the last non empty line
+func (t *LogTail) Last() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.lines) - 1; i >= 0; i-- {
+		if strings.TrimSpace(t.lines[i]) != "" {
+			return t.lines[i]
+		}
+	}
+	return ""
+}
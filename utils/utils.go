@@ -4,20 +4,11 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 )
 
-// returns a fully qualified image name given a function id.
-//
-// eg: quay.io/ubuntu-project/ubuntu:latest
-func BuildImageName(functionId string) string {
-	// TODO: implement this
-	Registry := "ghcr.io"
-	Project := "cloudbase-project"
-
-	imageName := Registry + "/" + Project + "/" + functionId + ":latest"
-	return imageName
-}
-
 func FromJSON(body io.Reader, value interface{}) interface{} {
 	d := json.NewDecoder(body)
 	return d.Decode(value)
@@ -30,6 +21,36 @@ func BuildServiceName(functionId string) string {
 	return "cloudbase-serverless-" + functionId + "-srv"
 }
 
+// reads an integer env variable. returns def if it is not set or invalid
+func GetEnvInt(key string, def int) int {
+	if value, ok := os.LookupEnv(key); ok {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// read a duration like 30s or 6h from the environment. def if unset or invalid
+func GetEnvDuration(key string, def time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+// read a bool from the environment. def if unset or invalid
+func GetEnvBool(key string, def bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
 // set http headers
 func SetSSEHeaders(rw http.ResponseWriter) http.ResponseWriter {
 	rw.Header().Set("Access-Control-Allow-Origin", "*")
@@ -0,0 +1,196 @@
+/*
+Parsing and verification of git push webhooks from GitHub, GitLab and Gitea. Everything here
+works on the request headers and body only, without the network or the database.
+*/
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type Provider string
+
+const (
+	GitHub Provider = "GitHub"
+	GitLab Provider = "GitLab"
+	Gitea  Provider = "Gitea"
+)
+
+var (
+	// the request doesn't look like it came from a supported provider
+	ErrUnknownProvider = errors.New("unknown webhook provider")
+	// the signature or token is missing or doesn't match the secret
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// sha git sends as the new commit of a deleted branch
+const zeroCommit = "0000000000000000000000000000000000000000"
+
+// A push to a repository, whichever provider sent it
+type PushEvent struct {
+	Provider Provider
+	// full ref pushed to. refs/heads/<branch> or refs/tags/<tag>
+	Ref string
+	// commit the ref points to after the push
+	After string
+	// the push deleted the ref
+	Deleted bool
+	// the repository's default branch, if the provider sends it
+	DefaultBranch string
+}
+
+// The branch pushed to. empty if a tag was pushed
+func (e *PushEvent) Branch() string {
+	if !strings.HasPrefix(e.Ref, "refs/heads/") {
+		return ""
+	}
+	return strings.TrimPrefix(e.Ref, "refs/heads/")
+}
+
+/*
+Whether the push moved the branch a function builds from. ref is the function's git ref; an empty
+ref follows the default branch. Pushes to tags and deleted branches never match.
+*/
+func (e *PushEvent) Moves(ref string) bool {
+	branch := e.Branch()
+	if branch == "" || e.Deleted {
+		return false
+	}
+	if ref == "" {
+		return e.DefaultBranch != "" && branch == e.DefaultBranch
+	}
+	return branch == strings.TrimPrefix(ref, "refs/heads/")
+}
+
+// The provider that sent the request, from its event header
+func Detect(headers http.Header) (Provider, error) {
+	// gitea sends github's headers too, so it is checked first
+	switch {
+	case headers.Get("X-Gitea-Event") != "":
+		return Gitea, nil
+	case headers.Get("X-Gitlab-Event") != "":
+		return GitLab, nil
+	case headers.Get("X-GitHub-Event") != "":
+		return GitHub, nil
+	}
+	return "", ErrUnknownProvider
+}
+
+/*
+Check the request against the function's secret. GitHub and Gitea sign the body with an
+HMAC-SHA256 of the secret. GitLab doesn't sign, it sends the secret itself as a token.
+*/
+func Verify(provider Provider, headers http.Header, body []byte, secret string) error {
+	if secret == "" {
+		return ErrInvalidSignature
+	}
+	switch provider {
+	case GitHub:
+		return verifyHMAC(strings.TrimPrefix(headers.Get("X-Hub-Signature-256"), "sha256="), body, secret)
+	case Gitea:
+		return verifyHMAC(headers.Get("X-Gitea-Signature"), body, secret)
+	case GitLab:
+		token := headers.Get("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnknownProvider
+}
+
+// Sign a body the way GitHub and Gitea do. hex encoded HMAC-SHA256
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyHMAC(signature string, body []byte, secret string) error {
+	got, err := hex.DecodeString(signature)
+	if err != nil || len(got) == 0 {
+		return ErrInvalidSignature
+	}
+	want, _ := hex.DecodeString(Sign(body, secret))
+	if !hmac.Equal(got, want) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+/*
+Whether the request is a push. Other events, like GitHub's ping when a hook is created, are
+acknowledged and ignored.
+*/
+func IsPush(provider Provider, headers http.Header) bool {
+	switch provider {
+	case GitHub:
+		return headers.Get("X-GitHub-Event") == "push"
+	case Gitea:
+		return headers.Get("X-Gitea-Event") == "push"
+	case GitLab:
+		return headers.Get("X-Gitlab-Event") == "Push Hook"
+	}
+	return false
+}
+
+// payload of github and gitea push events. only the fields we need
+type githubPush struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+}
+
+// payload of gitlab push hooks. only the fields we need
+type gitlabPush struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Project struct {
+		DefaultBranch string `json:"default_branch"`
+	} `json:"project"`
+}
+
+// Parse the body of a push event
+func ParsePush(provider Provider, body []byte) (*PushEvent, error) {
+	event := &PushEvent{Provider: provider}
+	switch provider {
+	case GitHub, Gitea:
+		var payload githubPush
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("invalid push payload: %w", err)
+		}
+		event.Ref = payload.Ref
+		event.After = payload.After
+		event.Deleted = payload.Deleted
+		event.DefaultBranch = payload.Repository.DefaultBranch
+	case GitLab:
+		var payload gitlabPush
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("invalid push payload: %w", err)
+		}
+		event.Ref = payload.Ref
+		event.After = payload.After
+		event.DefaultBranch = payload.Project.DefaultBranch
+	default:
+		return nil, ErrUnknownProvider
+	}
+	// gitea and gitlab don't send a deleted flag
+	if event.After == zeroCommit {
+		event.Deleted = true
+	}
+	if event.Ref == "" {
+		return nil, errors.New("invalid push payload: no ref")
+	}
+	return event, nil
+}
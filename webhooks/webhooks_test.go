@@ -0,0 +1,280 @@
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const secret = "s3cr3t"
+
+// a recorded payload from testdata
+func payload(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func headers(pairs ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i < len(pairs); i += 2 {
+		h.Set(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    Provider
+		err     error
+	}{
+		{"github", headers("X-GitHub-Event", "push"), GitHub, nil},
+		{"gitlab", headers("X-Gitlab-Event", "Push Hook"), GitLab, nil},
+		// gitea sends github's headers as well
+		{"gitea", headers("X-Gitea-Event", "push", "X-GitHub-Event", "push"), Gitea, nil},
+		{"unknown", headers("X-Bitbucket-Event", "repo:push"), "", ErrUnknownProvider},
+		{"none", headers(), "", ErrUnknownProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Detect(tt.headers)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Detect() error = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("Detect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	github := payload(t, "github_push.json")
+	gitea := payload(t, "gitea_push.json")
+	gitlab := payload(t, "gitlab_push.json")
+	tampered := append(append([]byte{}, github...), ' ')
+
+	tests := []struct {
+		name     string
+		provider Provider
+		headers  http.Header
+		body     []byte
+		secret   string
+		err      error
+	}{
+		{"github valid", GitHub, headers("X-Hub-Signature-256", "sha256="+Sign(github, secret)), github, secret, nil},
+		{"github tampered body", GitHub, headers("X-Hub-Signature-256", "sha256="+Sign(github, secret)), tampered, secret, ErrInvalidSignature},
+		{"github wrong secret", GitHub, headers("X-Hub-Signature-256", "sha256="+Sign(github, "other")), github, secret, ErrInvalidSignature},
+		{"github missing header", GitHub, headers(), github, secret, ErrInvalidSignature},
+		{"github not hex", GitHub, headers("X-Hub-Signature-256", "sha256=zz"), github, secret, ErrInvalidSignature},
+		{"github sha1 header only", GitHub, headers("X-Hub-Signature", "sha1=0123"), github, secret, ErrInvalidSignature},
+		{"gitea valid", Gitea, headers("X-Gitea-Signature", Sign(gitea, secret)), gitea, secret, nil},
+		{"gitea tampered body", Gitea, headers("X-Gitea-Signature", Sign(gitea, secret)), gitea[1:], secret, ErrInvalidSignature},
+		{"gitea missing header", Gitea, headers(), gitea, secret, ErrInvalidSignature},
+		{"gitlab valid token", GitLab, headers("X-Gitlab-Token", secret), gitlab, secret, nil},
+		{"gitlab wrong token", GitLab, headers("X-Gitlab-Token", "s3cr3"), gitlab, secret, ErrInvalidSignature},
+		{"gitlab missing token", GitLab, headers(), gitlab, secret, ErrInvalidSignature},
+		{"no secret set", GitLab, headers("X-Gitlab-Token", ""), gitlab, "", ErrInvalidSignature},
+		{"unknown provider", Provider("Bitbucket"), headers(), github, secret, ErrUnknownProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.provider, tt.headers, tt.body, tt.secret)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestIsPush(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		headers  http.Header
+		want     bool
+	}{
+		{"github push", GitHub, headers("X-GitHub-Event", "push"), true},
+		{"github ping", GitHub, headers("X-GitHub-Event", "ping"), false},
+		{"github pull request", GitHub, headers("X-GitHub-Event", "pull_request"), false},
+		{"gitea push", Gitea, headers("X-Gitea-Event", "push"), true},
+		{"gitea create", Gitea, headers("X-Gitea-Event", "create"), false},
+		{"gitlab push", GitLab, headers("X-Gitlab-Event", "Push Hook"), true},
+		{"gitlab tag push", GitLab, headers("X-Gitlab-Event", "Tag Push Hook"), false},
+		{"gitlab merge request", GitLab, headers("X-Gitlab-Event", "Merge Request Hook"), false},
+		{"unknown provider", Provider("Bitbucket"), headers("X-GitHub-Event", "push"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPush(tt.provider, tt.headers); got != tt.want {
+				t.Errorf("IsPush() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePush(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		body     []byte
+		want     PushEvent
+		wantErr  bool
+	}{
+		{
+			name:     "github push",
+			provider: GitHub,
+			body:     payload(t, "github_push.json"),
+			want: PushEvent{
+				Provider:      GitHub,
+				Ref:           "refs/heads/main",
+				After:         "59b20b8d5c6ff8d09518454d4dd8b7b30f095ab5",
+				DefaultBranch: "main",
+			},
+		},
+		{
+			name:     "github branch deleted",
+			provider: GitHub,
+			body:     payload(t, "github_delete.json"),
+			want: PushEvent{
+				Provider:      GitHub,
+				Ref:           "refs/heads/feature",
+				After:         zeroCommit,
+				Deleted:       true,
+				DefaultBranch: "main",
+			},
+		},
+		{
+			name:     "gitea push",
+			provider: Gitea,
+			body:     payload(t, "gitea_push.json"),
+			want: PushEvent{
+				Provider:      Gitea,
+				Ref:           "refs/heads/develop",
+				After:         "bffeb74224043ba2feb48d137756c8a9331c449a",
+				DefaultBranch: "develop",
+			},
+		},
+		{
+			name:     "gitea branch deleted",
+			provider: Gitea,
+			body:     []byte(`{"ref":"refs/heads/old","after":"` + zeroCommit + `","repository":{"default_branch":"main"}}`),
+			want: PushEvent{
+				Provider:      Gitea,
+				Ref:           "refs/heads/old",
+				After:         zeroCommit,
+				Deleted:       true,
+				DefaultBranch: "main",
+			},
+		},
+		{
+			name:     "gitlab push",
+			provider: GitLab,
+			body:     payload(t, "gitlab_push.json"),
+			want: PushEvent{
+				Provider:      GitLab,
+				Ref:           "refs/heads/release",
+				After:         "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+				DefaultBranch: "master",
+			},
+		},
+		{
+			name:     "gitlab tag push",
+			provider: GitLab,
+			body:     payload(t, "gitlab_tag_push.json"),
+			want: PushEvent{
+				Provider:      GitLab,
+				Ref:           "refs/tags/v1.0.0",
+				After:         "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+				DefaultBranch: "master",
+			},
+		},
+		{name: "github ping has no ref", provider: GitHub, body: payload(t, "github_ping.json"), wantErr: true},
+		{name: "not json", provider: GitHub, body: []byte("ref=refs/heads/main"), wantErr: true},
+		{name: "gitlab not json", provider: GitLab, body: []byte("<xml/>"), wantErr: true},
+		{name: "unknown provider", provider: Provider("Bitbucket"), body: payload(t, "github_push.json"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePush(tt.provider, tt.body)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePush() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePush() error = %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("ParsePush() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoves(t *testing.T) {
+	main := &PushEvent{Ref: "refs/heads/main", DefaultBranch: "main"}
+	feature := &PushEvent{Ref: "refs/heads/feature", DefaultBranch: "main"}
+	deleted := &PushEvent{Ref: "refs/heads/main", Deleted: true, DefaultBranch: "main"}
+	tag := &PushEvent{Ref: "refs/tags/main", DefaultBranch: "main"}
+	// gitlab and gitea always send it, but a payload without it can't match an empty ref
+	noDefault := &PushEvent{Ref: "refs/heads/main"}
+
+	tests := []struct {
+		name  string
+		event *PushEvent
+		ref   string
+		want  bool
+	}{
+		{"branch name", main, "main", true},
+		{"full ref", main, "refs/heads/main", true},
+		{"other branch", feature, "main", false},
+		{"empty ref follows default branch", main, "", true},
+		{"empty ref ignores other branches", feature, "", false},
+		{"empty ref without default branch", noDefault, "", false},
+		{"deleted branch", deleted, "main", false},
+		{"deleted default branch", deleted, "", false},
+		{"tag with branch name", tag, "main", false},
+		{"tag ref", tag, "refs/tags/main", false},
+		{"prefix of branch", feature, "feat", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.event.Moves(tt.ref); got != tt.want {
+				t.Errorf("Moves(%q) on %v = %v, want %v", tt.ref, tt.event.Ref, got, tt.want)
+			}
+		})
+	}
+}
+
+// a payload parsed end to end, the way the handler sees it
+func TestRecordedPush(t *testing.T) {
+	body := payload(t, "github_push.json")
+	h := headers("X-GitHub-Event", "push", "X-Hub-Signature-256", "sha256="+Sign(body, secret))
+
+	provider, err := Detect(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(provider, h, body, secret); err != nil {
+		t.Fatal(err)
+	}
+	if !IsPush(provider, h) {
+		t.Fatal("IsPush() = false")
+	}
+	event, err := ParsePush(provider, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !event.Moves("") || !event.Moves("main") || event.Moves("develop") {
+		t.Errorf("Moves() doesn't match the pushed branch %v", event.Branch())
+	}
+}